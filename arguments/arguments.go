@@ -0,0 +1,181 @@
+// Package arguments parses the `arguments.txt` file, that
+// lists the dates to simulate when $START_FORECAST is not set.
+//
+// The first line of the file contains the name of the configuration
+// file used to produce the inputs, and is not used. Every following
+// line contains the start of a forecast, in format YYYYMMDDHH, its
+// duration in hours, and optionally a list of options, in the form
+// key=value, that change the simulation of that date only:
+//
+//	wrfda-runner.cfg
+//	# dates of the campaign
+//	2020112600 24
+//	2020112700 48 members=0 assimilate=false
+//	2020112800 48 profile=small
+//
+// Text following a `#` is a comment. Blank lines are ignored.
+package arguments
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// dateFormat is the format of the start of forecasts.
+const dateFormat = "2006010215"
+
+// Arguments contains the content of an `arguments.txt` file.
+type Arguments struct {
+	// ConfigFile is the name of the configuration
+	// file read from the first line.
+	ConfigFile string
+	Runs       []Run
+}
+
+// Run contains the start and duration of the forecast of
+// a single date, together with the options that change
+// its simulation.
+type Run struct {
+	Start    time.Time
+	Duration time.Duration
+	// Line is the number of the line declaring the run,
+	// or 0 when the run was not read from a file.
+	Line int
+	// Members, when not nil, overrides the
+	// number of members of the ensemble.
+	Members *int
+	// Assimilate, when not nil, overrides
+	// whether to assimilate observations.
+	Assimilate *bool
+	// Profile, when not empty, is the name of the
+	// configuration profile to apply.
+	Profile string
+}
+
+// ParseError is the error returned when a line
+// of an `arguments.txt` file is not valid.
+type ParseError struct {
+	File string
+	Line int
+	Msg  string
+}
+
+func (e ParseError) Error() string {
+	return fmt.Sprintf("%s:%d: %s", e.File, e.Line, e.Msg)
+}
+
+var _ error = ParseError{}
+
+// ReadFile reads and parses the `arguments.txt` file in path.
+func ReadFile(path string) (Arguments, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return Arguments{}, err
+	}
+	defer f.Close()
+	return Parse(f, path)
+}
+
+// Parse parses the content of an `arguments.txt` file read from r.
+// name is the name of the file, used in errors.
+func Parse(r io.Reader, name string) (Arguments, error) {
+	var args Arguments
+	headerRead := false
+	lines := map[time.Time]int{}
+
+	scan := bufio.NewScanner(r)
+	for line := 1; scan.Scan(); line++ {
+		fail := func(format string, a ...any) (Arguments, error) {
+			return Arguments{}, ParseError{File: name, Line: line, Msg: fmt.Sprintf(format, a...)}
+		}
+
+		text, _, _ := strings.Cut(scan.Text(), "#")
+		fields := strings.Fields(text)
+		if len(fields) == 0 {
+			continue
+		}
+
+		if !headerRead {
+			headerRead = true
+			if _, err := time.Parse(dateFormat, fields[0]); err == nil {
+				return fail("the first line must contain the name of the configuration file, found a date instead")
+			}
+			if len(fields) > 1 {
+				return fail("the first line must contain only the name of the configuration file")
+			}
+			args.ConfigFile = fields[0]
+			continue
+		}
+
+		run := Run{Line: line}
+		var err error
+		run.Start, err = time.Parse(dateFormat, fields[0])
+		if err != nil {
+			return fail("invalid start date `%s`: must be in format YYYYMMDDHH", fields[0])
+		}
+		if prev, ok := lines[run.Start]; ok {
+			return fail("start date %s already listed at line %d", fields[0], prev)
+		}
+		lines[run.Start] = line
+
+		if len(fields) < 2 {
+			return fail("missing duration of the forecast")
+		}
+		hours, err := strconv.Atoi(fields[1])
+		if err != nil || hours <= 0 {
+			return fail("invalid duration `%s`: must be a positive number of hours", fields[1])
+		}
+		run.Duration = time.Duration(hours) * time.Hour
+
+		for _, option := range fields[2:] {
+			if msg := run.setOption(option); msg != "" {
+				return fail("%s", msg)
+			}
+		}
+		args.Runs = append(args.Runs, run)
+	}
+	if err := scan.Err(); err != nil {
+		return Arguments{}, err
+	}
+	if !headerRead {
+		return Arguments{}, ParseError{File: name, Line: 1, Msg: "missing name of the configuration file"}
+	}
+	return args, nil
+}
+
+// setOption sets the option of run contained in option, in the form
+// key=value. It returns a description of the problem when option
+// is not valid, or an empty string otherwise.
+func (run *Run) setOption(option string) string {
+	key, value, ok := strings.Cut(option, "=")
+	if !ok {
+		return fmt.Sprintf("invalid option `%s`: options must be in the form key=value", option)
+	}
+	switch key {
+	case "members":
+		members, err := strconv.Atoi(value)
+		if err != nil || members < 0 {
+			return fmt.Sprintf("invalid option `%s`: members must be a number not negative", option)
+		}
+		run.Members = &members
+	case "assimilate":
+		assimilate, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Sprintf("invalid option `%s`: assimilate must be true or false", option)
+		}
+		run.Assimilate = &assimilate
+	case "profile":
+		if value == "" {
+			return fmt.Sprintf("invalid option `%s`: profile cannot be empty", option)
+		}
+		run.Profile = value
+	default:
+		return fmt.Sprintf("unknown option `%s`: valid options are members, assimilate and profile", key)
+	}
+	return ""
+}
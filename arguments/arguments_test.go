@@ -0,0 +1,111 @@
+package arguments_test
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/meteocima/ensemble-runner/arguments"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func date(day int) time.Time {
+	return time.Date(2020, 11, day, 0, 0, 0, 0, time.UTC)
+}
+
+func TestReadFile(t *testing.T) {
+	t.Run("Dates", func(t *testing.T) {
+		args, err := arguments.ReadFile("../fixtures/dates.txt")
+		require.NoError(t, err)
+		assert.Equal(t, "wrfda-runner.cfg", args.ConfigFile)
+		assert.Equal(t, []arguments.Run{
+			{Start: date(26), Duration: 24 * time.Hour, Line: 2},
+			{Start: date(27), Duration: 48 * time.Hour, Line: 3},
+		}, args.Runs)
+	})
+
+	t.Run("MissingHeader", func(t *testing.T) {
+		_, err := arguments.ReadFile("../fixtures/wrong.txt")
+		assert.EqualError(t, err, "../fixtures/wrong.txt:1: the first line must contain the name of the configuration file, found a date instead")
+	})
+
+	t.Run("UnknownOption", func(t *testing.T) {
+		_, err := arguments.ReadFile("../fixtures/wrong2.txt")
+		var parseErr arguments.ParseError
+		require.ErrorAs(t, err, &parseErr)
+		assert.Equal(t, 2, parseErr.Line)
+		assert.Equal(t, "invalid option `IT`: options must be in the form key=value", parseErr.Msg)
+	})
+
+	t.Run("NotExists", func(t *testing.T) {
+		_, err := arguments.ReadFile("../fixtures/missing.txt")
+		assert.Error(t, err)
+	})
+}
+
+func TestParse(t *testing.T) {
+	parse := func(content string) (arguments.Arguments, error) {
+		return arguments.Parse(strings.NewReader(content), "arguments.txt")
+	}
+
+	t.Run("CommentsAndOptions", func(t *testing.T) {
+		args, err := parse(`
+# produced by wps-da.gfs
+italy-config.gfs.cfg   # config
+
+2020112600 24
+  # reanalysis without ensemble
+2020112700 48 members=0 assimilate=false
+2020112800 12 profile=small members=4
+`)
+		require.NoError(t, err)
+		assert.Equal(t, "italy-config.gfs.cfg", args.ConfigFile)
+		require.Len(t, args.Runs, 3)
+
+		assert.Equal(t, arguments.Run{Start: date(26), Duration: 24 * time.Hour, Line: 5}, args.Runs[0])
+
+		run := args.Runs[1]
+		assert.Equal(t, 7, run.Line)
+		require.NotNil(t, run.Members)
+		assert.Equal(t, 0, *run.Members)
+		require.NotNil(t, run.Assimilate)
+		assert.False(t, *run.Assimilate)
+		assert.Empty(t, run.Profile)
+
+		run = args.Runs[2]
+		assert.Equal(t, 12*time.Hour, run.Duration)
+		assert.Equal(t, "small", run.Profile)
+		assert.Equal(t, 4, *run.Members)
+		assert.Nil(t, run.Assimilate)
+	})
+
+	t.Run("OnlyHeader", func(t *testing.T) {
+		args, err := parse("config.cfg\n")
+		require.NoError(t, err)
+		assert.Empty(t, args.Runs)
+	})
+
+	for _, tc := range []struct {
+		name    string
+		content string
+		err     string
+	}{
+		{"Empty", "\n# nothing\n", "arguments.txt:1: missing name of the configuration file"},
+		{"HeaderWithFields", "config.cfg 2020112600\n", "arguments.txt:1: the first line must contain only the name of the configuration file"},
+		{"ShortLine", "config.cfg\n20201126\n", "arguments.txt:2: invalid start date `20201126`: must be in format YYYYMMDDHH"},
+		{"InvalidDate", "config.cfg\n2020113200 24\n", "arguments.txt:2: invalid start date `2020113200`: must be in format YYYYMMDDHH"},
+		{"MissingDuration", "config.cfg\n\n2020112600\n", "arguments.txt:3: missing duration of the forecast"},
+		{"InvalidDuration", "config.cfg\n2020112600 -3\n", "arguments.txt:2: invalid duration `-3`: must be a positive number of hours"},
+		{"DuplicateDate", "config.cfg\n2020112600 24\n2020112600 48\n", "arguments.txt:3: start date 2020112600 already listed at line 2"},
+		{"UnknownOption", "config.cfg\n2020112600 24 member=3\n", "arguments.txt:2: unknown option `member`: valid options are members, assimilate and profile"},
+		{"InvalidMembers", "config.cfg\n2020112600 24 members=-1\n", "arguments.txt:2: invalid option `members=-1`: members must be a number not negative"},
+		{"InvalidAssimilate", "config.cfg\n2020112600 24 assimilate=maybe\n", "arguments.txt:2: invalid option `assimilate=maybe`: assimilate must be true or false"},
+		{"EmptyProfile", "config.cfg\n2020112600 24 profile=\n", "arguments.txt:2: invalid option `profile=`: profile cannot be empty"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := parse(tc.content)
+			assert.EqualError(t, err, tc.err)
+		})
+	}
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"bufio"
+	"context"
 	"encoding/json"
 	"fmt"
 	"os"
@@ -123,7 +124,7 @@ func deliverFile(ppc PostProcessCompleted, workDir string, startInstant time.Tim
 		// delivery raw aux files to continuum
 		cmd := fmt.Sprintf("scp %s del-continuum:/home/silvestro/Flood_Proofs_Italia2p0/MeteoModel/WrfOL/%s", ppc.FilePath, filepath.Base(ppc.FilePath))
 		log.Info("Start delivery file %s to continuum", filepath.Base(ppc.FilePath))
-		server.ExecRetry(cmd, workDir, "deliv-continuum.log", "deliv-continuum.log")
+		server.ExecRetry(context.Background(), cmd, workDir, "deliv-continuum.log", "deliv-continuum.log")
 		log.Info("Delivered file %s to continuum", filepath.Base(ppc.FilePath))
 	} else if ppc.Kind == WrfOutFile && ppc.Domain == 3 {
 
@@ -133,19 +134,19 @@ func deliverFile(ppc PostProcessCompleted, workDir string, startInstant time.Tim
 		// delivery AWS
 		cmd := fmt.Sprintf("scp %s del-repo:/share/wrf_repository/%s", ppc.FilePath, filename)
 		log.Info("Start delivery file %s to AWS", filename)
-		server.ExecRetry(cmd, workDir, "deliv-aws.log", "deliv-aws.log")
+		server.ExecRetry(context.Background(), cmd, workDir, "deliv-aws.log", "deliv-aws.log")
 		log.Info("Delivered file %s to AWS", filename)
 
 		// delivery VdA
 		cmd = fmt.Sprintf("scp %s del-vda:/home/WRF/%s", ppc.FilePath, filename)
 		log.Info("Start delivery file %s to VdA", filename)
-		server.ExecRetry(cmd, workDir, "deliv-vda.log", "deliv-vda.log")
+		server.ExecRetry(context.Background(), cmd, workDir, "deliv-vda.log", "deliv-vda.log")
 		log.Info("Delivered file %s to VdA", filename)
 
 		// delivery arpal
 		cmd = fmt.Sprintf("echo put %s /cima2lig/WRF/%s | sftp del-arpal", ppc.FilePath, filename)
 		log.Info("Start delivery file %s to ARPAL", filename)
-		server.ExecRetry(cmd, workDir, "deliv-arpal.log", "deliv-arpal.log")
+		server.ExecRetry(context.Background(), cmd, workDir, "deliv-arpal.log", "deliv-arpal.log")
 		log.Info("Delivered file %s to ARPAL", filename)
 
 	} else if ppc.Kind == Phase {
@@ -169,7 +170,7 @@ func deliverFile(ppc PostProcessCompleted, workDir string, startInstant time.Tim
 		// delivery AWS of phase index
 		cmd := fmt.Sprintf("scp %s del-repo:/share/wrf_repository/%s", phaseFname, filepath.Base(phaseFname))
 		log.Info("Start delivery file %s to AWS", filepath.Base(phaseFname))
-		server.ExecRetry(cmd, workDir, "deliv-aws.log", "deliv-aws.log")
+		server.ExecRetry(context.Background(), cmd, workDir, "deliv-aws.log", "deliv-aws.log")
 		log.Info("Delivered file %s to AWS", filepath.Base(phaseFname))
 		os.Remove(phaseFname)
 	} else if ppc.Kind == AuxFile && ppc.Domain == 3 {
@@ -177,10 +178,10 @@ func deliverFile(ppc PostProcessCompleted, workDir string, startInstant time.Tim
 
 		targetDir := fmt.Sprintf("/share/ol_leo/%s", startInstant.Format("2006-01-02-15"))
 		log.Info("Start delivery file %s to drihm", filepath.Base(ppc.FilePath))
-		server.ExecRetry("ssh drihm mkdir -p "+targetDir, workDir, "", "")
+		server.ExecRetry(context.Background(), "ssh drihm mkdir -p "+targetDir, workDir, "", "")
 
 		cmd := fmt.Sprintf("scp %s drihm:%s/%s", ppc.FilePath, targetDir, filepath.Base(ppc.FilePath))
-		server.ExecRetry(cmd, workDir, "deliv-dewetra-d01.log", "deliv-dewetra-d01.log")
+		server.ExecRetry(context.Background(), cmd, workDir, "deliv-dewetra-d01.log", "deliv-dewetra-d01.log")
 		log.Info("Delivered file %s to Dewetra", filepath.Base(ppc.FilePath))
 
 	} else if ppc.Kind == Completed {
@@ -191,10 +192,10 @@ func deliverFile(ppc PostProcessCompleted, workDir string, startInstant time.Tim
 		targetName := fmt.Sprintf("rg_wrf_d01-%s_00UTC.nc", startInstant.Format("2006010215"))
 
 		log.Info("Start delivery file %s to Dewetra World", targetName)
-		server.ExecRetry("ssh del-dewetra-world mkdir -p "+targetDir, workDir, "deliv-dewetra-d01.log", "deliv-dewetra-d01.log")
+		server.ExecRetry(context.Background(), "ssh del-dewetra-world mkdir -p "+targetDir, workDir, "deliv-dewetra-d01.log", "deliv-dewetra-d01.log")
 
 		cmd := fmt.Sprintf("scp %s del-dewetra-world:%s", filepath.Join(workDir, "results/aux", filename), filepath.Join(targetDir, targetName))
-		server.ExecRetry(cmd, workDir, "deliv-dewetra-d01.log", "deliv-dewetra-d01.log")
+		server.ExecRetry(context.Background(), cmd, workDir, "deliv-dewetra-d01.log", "deliv-dewetra-d01.log")
 		log.Info("Delivered file %s to Dewetra World", targetName)
 
 		// delivery domain 3 to Dewetra
@@ -202,16 +203,16 @@ func deliverFile(ppc PostProcessCompleted, workDir string, startInstant time.Tim
 		targetDir = fmt.Sprintf("/share/archivio/experience/data/MeteoModels/WRF_ARPAL/%04d/%02d/%02d/%04d", startInstant.Year(), startInstant.Month(), startInstant.Day(), startInstant.Hour())
 		targetName = fmt.Sprintf("rg_wrf-%s_00UTC.nc", startInstant.Format("200601021504"))
 		log.Info("Start delivery file %s to Dewetra", targetName)
-		server.ExecRetry("ssh del-dewetra mkdir -p "+targetDir, workDir, "", "")
+		server.ExecRetry(context.Background(), "ssh del-dewetra mkdir -p "+targetDir, workDir, "", "")
 
 		cmd = fmt.Sprintf("scp %s del-dewetra:%s", filepath.Join(workDir, "results/aux", filename), filepath.Join(targetDir, targetName))
-		server.ExecRetry(cmd, workDir, "deliv-dewetra-d01.log", "deliv-dewetra-d01.log")
+		server.ExecRetry(context.Background(), cmd, workDir, "deliv-dewetra-d01.log", "deliv-dewetra-d01.log")
 		log.Info("Delivered file %s to Dewetra", targetName)
 
 		// delivery domain 3 to AWS
 		cmd = fmt.Sprintf("scp %s del-repo:/share/wrf_repository/ol/%s", filepath.Join(workDir, "results/aux", filename), targetName)
 		log.Info("Start delivery file %s to AWS", targetName)
-		server.ExecRetry(cmd, workDir, "deliv-aws-tt-d01.log", "deliv-aws-tt-d01.log")
+		server.ExecRetry(context.Background(), cmd, workDir, "deliv-aws-tt-d01.log", "deliv-aws-tt-d01.log")
 		log.Info("Delivered file %s to AWS", targetName)
 
 	}
@@ -9,61 +9,87 @@ import (
 	"golang.org/x/exp/maps"
 )
 
-func main() {
-	if len(os.Args) < 3 {
-		fmt.Fprintf(os.Stderr, "Usage: dirprep [--print-vars] [--strict] <SRCDIR...> <DSTDIR>\n")
-		os.Exit(1)
-	}
+const usage = `Usage: dirprep [--print-vars] [--strict] <SRCDIR...> <DSTDIR>
+       dirprep [--print-vars] --check <SRCDIR...>
+`
 
-	var srcdirs []string
-	var dstdir string
+func main() {
+	var args []string
 	var printVars bool
 	var strict bool
+	var check bool
 	var resolvedVars = map[string]struct{}{}
-	for _, arg := range os.Args[1 : len(os.Args)-1] {
-		if arg == "--print-vars" {
+	for _, arg := range os.Args[1:] {
+		switch arg {
+		case "--print-vars":
 			printVars = true
-			continue
-		}
-		if arg == "--strict" {
+		case "--strict":
 			strict = true
-			continue
+		case "--check":
+			check = true
+		default:
+			args = append(args, arg)
+		}
+	}
+	if len(args) < 2 && !(check && len(args) == 1) {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(1)
+	}
+
+	// in strict and check mode, variables not
+	// defined in the environment are errors
+	lookup := os.LookupEnv
+	if !strict && !check {
+		lookup = func(key string) (string, bool) {
+			return os.Getenv(key), true
 		}
-		srcdirs = append(srcdirs, arg)
 	}
-	dstdir = os.Args[len(os.Args)-1]
-	xp := os.Getenv
 	if printVars {
-		prevXp := xp
-		xp = func(key string) string {
+		prevLookup := lookup
+		lookup = func(key string) (string, bool) {
 			resolvedVars[key] = struct{}{}
-			return prevXp(key)
+			return prevLookup(key)
 		}
 	}
-	if strict {
-		prevXp := xp
-		xp = func(key string) string {
-			if _, ok := os.LookupEnv(key); !ok {
-				fmt.Fprintf(os.Stderr, "Env variable not found: $%s\n", key)
+
+	if check {
+		failed := false
+		for _, srcdir := range args {
+			problems, err := dirprep.CheckDir(srcdir, lookup)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "%s\n", err)
 				os.Exit(1)
 			}
-			val := prevXp(key)
-
-			return val
+			for _, problem := range problems {
+				fmt.Fprintf(os.Stderr, "%s\n", problem)
+			}
+			failed = failed || len(problems) > 0
 		}
-	}
-	for _, srcdir := range srcdirs {
-		err := dirprep.RenderDirEnv(srcdir, dstdir, xp)
-		if err != nil {
-			fmt.Fprintf(os.Stderr, "%s\n", err)
+		printResolvedVars(printVars, resolvedVars)
+		if failed {
 			os.Exit(1)
 		}
+		return
 	}
-	if printVars {
-		names := maps.Keys(resolvedVars)
-		sort.Strings(names)
-		for _, name := range names {
-			fmt.Printf("$%s\n", name)
-		}
+
+	srcdirs, dstdir := args[:len(args)-1], args[len(args)-1]
+	err := dirprep.RenderDirsLookup(srcdirs, dstdir, lookup)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		os.Exit(1)
+	}
+	printResolvedVars(printVars, resolvedVars)
+}
+
+// printResolvedVars prints, when printVars is true,
+// the names of the variables in resolvedVars.
+func printResolvedVars(printVars bool, resolvedVars map[string]struct{}) {
+	if !printVars {
+		return
+	}
+	names := maps.Keys(resolvedVars)
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Printf("$%s\n", name)
 	}
 }
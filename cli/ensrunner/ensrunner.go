@@ -1,7 +1,14 @@
 package main
 
 import (
+	"context"
+	"flag"
+	"fmt"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
 
 	"github.com/meteocima/ensemble-runner/conf"
 	"github.com/meteocima/ensemble-runner/errors"
@@ -10,22 +17,93 @@ import (
 	"github.com/meteocima/ensemble-runner/simulation"
 )
 
+// setFlags collects the values of
+// every occurrence of the --set flag.
+type setFlags []string
+
+func (s *setFlags) String() string {
+	return strings.Join(*s, " ")
+}
+
+func (s *setFlags) Set(value string) error {
+	*s = append(*s, value)
+	return nil
+}
+
 func main() {
-	log.Info("WRF runner starting. Checking configuration...")
+	var opts simulation.Options
+	var overrides conf.Overrides
+	flag.BoolVar(&opts.Resume, "resume", false, "resume the simulation from the first step not completed by a previous run")
+	flag.BoolVar(&opts.Plan, "plan", false, "print the steps the simulation would run, without running them")
+	flag.StringVar(&overrides.Profile, "profile", "", "name of the configuration profile to apply")
+	flag.Var((*setFlags)(&overrides.Set), "set", "override a configuration value, in the form Key=Value. Can be repeated")
+	flag.Parse()
+	overrides.Env = os.Environ()
 
 	defer errors.OnFailuresDo(func(err errors.RunTimeError) {
 		log.Error("Simulation failed: %s\n", err)
 		os.Exit(1)
 	})
 
+	switch args := strings.Join(flag.Args(), " "); args {
+	case "":
+	case "config dump":
+		dumpConfig(overrides)
+		return
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command `%s`\n", args)
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	log.Info("WRF runner starting. Checking configuration...")
+
 	folders.Initialize(false)
-	conf.Initialize()
+	log.Info("Reading configuration from %s", filepath.Join(folders.Rootdir, "config.yaml"))
+	cfg := errors.CheckResult(conf.Load(folders.Rootdir, overrides))
+	cfg.Log()
 	log.SetLevel(log.LevelDebug)
 
+	ctx := stopOnSignals()
 	if _, ok := os.LookupEnv("START_FORECAST"); ok {
-		simulation.RunForecastFromEnv()
+		simulation.RunForecastFromEnv(ctx, cfg, opts)
 	} else {
-		simulation.RunForecastsFromInputs()
+		simulation.RunForecastsFromInputs(ctx, cfg, opts)
 	}
 
 }
+
+// stopOnSignals returns a context which is done when the process
+// receives SIGINT or SIGTERM, to stop all the running simulations
+// and the processes they started. A second signal terminates
+// the process immediately.
+func stopOnSignals() context.Context {
+	ctx, cancel := context.WithCancel(context.Background())
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		sig := <-signals
+		signal.Stop(signals)
+		log.Warning("Received %s: stopping all running processes...", sig)
+		cancel()
+	}()
+	return ctx
+}
+
+// dumpConfig prints the effective configuration, with
+// the source of every value, and exits. The configuration
+// is printed without checking it, nor the environment, since
+// it's needed to debug invalid configurations: the problems
+// found reading it are printed after it.
+func dumpConfig(overrides conf.Overrides) {
+	rootdir, ok := os.LookupEnv("ROOTDIR")
+	if !ok {
+		errors.FailF("cannot read environment variable $ROOTDIR")
+	}
+	cfg, err := conf.LoadUnchecked(os.ExpandEnv(rootdir), overrides)
+	if cfg == nil {
+		errors.Check(err)
+	}
+	errors.Check(cfg.Dump(os.Stdout))
+	errors.Check(err)
+}
@@ -11,25 +11,51 @@ import (
 
 func main() {
 	if len(os.Args) < 2 {
-		fmt.Fprintln(os.Stderr, "Usage: hosts 'slurm'|'cores'|<hosts string>")
+		fmt.Fprintln(os.Stderr, "Usage: hosts 'slurm'|'pbs'|'lsf'|'local'|'detect'|'hostfile' <path>|'cores'|'compress' <host>...|<hosts string>")
 		os.Exit(1)
 	}
 	if os.Args[1] == "cores" {
 		fmt.Printf("%d\n", runtime.NumCPU())
 		os.Exit(0)
 	}
-	var hostsStr string
-	if os.Args[1] == "slurm" {
-		var ok bool
-		hostsStr, ok = os.LookupEnv("SLURM_NODELIST")
-		if !ok {
-			fmt.Fprintln(os.Stderr, "$SLURM_NODELIST not set")
+	if os.Args[1] == "compress" {
+		fmt.Println(mpiman.SlurmNodesList(os.Args[2:]).Compress())
+		os.Exit(0)
+	}
+	var source mpiman.NodeSource
+	switch os.Args[1] {
+	case "slurm":
+		source = mpiman.Slurm{}
+	case "pbs":
+		source = mpiman.PBS{}
+	case "lsf":
+		source = mpiman.LSF{}
+	case "local":
+		source = mpiman.Localhost{}
+	case "hostfile":
+		if len(os.Args) < 3 {
+			fmt.Fprintln(os.Stderr, "Usage: hosts hostfile <path>")
+			os.Exit(1)
+		}
+		source = mpiman.Hostfile{Path: os.Args[2]}
+	case "detect":
+		source = mpiman.DetectNodeSource()
+		if source == nil {
+			fmt.Fprintln(os.Stderr, "none of $SLURM_NODELIST, $PBS_NODEFILE, $LSB_MCPU_HOSTS or $LSB_HOSTS is set")
 			os.Exit(1)
 		}
+	}
+
+	var hosts mpiman.SlurmNodes
+	var err error
+	if source == nil {
+		hosts, err = mpiman.ParseSlurmNodes(os.Args[1])
+	} else if !source.Available() {
+		fmt.Fprintf(os.Stderr, "%s not set\n", source)
+		os.Exit(1)
 	} else {
-		hostsStr = os.Args[1]
+		hosts, err = mpiman.DiscoverNodes(source)
 	}
-	hosts, err := mpiman.ParseSlurmNodes(hostsStr)
 	if err != nil {
 		if e, ok := err.(mpiman.ParseError); ok {
 			msg := fmt.Sprintf("Invalid hosts string at character %d: %s.\n", e.Pos, e.Msg)
@@ -40,7 +66,7 @@ func main() {
 			fmt.Fprintf(os.Stderr, "%s\n", e.Src)
 
 		} else {
-			fmt.Printf("Invalid hosts string at character: %s.\n", err)
+			fmt.Fprintf(os.Stderr, "Cannot read hosts: %s.\n", err)
 		}
 		os.Exit(1)
 	}
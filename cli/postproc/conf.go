@@ -3,17 +3,21 @@ package main
 import (
 	"os"
 
+	"github.com/meteocima/ensemble-runner/conf"
 	"github.com/meteocima/ensemble-runner/errors"
-	"gopkg.in/yaml.v3"
 )
 
 var Conf = struct {
 	PostprocRules map[string]string `yaml:"PostprocRules"`
+	// Domains is used to know which domains produce AUX files.
+	Domains []conf.Domain `yaml:"Domains"`
 }{}
 
 func ReadConf() {
 	cfgFile := "./config.yaml"
-	cfg := errors.CheckResult(os.ReadFile(cfgFile))
-	errors.Check(yaml.Unmarshal(cfg, &Conf))
+	errors.CheckResult(conf.Read(cfgFile, conf.Overrides{Env: os.Environ()}, &Conf))
+	if len(Conf.Domains) == 0 {
+		Conf.Domains = conf.LegacyDomains(false)
+	}
 
 }
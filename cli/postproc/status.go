@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"math"
 	"os"
@@ -45,12 +46,13 @@ type PostProcessCompleted struct {
 }
 
 type PostProcessStatus struct {
-	CompletedCh          <-chan PostProcessCompleted
-	SimWorkdir           string
-	SimStartInstant      time.Time
-	OUTDone              [49]bool
-	AUXDoneD1            [49]bool
-	AUXDoneD3            [49]bool
+	CompletedCh     <-chan PostProcessCompleted
+	SimWorkdir      string
+	SimStartInstant time.Time
+	OUTDone         [49]bool
+	// AUXDone contains, for every domain that produces AUX
+	// files, the hours for which they have been postprocessed.
+	AUXDone              map[int]*[49]bool
 	FinalAUXPostProcDone bool
 	OutPhasesDone        [4]bool
 	Done                 chan struct{}
@@ -65,13 +67,11 @@ func (stat *PostProcessStatus) Run() {
 	for completed := range stat.CompletedCh {
 		fmt.Fprintf(postProcd, `{"domain": %d, "progr": %d, "kind": "%s", "file": "%s"}`+"\n", completed.Domain, completed.ProgrHour, completed.Kind.String(), completed.FilePath)
 		if completed.Kind == AuxFile {
-			if completed.Domain == 1 {
-				stat.AUXDoneD1[completed.ProgrHour] = true
-			} else if completed.Domain == 3 {
-				stat.AUXDoneD3[completed.ProgrHour] = true
-			} else {
+			auxDone, ok := stat.AUXDone[completed.Domain]
+			if !ok {
 				errors.FailF("Unknown domain for AUX file %s: %d", completed.FilePath, completed.Domain)
 			}
+			auxDone[completed.ProgrHour] = true
 
 			stat.checkAllAUXCompleted(completed, postProcd)
 		} else if completed.Kind == WrfOutFile {
@@ -103,19 +103,17 @@ func (stat *PostProcessStatus) checkAllPostProcessingCompleted(postProcd *os.Fil
 }
 func (stat *PostProcessStatus) checkAllAUXCompleted(completed PostProcessCompleted, postProcd *os.File) {
 	for i := 0; i <= stat.TotHours; i++ {
-		if !stat.AUXDoneD1[i] {
-			return
-		}
-
-		if !stat.AUXDoneD3[i] {
-			return
+		for _, auxDone := range stat.AUXDone {
+			if !auxDone[i] {
+				return
+			}
 		}
 	}
 
 	script := filepath.Join(folders.Rootdir, "scripts/postproc-aux-end.sh")
 	logf := "postproc-aux-end.log"
 	log.Info("Running final merge of AUX files")
-	server.ExecRetry(script, stat.SimWorkdir, logf, logf,
+	server.ExecRetry(context.Background(), script, stat.SimWorkdir, logf, logf,
 		"SIM_WORKDIR", stat.SimWorkdir,
 		"RUNDATE", stat.SimStartInstant.Format("2006-01-02-15"),
 	)
@@ -2,6 +2,7 @@ package main
 
 import (
 	"bufio"
+	"context"
 	"fmt"
 	"path/filepath"
 	"regexp"
@@ -59,7 +60,7 @@ func (w *Worker) runCommand(ppc PostProcessCommand) {
 	log.Info("Running postprocessing for file %s", file)
 	log.Debug("\t Command for file %s: `%s` ", file, ppc.Cmd)
 
-	server.Exec(ppc.Cmd, w.SimWorkdir, "",
+	server.Exec(context.Background(), ppc.Cmd, w.SimWorkdir, "",
 		"FILE_PATH", ppc.FilePath,
 		"FILE", file,
 		"DIR", filepath.Dir(ppc.FilePath),
@@ -115,14 +116,20 @@ func RunPostProcessing(startInstant time.Time, totHours int) {
 	simWorkdir := simulation.Workdir(startInstant)
 	outfile := filepath.Join(simWorkdir, "output_files.log")
 
+	auxDone := map[int]*[49]bool{}
+	for domain, dom := range Conf.Domains {
+		if dom.PostprocAux {
+			auxDone[domain+1] = &[49]bool{}
+		}
+	}
+
 	completedCh := make(chan PostProcessCompleted)
 	status := PostProcessStatus{
 		CompletedCh:          completedCh,
 		SimWorkdir:           simWorkdir,
 		SimStartInstant:      startInstant,
 		OUTDone:              [49]bool{},
-		AUXDoneD1:            [49]bool{},
-		AUXDoneD3:            [49]bool{},
+		AUXDone:              auxDone,
 		FinalAUXPostProcDone: false,
 		OutPhasesDone:        [4]bool{},
 		Done:                 make(chan struct{}),
@@ -1,16 +1,18 @@
 package conf
 
 import (
+	"fmt"
 	"os"
 	"path/filepath"
+	"time"
 
-	"github.com/meteocima/ensemble-runner/errors"
-	"github.com/meteocima/ensemble-runner/folders"
+	"github.com/meteocima/ensemble-runner/arguments"
 	"github.com/meteocima/ensemble-runner/log"
-	"gopkg.in/yaml.v3"
 )
 
-var Values = struct {
+// Config contains the configuration of a simulation,
+// as read from the `config.yaml` file by Load.
+type Config struct {
 	// GeogridProcCount is the number of cores to use for geogrid.exe
 	GeogridProcCount int `yaml:"GeogridProc"`
 	// MetgridProcCount is the number of cores to use for metgrid.exe
@@ -28,6 +30,15 @@ var Values = struct {
 	// MpiOptions contains additional options to pass to the mpirun command
 	// when running the WRF executables.
 	MpiOptions string `yaml:"MpiOptions"`
+	// MpiRankfile, when true, makes mpirun place the processes on the
+	// cores allocated to them using a rankfile, instead of `-host`.
+	MpiRankfile bool `yaml:"MpiRankfile"`
+	// Launchers contains the configuration of the launchers used to
+	// run the MPI executables, indexed by the name of the executable
+	// (see Executables), or by `default` for the executables that
+	// are not listed. When omitted, executables are run using
+	// `mpiexec` or `mpirun`, with MpiOptions.
+	Launchers map[string]LauncherConfig `yaml:"Launchers"`
 	// ObDataDir is the directory where the observation data is stored.
 	ObDataDir string `yaml:"ObDataDir"`
 	// GeogDataDir is the directory where the input geogrid static data is stored.
@@ -47,67 +58,302 @@ var Values = struct {
 	// EnsembleParallelism contains the number of ensemble members to run in parallel
 	// The main control forecast is scheduled taking into accounts this value for parallelism,
 	// so `EnsembleParallelism` must be at least 1, even when no ensemble members is needed.
+	// The same limit applies to every other MPI step that can run concurrently,
+	// such as the assimilation of different domains in the same cycle.
 	EnsembleParallelism int `yaml:"EnsembleParallelism"`
+	// AllocationTimeout is the maximum time an MPI step waits for the
+	// cores it needs to be released by the running ones. When omitted,
+	// steps wait until the cores are free.
+	AllocationTimeout time.Duration `yaml:"AllocationTimeout"`
+	// Timeouts contains the maximum time every process of the
+	// simulation can run, including its retries, indexed by the
+	// name of the process (see Processes). Processes still running
+	// when their timeout expires are stopped, and fail. When
+	// omitted, processes have no timeout.
+	Timeouts map[string]time.Duration `yaml:"Timeouts"`
+	// RestartInterval is the interval at which wrf.exe writes the
+	// restart files of the control forecast and of the ensemble
+	// members, passed to the templates in minutes as variable
+	// RESTART_INTERVAL. When omitted, the interval set in the
+	// templates is used.
+	RestartInterval time.Duration `yaml:"RestartInterval"`
+	// Retries contains the policy used to retry the processes that
+	// fail, indexed by the name of the process (see Processes), or
+	// by `default` for the processes that are not listed. Failures
+	// that would happen again, such as a CFL violation or a missing
+	// input file, are never retried.
+	Retries map[string]RetryConfig `yaml:"Retries"`
+	// QuarantineAfter is the number of consecutive failures of MPI
+	// processes on a node after which the node is not used anymore
+	// by the simulation. When omitted, nodes are quarantined after
+	// 3 failures.
+	QuarantineAfter int `yaml:"QuarantineAfter"`
+	// DateParallelism is the number of dates read from `arguments.txt`
+	// to run concurrently. Nodes of the allocation are split in as many
+	// disjoint pools, one for every date running. When omitted, dates
+	// are run one after another, using the whole allocation.
+	DateParallelism int `yaml:"DateParallelism"`
 
 	// Whether to assimilate observations or not.
 	AssimilateObservations bool `yaml:"AssimilateObservations"`
 	// Whether to assimilate observations only in the inner domain, or in the outer ones too.
+	// This value is used only when Domains is not set.
 	AssimilateOnlyInnerDomain bool `yaml:"AssimilateOnlyInnerDomain"`
+	// Domains contains the configuration of every nested domain of the simulation,
+	// from the outermost to the innermost one. When omitted, the simulation
+	// uses 3 domains, assimilating according to AssimilateOnlyInnerDomain.
+	Domains []Domain `yaml:"Domains"`
 	// Whether to assimilate observations only in the first cycle, or in each one of them.
 	AssimilateFirstCycle bool `yaml:"AssimilateFirstCycle"`
+	// AssimilationCycles contains the schedule of the assimilation cycles.
+	// When omitted, 3 cycles are run, 3 hours apart.
+	AssimilationCycles AssimilationCycles `yaml:"AssimilationCycles"`
 	// Number of cores per node in the cluster where the simulation is run.
 	// This is used to calculate which nodes to use for each one of the ensemble members.
 	CoresPerNode int `yaml:"CoresPerNode"`
-}{}
+	// Scheduler is the batch scheduler that allocated the nodes of
+	// the simulation (see Schedulers). When omitted, nodes are read
+	// from Hostfile if it's set, or from the environment variables of
+	// the first one found among Slurm, PBS and LSF.
+	Scheduler string `yaml:"Scheduler"`
+	// Hostfile is the path of a file listing the nodes available
+	// to the simulation, one per line, used when Scheduler is
+	// `hostfile` or omitted.
+	Hostfile string `yaml:"Hostfile"`
+	// PostprocRules contains the commands used by postproc to process
+	// the files produced by the simulation, indexed by a regular
+	// expression matching their names.
+	PostprocRules map[string]string `yaml:"PostprocRules"`
 
-func Initialize() {
-	cfgFile := filepath.Join(folders.Rootdir, "config.yaml")
-	log.Info("Reading configuration from %s", cfgFile)
-	cfg := errors.CheckResult(os.ReadFile(cfgFile))
-	//fmt.Printf("Configuration:\n %s\n", cfg)
-	errors.Check(os.Chdir(folders.Rootdir))
-	errors.Check(yaml.Unmarshal(cfg, &Values))
+	// sources contains where every value was read from.
+	sources Sources
+	// rootdir and overrides are the arguments Load was
+	// called with, used to load the profiles of runs.
+	rootdir   string
+	overrides Overrides
+}
+
+// Domain contains the configuration of a single
+// nested domain of the simulation.
+type Domain struct {
+	// Whether to assimilate observations in the domain.
+	Assimilate bool `yaml:"Assimilate"`
+	// Whether the domain produces AUX files that must
+	// be postprocessed. This is used by postproc to know
+	// when the final merge of AUX files can start.
+	PostprocAux bool `yaml:"PostprocAux"`
+}
+
+// LegacyDomains returns the configuration of the 3
+// domains used when Domains is omitted in config file.
+func LegacyDomains(assimilateOnlyInnerDomain bool) []Domain {
+	return []Domain{
+		{Assimilate: !assimilateOnlyInnerDomain, PostprocAux: true},
+		{Assimilate: !assimilateOnlyInnerDomain},
+		{Assimilate: true, PostprocAux: true},
+	}
+}
+
+// AssimilationCycles contains the schedule of the
+// assimilation cycles run before the forecast.
+type AssimilationCycles struct {
+	// Count is the number of cycles. The last cycle
+	// happens at the start of the forecast.
+	Count int `yaml:"Count"`
+	// Interval is the time between the start of two consecutive
+	// cycles, which is also the duration of the wrf.exe run that
+	// advances the results of a cycle to the next one.
+	// It must be a whole number of hours.
+	Interval time.Duration `yaml:"Interval"`
+	// Window is the width of the assimilation window,
+	// centered at the analysis time of every cycle.
+	Window time.Duration `yaml:"Window"`
+}
+
+// DefaultAssimilationCycles returns the schedule of the
+// assimilation cycles used when it's omitted in config file.
+func DefaultAssimilationCycles() AssimilationCycles {
+	return AssimilationCycles{
+		Count:    3,
+		Interval: 3 * time.Hour,
+		Window:   2 * time.Hour,
+	}
+}
+
+// Load reads the configuration from the `config.yaml` file
+// in rootdir, merged with the files it includes, the selected
+// profile and overrides, as described in Read, and checks it.
+// Keys that are unknown and wrong values are reported all
+// together, returning a ValidationError. Load does not check the
+// environment: the nodes, directories and files needed to run the
+// simulations are checked by CheckEnvironment.
+//
+// Relative directories are resolved against rootdir. Load
+// does not change the working directory nor the environment
+// of the process: the values needed by templates are
+// returned by Config.Env.
+func Load(rootdir string, overrides Overrides) (*Config, error) {
+	cfg, problems, err := load(rootdir, overrides)
+	if err != nil {
+		return nil, err
+	}
+	problems = append(problems, cfg.validate()...)
+	if len(problems) > 0 {
+		return nil, ValidationError{File: filepath.Join(rootdir, "config.yaml"), Problems: problems}
+	}
+	return cfg, nil
+}
+
+// LoadUnchecked reads the configuration as Load does, but does
+// not check its values, so that it can be inspected also when it's
+// not valid, e.g. to dump it. The configuration is returned also
+// when keys are unknown or values have the wrong type: the
+// ValidationError returned describes these problems.
+func LoadUnchecked(rootdir string, overrides Overrides) (*Config, error) {
+	cfg, problems, err := load(rootdir, overrides)
+	if err != nil {
+		return nil, err
+	}
+	if len(problems) > 0 {
+		return cfg, ValidationError{File: filepath.Join(rootdir, "config.yaml"), Problems: problems}
+	}
+	return cfg, nil
+}
+
+// load reads the configuration from the `config.yaml` file in
+// rootdir, applying overrides, and sets the default values. It
+// returns the problems found reading it, without checking its values.
+func load(rootdir string, overrides Overrides) (*Config, []string, error) {
+	cfgFile := filepath.Join(rootdir, "config.yaml")
+	if _, err := os.Stat(cfgFile); err != nil {
+		return nil, nil, err
+	}
+
+	cfg := Config{rootdir: rootdir, overrides: overrides}
+	var problems []string
+	cfg.sources, problems = read(cfgFile, overrides, &cfg, true)
+
+	if len(cfg.Domains) == 0 {
+		cfg.Domains = LegacyDomains(cfg.AssimilateOnlyInnerDomain)
+	}
+
+	if cfg.DateParallelism == 0 {
+		cfg.DateParallelism = 1
+	}
+
+	if cfg.QuarantineAfter == 0 {
+		cfg.QuarantineAfter = 3
+	}
+
+	cycles := &cfg.AssimilationCycles
+	defaultCycles := DefaultAssimilationCycles()
+	if cycles.Count == 0 {
+		cycles.Count = defaultCycles.Count
+	}
+	if cycles.Interval == 0 {
+		cycles.Interval = defaultCycles.Interval
+	}
+	if cycles.Window == 0 {
+		cycles.Window = defaultCycles.Window
+	}
 
 	for _, dir := range []*string{
-		&Values.ObDataDir,
-		&Values.GeogDataDir,
-		&Values.GfsDir,
-		&Values.CovarMatrixesDir,
+		&cfg.ObDataDir,
+		&cfg.GeogDataDir,
+		&cfg.GfsDir,
+		&cfg.CovarMatrixesDir,
 	} {
-		if !filepath.IsAbs(*dir) {
-			*dir = errors.CheckResult(filepath.Abs(*dir))
+		if *dir != "" && !filepath.IsAbs(*dir) {
+			*dir = filepath.Join(rootdir, *dir)
 		}
 	}
+	if cfg.Hostfile != "" && !filepath.IsAbs(cfg.Hostfile) {
+		cfg.Hostfile = filepath.Join(rootdir, cfg.Hostfile)
+	}
 
-	for name, value := range map[string]string{
-		"GEOG_DATA": Values.GeogDataDir,
-		"GFS":       Values.GfsDir,
-		"BE_DIR":    Values.CovarMatrixesDir,
-		"MPIOPTS":   Values.MpiOptions,
-		"OB_DATDIR": Values.ObDataDir,
-	} {
-		errors.Check(os.Setenv(name, value))
+	return &cfg, problems, nil
+}
+
+// ForRun returns the configuration to use for the simulation
+// of run: when run selects a profile, the configuration is loaded
+// again applying it, then the values overridden by run are set.
+// When run changes nothing, cfg itself is returned.
+func (cfg *Config) ForRun(run arguments.Run) (*Config, error) {
+	res := cfg
+	if run.Profile != "" {
+		overrides := cfg.overrides
+		overrides.Profile = run.Profile
+		var err error
+		if res, err = Load(cfg.rootdir, overrides); err != nil {
+			return nil, err
+		}
+	}
+	if run.Members == nil && run.Assimilate == nil {
+		return res, nil
+	}
+
+	runCfg := *res
+	if run.Members != nil {
+		runCfg.EnsembleMembers = *run.Members
+	}
+	if run.Assimilate != nil {
+		runCfg.AssimilateObservations = *run.Assimilate
+	}
+	if problems := runCfg.validate(); len(problems) > 0 {
+		return nil, ValidationError{File: filepath.Join(runCfg.rootdir, "config.yaml"), Problems: problems}
 	}
+	return &runCfg, nil
+}
+
+// Env returns pairs of name and value of the environment
+// variables through which the configuration is made
+// available to the commands rendering templates.
+func (cfg *Config) Env() []string {
+	env := []string{
+		"GEOG_DATA", cfg.GeogDataDir,
+		"GFS", cfg.GfsDir,
+		"BE_DIR", cfg.CovarMatrixesDir,
+		"MPIOPTS", cfg.MpiOptions,
+		"OB_DATDIR", cfg.ObDataDir,
+	}
+	if cfg.RestartInterval > 0 {
+		env = append(env, "RESTART_INTERVAL", fmt.Sprintf("%.0f", cfg.RestartInterval.Minutes()))
+	}
+	return env
+}
 
+// Log writes all values of the configuration to the log.
+func (cfg *Config) Log() {
 	for name, value := range map[string]any{
-		"GeogridProcCount":          Values.GeogridProcCount,
-		"MetgridProcCount":          Values.MetgridProcCount,
-		"WrfProcCount":              Values.WrfProcCount,
-		"WrfStepProcCount":          Values.WrfStepProcCount,
-		"WrfdaProcCount":            Values.WrfdaProcCount,
-		"RealProcCount":             Values.RealProcCount,
-		"MpiOptions":                Values.MpiOptions,
-		"ObDataDir":                 Values.ObDataDir,
-		"GeogDataDir":               Values.GeogDataDir,
-		"GfsDir":                    Values.GfsDir,
-		"CovarMatrixesDir":          Values.CovarMatrixesDir,
-		"RunWPS":                    Values.RunWPS,
-		"EnsembleMembers":           Values.EnsembleMembers,
-		"EnsembleParallelism":       Values.EnsembleParallelism,
-		"AssimilateOnlyInnerDomain": Values.AssimilateOnlyInnerDomain,
-		"AssimilateFirstCycle":      Values.AssimilateFirstCycle,
+		"GeogridProcCount":          cfg.GeogridProcCount,
+		"MetgridProcCount":          cfg.MetgridProcCount,
+		"WrfProcCount":              cfg.WrfProcCount,
+		"WrfStepProcCount":          cfg.WrfStepProcCount,
+		"WrfdaProcCount":            cfg.WrfdaProcCount,
+		"RealProcCount":             cfg.RealProcCount,
+		"MpiOptions":                cfg.MpiOptions,
+		"MpiRankfile":               cfg.MpiRankfile,
+		"Launchers":                 cfg.Launchers,
+		"ObDataDir":                 cfg.ObDataDir,
+		"GeogDataDir":               cfg.GeogDataDir,
+		"GfsDir":                    cfg.GfsDir,
+		"CovarMatrixesDir":          cfg.CovarMatrixesDir,
+		"RunWPS":                    cfg.RunWPS,
+		"EnsembleMembers":           cfg.EnsembleMembers,
+		"EnsembleParallelism":       cfg.EnsembleParallelism,
+		"AllocationTimeout":         cfg.AllocationTimeout,
+		"Timeouts":                  cfg.Timeouts,
+		"RestartInterval":           cfg.RestartInterval,
+		"Retries":                   cfg.Retries,
+		"QuarantineAfter":           cfg.QuarantineAfter,
+		"DateParallelism":           cfg.DateParallelism,
+		"AssimilateOnlyInnerDomain": cfg.AssimilateOnlyInnerDomain,
+		"AssimilateFirstCycle":      cfg.AssimilateFirstCycle,
+		"Domains":                   cfg.Domains,
+		"AssimilationCycles":        cfg.AssimilationCycles,
+		"Scheduler":                 cfg.Scheduler,
+		"Hostfile":                  cfg.Hostfile,
 	} {
 		log.Info("  -- %s: %v", name, value)
 	}
-
 }
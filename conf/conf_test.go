@@ -0,0 +1,312 @@
+package conf_test
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/meteocima/ensemble-runner/conf"
+	"github.com/meteocima/ensemble-runner/mpiman"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const validConfig = `
+GeogridProc: 36
+MetgridProc: 36
+RealProc: 36
+WrfProc: 224
+WrfStepProc: 112
+WrfdaProc: 112
+ObDataDir: ./observations
+CovarMatrixesDir: ./covar-matrices
+RunWPS: false
+EnsembleMembers: 0
+EnsembleParallelism: 1
+AssimilateObservations: true
+AssimilateFirstCycle: true
+Domains:
+  - Assimilate: false
+  - Assimilate: true
+    PostprocAux: true
+CoresPerNode: 112
+PostprocRules:
+  wrfout_d02.*: postproc-wrfout.sh
+`
+
+// newRootdir returns a root directory containing the
+// templates and data directories used by validConfig.
+func newRootdir(t *testing.T) string {
+	rootdir := t.TempDir()
+	for _, dir := range []string{
+		"templates/wrf-forecast",
+		"templates/wrf-step",
+		"templates/wrfda_02",
+		"observations",
+		"covar-matrices/winter",
+		"workdir",
+	} {
+		require.NoError(t, os.MkdirAll(filepath.Join(rootdir, dir), 0755))
+	}
+	require.NoError(t, os.WriteFile(filepath.Join(rootdir, "covar-matrices/winter/be_d02"), nil, 0644))
+
+	t.Setenv("START_FORECAST", "2020-12-25-00")
+	t.Setenv("SLURM_NODELIST", "n[1-2]")
+	return rootdir
+}
+
+// loadFiles writes files in a new root directory, and loads
+// the configuration from it, applying overrides, then checks
+// the environment. It returns the configuration, or the
+// problems found in it or in the environment.
+func loadFiles(t *testing.T, files map[string]string, overrides conf.Overrides) (*conf.Config, []string) {
+	rootdir := newRootdir(t)
+	for name, content := range files {
+		require.NoError(t, os.WriteFile(filepath.Join(rootdir, name), []byte(content), 0644))
+	}
+
+	cfg, err := conf.Load(rootdir, overrides)
+	if err == nil {
+		err = cfg.CheckEnvironment()
+	}
+	if err == nil {
+		return cfg, nil
+	}
+	var validationErr conf.ValidationError
+	require.ErrorAs(t, err, &validationErr)
+	return nil, validationErr.Problems
+}
+
+func ptr[T any](v T) *T {
+	return &v
+}
+
+func load(t *testing.T, config string) (*conf.Config, []string) {
+	return loadFiles(t, map[string]string{"config.yaml": config}, conf.Overrides{})
+}
+
+func TestLoad(t *testing.T) {
+	t.Run("Valid", func(t *testing.T) {
+		cfg, problems := load(t, validConfig)
+		require.Empty(t, problems)
+		assert.Equal(t, 2, len(cfg.Domains))
+		assert.Equal(t, conf.DefaultAssimilationCycles(), cfg.AssimilationCycles)
+		assert.Equal(t, "postproc-wrfout.sh", cfg.PostprocRules["wrfout_d02.*"])
+	})
+
+	t.Run("DoesNotTouchProcessState", func(t *testing.T) {
+		wd, err := os.Getwd()
+		require.NoError(t, err)
+
+		cfg, problems := load(t, validConfig)
+		require.Empty(t, problems)
+
+		assert.True(t, filepath.IsAbs(cfg.ObDataDir))
+		assert.Equal(t, "observations", filepath.Base(cfg.ObDataDir))
+		after, err := os.Getwd()
+		require.NoError(t, err)
+		assert.Equal(t, wd, after)
+		_, exported := os.LookupEnv("OB_DATDIR")
+		assert.False(t, exported)
+		assert.Contains(t, cfg.Env(), cfg.ObDataDir)
+	})
+
+	t.Run("UnknownKeys", func(t *testing.T) {
+		_, problems := load(t, validConfig+`
+WrfProcs: 12
+AssimilationCycles:
+  Count: 2
+  Intervall: 1h
+`)
+		assert.Equal(t, []string{
+			"line 23: unknown key `WrfProcs`, did you mean `WrfProc`?",
+			"line 26: unknown key `AssimilationCycles.Intervall`, did you mean `AssimilationCycles.Interval`?",
+		}, problems)
+	})
+
+	t.Run("WrongTypes", func(t *testing.T) {
+		_, problems := load(t, strings.Replace(validConfig, "  - Assimilate: false", "  - Assimilate: maybe", 1))
+		require.Len(t, problems, 1)
+		assert.Contains(t, problems[0], "line 16: cannot unmarshal !!str `maybe` into bool")
+	})
+
+	t.Run("Launchers", func(t *testing.T) {
+		cfg, problems := load(t, validConfig+`
+MpiOptions: --bind-to core
+Launchers:
+  default:
+    Type: srun
+  wrf:
+    Command: mpiexec
+    Rankfile: true
+`)
+		require.Empty(t, problems)
+		assert.Equal(t, mpiman.Srun{}, cfg.Launcher("real"))
+		assert.Equal(t, mpiman.OpenMPI{Mpirun: "mpiexec", Rankfile: true}, cfg.Launcher("wrf"))
+
+		cfg, problems = load(t, validConfig+"MpiOptions: --bind-to core\n")
+		require.Empty(t, problems)
+		assert.Equal(t, mpiman.OpenMPI{Mpirun: "mpiexec", Options: "--bind-to core"}, cfg.Launcher("geogrid"))
+		assert.Equal(t, mpiman.OpenMPI{Mpirun: "mpirun", Options: "--bind-to core"}, cfg.Launcher("wrf"))
+
+		_, problems = load(t, validConfig+`
+Launchers:
+  wrfda:
+    Type: local
+  real:
+    Type: slurm
+  wrf:
+    Type: srun
+    Rankfile: true
+`)
+		assert.Equal(t, []string{
+			"Launchers.real: unknown launcher type `slurm`, must be one of openmpi, intelmpi, srun or local",
+			"Launchers.wrf: Rankfile is supported only by openmpi launchers, not by srun",
+			"Launchers: unknown executable `wrfda`, must be default or one of [geogrid metgrid real da_wrfvar wrf]",
+		}, problems)
+	})
+
+	t.Run("Scheduler", func(t *testing.T) {
+		cfg, problems := load(t, validConfig)
+		require.Empty(t, problems)
+		assert.Equal(t, mpiman.Slurm{}, cfg.NodeSource())
+
+		cfg, problems = loadFiles(t, map[string]string{
+			"config.yaml": validConfig + "Hostfile: hostfile\nDateParallelism: 2\n",
+			"hostfile":    "wn01 slots=112\nwn02 slots=112\nwn03 slots=112\n",
+		}, conf.Overrides{})
+		require.Empty(t, problems)
+		assert.Equal(t, "hostfile", filepath.Base(cfg.Hostfile))
+		assert.IsType(t, mpiman.Hostfile{}, cfg.NodeSource())
+
+		_, problems = load(t, validConfig+"Scheduler: local\n")
+		assert.Equal(t, []string{"WrfProc is 224, but the nodes available to every date have only 112 cores (1 nodes with 112 cores each)"}, problems)
+
+		_, problems = load(t, validConfig+"Scheduler: sge\n")
+		assert.Equal(t, []string{"unknown Scheduler `sge`, must be one of [slurm pbs lsf hostfile local]"}, problems)
+
+		_, problems = load(t, validConfig+"Scheduler: hostfile\n")
+		assert.Equal(t, []string{"Scheduler is hostfile, but Hostfile is not set"}, problems)
+
+		_, problems = load(t, validConfig+"Scheduler: pbs\nHostfile: hostfile\n")
+		assert.Equal(t, []string{"Hostfile is set, but Scheduler is pbs"}, problems)
+	})
+
+	t.Run("Timeouts", func(t *testing.T) {
+		cfg, problems := load(t, validConfig+`
+Timeouts:
+  wrf: 6h
+  real: 30m
+`)
+		require.Empty(t, problems)
+		assert.Equal(t, 6*time.Hour, cfg.Timeouts["wrf"])
+
+		_, problems = load(t, validConfig+`
+Timeouts:
+  wrf.exe: 6h
+  real: -30m
+`)
+		assert.Equal(t, []string{
+			"Timeouts.real cannot be negative: -30m0s",
+			"Timeouts: unknown process `wrf.exe`, must be one of [geogrid link_grib ungrib metgrid avg_tsfc real da_wrfvar wrf_step wrf]",
+		}, problems)
+	})
+
+	t.Run("RestartInterval", func(t *testing.T) {
+		cfg, problems := load(t, validConfig)
+		require.Empty(t, problems)
+		assert.NotContains(t, cfg.Env(), "RESTART_INTERVAL")
+
+		cfg, problems = load(t, validConfig+"RestartInterval: 6h\n")
+		require.Empty(t, problems)
+		assert.Equal(t, []string{"RESTART_INTERVAL", "360"}, cfg.Env()[len(cfg.Env())-2:])
+
+		_, problems = load(t, validConfig+"RestartInterval: 90m\n")
+		assert.Equal(t, []string{"RestartInterval must be a positive whole number of hours: 1h30m0s"}, problems)
+	})
+
+	t.Run("Retries", func(t *testing.T) {
+		cfg, problems := load(t, validConfig+`
+Retries:
+  default:
+    Attempts: 3
+  wrf:
+    Backoff: 1m
+    MaxBackoff: 10m
+`)
+		require.Empty(t, problems)
+		assert.Equal(t, conf.RetryConfig{Attempts: ptr(3), Backoff: ptr(time.Minute), MaxBackoff: ptr(10 * time.Minute)}, cfg.Retry("wrf"))
+		assert.Equal(t, conf.RetryConfig{Attempts: ptr(3)}, cfg.Retry("real"))
+
+		cfg, problems = load(t, validConfig+`
+Retries:
+  default:
+    Backoff: 10s
+    Jitter: 0.5
+  wrf:
+    Backoff: 0s
+    Jitter: 0
+`)
+		require.Empty(t, problems)
+		assert.Equal(t, conf.RetryConfig{Backoff: ptr(time.Duration(0)), Jitter: ptr(0.0)}, cfg.Retry("wrf"))
+		assert.Equal(t, conf.RetryConfig{Backoff: ptr(10 * time.Second), Jitter: ptr(0.5)}, cfg.Retry("real"))
+
+		_, problems = load(t, validConfig+`
+Retries:
+  wrfda:
+    Attempts: 2
+  wrf:
+    Attempts: -1
+    Jitter: 2
+`)
+		assert.Equal(t, []string{
+			"Retries.wrf.Attempts cannot be negative: -1",
+			"Retries.wrf.Jitter must be between 0 and 1: 2",
+			"Retries: unknown process `wrfda`, must be default or one of [geogrid link_grib ungrib metgrid avg_tsfc real da_wrfvar wrf_step wrf]",
+		}, problems)
+	})
+
+	t.Run("AllProblemsAtOnce", func(t *testing.T) {
+		config := strings.NewReplacer(
+			"WrfProc: 224", "WrfProc: 512",
+			"EnsembleMembers: 0", "EnsembleMembers: 2",
+			"RunWPS: false", "RunWPS: true\nGfsDir: ./gfs\nGeogDataDir: ./observations",
+			"  - Assimilate: false", "  - Assimilate: true",
+		).Replace(validConfig)
+
+		_, problems := load(t, config)
+		require.Len(t, problems, 6)
+		assert.Equal(t, "WrfProc is 512, but the nodes available to every date have only 224 cores (2 nodes with 112 cores each)", problems[0])
+		assert.Contains(t, problems[1], "GfsDir: stat ")
+		assert.Contains(t, problems[2], "CovarMatrixesDir: background errors for domain 1 in winter: stat ")
+		assert.Contains(t, problems[3], "template wrf-ensmember: stat ")
+		assert.Contains(t, problems[4], "template wps: stat ")
+		assert.Contains(t, problems[5], "template wrfda_01: stat ")
+
+		_, problems = load(t, strings.NewReplacer(
+			"EnsembleParallelism: 1", "EnsembleParallelism: 0",
+			"EnsembleMembers: 0", "EnsembleMembers: -1",
+		).Replace(validConfig))
+		assert.Equal(t, []string{
+			"EnsembleParallelism must be at least 1: 0",
+			"EnsembleMembers cannot be negative: -1",
+		}, problems)
+	})
+
+	t.Run("WithoutEnvironment", func(t *testing.T) {
+		rootdir := t.TempDir()
+		require.NoError(t, os.WriteFile(filepath.Join(rootdir, "config.yaml"), []byte(validConfig+"DateParallelism: 4\n"), 0644))
+		for _, name := range []string{"START_FORECAST", "SLURM_NODELIST", "PBS_NODEFILE", "LSB_MCPU_HOSTS", "LSB_HOSTS"} {
+			t.Setenv(name, "")
+			os.Unsetenv(name)
+		}
+
+		cfg, err := conf.Load(rootdir, conf.Overrides{})
+		require.NoError(t, err, "Load does not need nodes, dates nor directories")
+		var validationErr conf.ValidationError
+		require.ErrorAs(t, cfg.CheckEnvironment(), &validationErr)
+		assert.Contains(t, strings.Join(validationErr.Problems, "\n"), "cannot read dates to run")
+	})
+}
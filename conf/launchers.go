@@ -0,0 +1,110 @@
+package conf
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/meteocima/ensemble-runner/mpiman"
+)
+
+// Executables contains the names of the MPI executables
+// run by the simulation, as used in Launchers.
+var Executables = []string{"geogrid", "metgrid", "real", "da_wrfvar", "wrf"}
+
+// Processes contains the names of all the processes run by
+// the simulation, as used in Timeouts: `wrf_step` is wrf.exe
+// run between assimilation cycles, `wrf` the forecast.
+var Processes = []string{"geogrid", "link_grib", "ungrib", "metgrid", "avg_tsfc", "real", "da_wrfvar", "wrf_step", "wrf"}
+
+// LauncherConfig contains the configuration of
+// the launcher used to run an MPI executable.
+type LauncherConfig struct {
+	// Type is the kind of launcher: `openmpi`, `intelmpi`,
+	// `srun` or `local`. When omitted, `openmpi` is used.
+	Type string `yaml:"Type"`
+	// Command is the command used to launch the executable,
+	// for `openmpi` and `intelmpi` launchers. When omitted,
+	// `mpirun` is used.
+	Command string `yaml:"Command"`
+	// Options contains additional options for the launcher.
+	Options string `yaml:"Options"`
+	// Rankfile, when true, makes an `openmpi` launcher place
+	// the processes using a rankfile, instead of `-host`.
+	Rankfile bool `yaml:"Rankfile"`
+}
+
+// launcher returns the launcher configured by lc.
+func (lc LauncherConfig) launcher() (mpiman.Launcher, error) {
+	if lc.Rankfile && lc.Type != "" && lc.Type != "openmpi" {
+		return nil, fmt.Errorf("Rankfile is supported only by openmpi launchers, not by %s", lc.Type)
+	}
+	switch lc.Type {
+	case "", "openmpi":
+		return mpiman.OpenMPI{Mpirun: lc.Command, Options: lc.Options, Rankfile: lc.Rankfile}, nil
+	case "intelmpi":
+		return mpiman.IntelMPI{Mpirun: lc.Command, Options: lc.Options}, nil
+	case "srun":
+		return mpiman.Srun{Options: lc.Options}, nil
+	case "local":
+		return mpiman.Local{}, nil
+	default:
+		return nil, fmt.Errorf("unknown launcher type `%s`, must be one of openmpi, intelmpi, srun or local", lc.Type)
+	}
+}
+
+// launcherConfig returns the configuration of the launcher of exe:
+// its entry in Launchers, or the `default` one when it's missing.
+// When Launchers is omitted, executables are launched as in previous
+// versions: WPS ones using `mpiexec`, the other ones using `mpirun`,
+// with MpiOptions and MpiRankfile.
+func (cfg *Config) launcherConfig(exe string) LauncherConfig {
+	if lc, ok := cfg.Launchers[exe]; ok {
+		return lc
+	}
+	if lc, ok := cfg.Launchers["default"]; ok {
+		return lc
+	}
+	lc := LauncherConfig{Command: "mpirun", Options: cfg.MpiOptions, Rankfile: cfg.MpiRankfile}
+	switch exe {
+	case "geogrid", "metgrid", "real":
+		lc.Command = "mpiexec"
+	}
+	return lc
+}
+
+// Launcher returns the launcher used to run the MPI
+// executable exe, that is one of Executables.
+func (cfg *Config) Launcher(exe string) mpiman.Launcher {
+	launcher, err := cfg.launcherConfig(exe).launcher()
+	if err != nil {
+		// launchers are checked by Load
+		panic(err)
+	}
+	return launcher
+}
+
+// validateLaunchers returns a description of every
+// problem found in the configuration of launchers.
+func (cfg *Config) validateLaunchers() []string {
+	var problems []string
+	names := make([]string, 0, len(cfg.Launchers))
+	for name := range cfg.Launchers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		known := name == "default"
+		for _, exe := range Executables {
+			known = known || name == exe
+		}
+		if !known {
+			problems = append(problems, fmt.Sprintf("Launchers: unknown executable `%s`, must be default or one of %v", name, Executables))
+			continue
+		}
+		if _, err := cfg.Launchers[name].launcher(); err != nil {
+			problems = append(problems, fmt.Sprintf("Launchers.%s: %s", name, err))
+		}
+	}
+	return problems
+}
@@ -0,0 +1,524 @@
+package conf
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Overrides contains the values that take precedence
+// over the ones read from the configuration files.
+type Overrides struct {
+	// Profile is the name of the profile to apply, among the ones
+	// defined in the `profiles` section of the configuration files.
+	// When empty, the profile named by $ENSRUNNER_PROFILE is applied.
+	Profile string
+	// Env contains environment variables in the form NAME=value,
+	// as returned by os.Environ. A variable named ENSRUNNER_<KEY>
+	// overrides the configuration key KEY. Nested keys are
+	// separated by an underscore, and case is ignored.
+	Env []string
+	// Set contains overrides in the form Key=Value. Nested
+	// keys are separated by a dot. They take precedence over
+	// the environment variables.
+	Set []string
+}
+
+// Sources maps the path of every value of the configuration,
+// with nested keys separated by a dot, to a description of
+// where the value was read from.
+type Sources map[string]string
+
+// envPrefix is the prefix of environment
+// variables overriding configuration values.
+const envPrefix = "ENSRUNNER_"
+
+// layer is a yaml mapping containing part of the configuration,
+// read from a file, a profile or an override.
+type layer struct {
+	// prefix is prepended to the problems found in the layer.
+	// It is empty for the main configuration file.
+	prefix string
+	// noLines is true when the line numbers of node
+	// are meaningless, as in overrides.
+	noLines bool
+	node    *yaml.Node
+	// source describes where the value in node was read from.
+	source func(node *yaml.Node) string
+}
+
+// loader reads all layers of a configuration.
+type loader struct {
+	rootdir  string
+	target   reflect.Type
+	strict   bool
+	layers   []layer
+	profiles map[string][]layer
+	stack    []string
+	problems []string
+}
+
+// Read reads the configuration file cfgFile into out, merging in
+// order the files it includes, cfgFile itself, the selected profile,
+// and the overrides. It returns where every value was read from.
+//
+// Unlike Load, keys that are unknown to out are ignored and values
+// are not validated: Read is meant for commands that need only part
+// of the configuration.
+func Read(cfgFile string, overrides Overrides, out any) (Sources, error) {
+	sources, problems := read(cfgFile, overrides, out, false)
+	if len(problems) > 0 {
+		return nil, ValidationError{File: cfgFile, Problems: problems}
+	}
+	return sources, nil
+}
+
+// read merges all layers of the configuration in cfgFile and decodes
+// them into out. When strict is true, unknown keys are reported as problems.
+func read(cfgFile string, overrides Overrides, out any, strict bool) (Sources, []string) {
+	l := loader{
+		rootdir:  filepath.Dir(cfgFile),
+		target:   reflect.TypeOf(out),
+		strict:   strict,
+		profiles: map[string][]layer{},
+	}
+	l.readFile(cfgFile, "")
+
+	profile := overrides.Profile
+	if profile == "" {
+		profile = lookupEnv(overrides.Env, envPrefix+"PROFILE")
+	}
+	if profile != "" {
+		profileLayers, ok := l.profiles[profile]
+		if !ok {
+			l.problemf("profile `%s` is not defined, available profiles are: %s", profile, l.profileNames())
+		}
+		l.layers = append(l.layers, profileLayers...)
+	}
+
+	l.readEnv(overrides.Env)
+	for _, set := range overrides.Set {
+		l.readSet(set)
+	}
+
+	for _, layer := range l.layers {
+		l.check(layer)
+	}
+
+	merged := &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+	sources := Sources{}
+	for _, layer := range l.layers {
+		mergeNodes(merged, layer.node, "", layer.source, sources)
+	}
+	// type errors are already reported by check for the layer they come from.
+	_ = merged.Decode(out)
+
+	return sources, l.problems
+}
+
+func (l *loader) problemf(format string, args ...any) {
+	l.problems = append(l.problems, fmt.Sprintf(format, args...))
+}
+
+// relName returns the name of path used in problems and sources.
+func (l *loader) relName(path string) string {
+	if rel, err := filepath.Rel(l.rootdir, path); err == nil && !strings.HasPrefix(rel, "..") {
+		return rel
+	}
+	return path
+}
+
+// profileNames returns a comma separated list
+// of the names of all the profiles defined.
+func (l *loader) profileNames() string {
+	var names []string
+	for name := range l.profiles {
+		names = append(names, name)
+	}
+	if len(names) == 0 {
+		return "none"
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+// readFile adds to l a layer with the content of the
+// configuration file in path, preceded by the layers of
+// the files it includes. includedBy is the name of the
+// file including path, or an empty string for the main file.
+func (l *loader) readFile(path string, includedBy string) {
+	name := l.relName(path)
+	prefix := ""
+	if includedBy != "" {
+		prefix = name + ": "
+	}
+
+	for _, included := range l.stack {
+		if included == path {
+			var cycle []string
+			for _, p := range append(l.stack, path) {
+				cycle = append(cycle, l.relName(p))
+			}
+			l.problemf("%s: include cycle: %s", includedBy, strings.Join(cycle, " -> "))
+			return
+		}
+	}
+
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		l.problemf("%s", err)
+		return
+	}
+	var doc yaml.Node
+	if err := yaml.Unmarshal(buf, &doc); err != nil {
+		l.problemf("%s%s", prefix, err)
+		return
+	}
+	if doc.Kind == 0 {
+		// empty document
+		return
+	}
+	root := doc.Content[0]
+	if root.Kind != yaml.MappingNode {
+		l.problemf("%sline %d: the configuration must be a mapping of keys to values", prefix, root.Line)
+		return
+	}
+
+	l.stack = append(l.stack, path)
+	defer func() {
+		l.stack = l.stack[:len(l.stack)-1]
+	}()
+
+	source := func(node *yaml.Node) string {
+		return fmt.Sprintf("%s:%d", name, node.Line)
+	}
+	fileLayer := &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+	for i := 0; i+1 < len(root.Content); i += 2 {
+		key, value := root.Content[i], root.Content[i+1]
+		switch key.Value {
+		case "include":
+			includes := []*yaml.Node{value}
+			if value.Kind == yaml.SequenceNode {
+				includes = value.Content
+			}
+			for _, include := range includes {
+				if include.Kind != yaml.ScalarNode || include.Value == "" {
+					l.problemf("%sline %d: `include` must be a file name or a list of file names", prefix, include.Line)
+					continue
+				}
+				includePath := include.Value
+				if !filepath.IsAbs(includePath) {
+					includePath = filepath.Join(filepath.Dir(path), includePath)
+				}
+				l.readFile(includePath, name)
+			}
+		case "profiles":
+			if value.Kind != yaml.MappingNode {
+				l.problemf("%sline %d: `profiles` must be a mapping of profile names to configuration values", prefix, value.Line)
+				continue
+			}
+			for j := 0; j+1 < len(value.Content); j += 2 {
+				profile, body := value.Content[j].Value, value.Content[j+1]
+				if body.Kind != yaml.MappingNode {
+					l.problemf("%sline %d: profile `%s` must be a mapping of keys to values", prefix, body.Line, profile)
+					continue
+				}
+				l.profiles[profile] = append(l.profiles[profile], layer{
+					prefix: fmt.Sprintf("%sprofile %s: ", prefix, profile),
+					node:   body,
+					source: func(node *yaml.Node) string {
+						return fmt.Sprintf("profile %s, %s", profile, source(node))
+					},
+				})
+			}
+		default:
+			fileLayer.Content = append(fileLayer.Content, key, value)
+		}
+	}
+
+	l.layers = append(l.layers, layer{prefix: prefix, node: fileLayer, source: source})
+}
+
+// readEnv adds to l a layer for every ENSRUNNER_<KEY>
+// variable in env, sorted by name.
+func (l *loader) readEnv(env []string) {
+	sorted := append([]string(nil), env...)
+	sort.Strings(sorted)
+	for _, variable := range sorted {
+		name, value, _ := strings.Cut(variable, "=")
+		key, ok := strings.CutPrefix(name, envPrefix)
+		if !ok || key == "PROFILE" {
+			continue
+		}
+		l.addOverride(name, strings.Split(key, "_"), "_", value, "env "+name)
+	}
+}
+
+// readSet adds to l a layer for the override
+// set, in the form Key=Value.
+func (l *loader) readSet(set string) {
+	key, value, ok := strings.Cut(set, "=")
+	if !ok || key == "" {
+		l.problemf("--set %s: overrides must be in the form Key=Value", set)
+		return
+	}
+	l.addOverride("--set "+key, strings.Split(key, "."), ".", value, "--set "+key)
+}
+
+// addOverride adds to l a layer that sets the key whose path is
+// composed by segments to value, parsed as a yaml document.
+// sep is the separator of segments in the name of the override.
+func (l *loader) addOverride(name string, segments []string, sep string, value string, source string) {
+	path, problem := resolvePath(l.target, segments, sep)
+	if problem != "" {
+		if l.strict {
+			l.problemf("%s: %s", name, problem)
+		}
+		return
+	}
+
+	var doc yaml.Node
+	if err := yaml.Unmarshal([]byte(value), &doc); err != nil {
+		l.problemf("%s: cannot parse value: %s", name, err)
+		return
+	}
+	node := &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str"}
+	if doc.Kind != 0 {
+		node = doc.Content[0]
+	}
+	for i := len(path) - 1; i >= 0; i-- {
+		node = &yaml.Node{
+			Kind:    yaml.MappingNode,
+			Tag:     "!!map",
+			Content: []*yaml.Node{{Kind: yaml.ScalarNode, Tag: "!!str", Value: path[i]}, node},
+		}
+	}
+
+	l.layers = append(l.layers, layer{
+		prefix:  name + ": ",
+		noLines: true,
+		node:    node,
+		source: func(*yaml.Node) string {
+			return source
+		},
+	})
+}
+
+// resolvePath returns the path of the configuration key in type t
+// named by segments, ignoring case. When no such key exists, it
+// returns a description of the problem.
+//
+// Since the keys of maps can contain sep, the key of a map whose
+// values have nested keys is the longest sequence of segments,
+// joined using sep, that is one of mapKeys, or else the next segment
+// only. The key of any other map is composed by all the segments
+// left. Keys equal to one of mapKeys, ignoring case, are replaced
+// by it, since environment variables are uppercase.
+func resolvePath(t reflect.Type, segments []string, sep string) ([]string, string) {
+	var path []string
+	for i := 0; i < len(segments); {
+		segment := segments[i]
+		for t.Kind() == reflect.Pointer {
+			t = t.Elem()
+		}
+		if t.Kind() == reflect.Map {
+			elem := t.Elem()
+			for elem.Kind() == reflect.Pointer {
+				elem = elem.Elem()
+			}
+			// the key is followed by nested keys only
+			// when the values of the map have them.
+			last := i + 1
+			if elem.Kind() != reflect.Struct && elem.Kind() != reflect.Map {
+				last = len(segments)
+			}
+			n := last - i
+			key := strings.Join(segments[i:last], sep)
+			for j := last; j <= len(segments); j++ {
+				if known, ok := mapKey(strings.Join(segments[i:j], sep)); ok {
+					key, n = known, j-i
+				}
+			}
+			path = append(path, key)
+			t = t.Elem()
+			i += n
+			continue
+		}
+		if t.Kind() != reflect.Struct {
+			return nil, fmt.Sprintf("unknown key `%s`: `%s` has no nested keys", strings.Join(segments, sep), strings.Join(path, "."))
+		}
+
+		fields := yamlFields(t)
+		var field reflect.StructField
+		found := false
+		for name, f := range fields {
+			if strings.EqualFold(name, segment) {
+				path = append(path, name)
+				field = f
+				found = true
+				break
+			}
+		}
+		if !found {
+			problem := fmt.Sprintf("unknown key `%s`", strings.Join(segments, sep))
+			if similar := similarKey(segment, fields); similar != "" {
+				problem += fmt.Sprintf(", did you mean `%s`?", strings.Join(append(path, similar), "."))
+			}
+			return nil, problem
+		}
+		t = field.Type
+		i++
+	}
+	return path, ""
+}
+
+// mapKeys contains the keys of the maps of the configuration
+// that are known in advance, such as the names of processes.
+var mapKeys = append([]string{"default"}, Processes...)
+
+// mapKey returns the one of mapKeys equal
+// to key, ignoring case, if there's one.
+func mapKey(key string) (string, bool) {
+	for _, known := range mapKeys {
+		if strings.EqualFold(known, key) {
+			return known, true
+		}
+	}
+	return "", false
+}
+
+// lineRe matches the line number at the start of yaml errors.
+var lineRe = regexp.MustCompile(`^line \d+: `)
+
+// check adds to l the problems found in the values of layer.
+func (l *loader) check(layer layer) {
+	var problems []string
+	if l.strict {
+		problems = unknownKeys(layer.node, l.target, "")
+	}
+	scratch := reflect.New(l.target.Elem())
+	if err := layer.node.Decode(scratch.Interface()); err != nil {
+		if typeErr, ok := err.(*yaml.TypeError); ok {
+			problems = append(problems, typeErr.Errors...)
+		} else {
+			problems = append(problems, err.Error())
+		}
+	}
+
+	for _, problem := range problems {
+		if layer.noLines {
+			problem = lineRe.ReplaceAllString(problem, "")
+		}
+		l.problems = append(l.problems, layer.prefix+problem)
+	}
+}
+
+// mergeNodes merges the mapping src into the mapping dst. Nested
+// mappings are merged recursively, any other value in src replaces
+// the one in dst. path is the path of dst, and sources is updated with
+// the source of every value merged, as returned by source.
+func mergeNodes(dst, src *yaml.Node, path string, source func(*yaml.Node) string, sources Sources) {
+	for i := 0; i+1 < len(src.Content); i += 2 {
+		key, value := src.Content[i], src.Content[i+1]
+		keyPath := path + key.Value
+
+		idx := -1
+		for j := 0; j+1 < len(dst.Content); j += 2 {
+			if dst.Content[j].Value == key.Value {
+				idx = j
+				break
+			}
+		}
+
+		if value.Kind == yaml.MappingNode {
+			if idx == -1 || dst.Content[idx+1].Kind != yaml.MappingNode {
+				nested := &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+				if idx == -1 {
+					dst.Content = append(dst.Content, key, nested)
+				} else {
+					dst.Content[idx+1] = nested
+				}
+				delete(sources, keyPath)
+			}
+			if idx == -1 {
+				idx = len(dst.Content) - 2
+			}
+			mergeNodes(dst.Content[idx+1], value, keyPath+".", source, sources)
+			continue
+		}
+
+		if idx == -1 {
+			dst.Content = append(dst.Content, key, value)
+		} else {
+			dst.Content[idx+1] = value
+		}
+		for p := range sources {
+			if strings.HasPrefix(p, keyPath+".") {
+				delete(sources, p)
+			}
+		}
+		sources[keyPath] = source(value)
+	}
+}
+
+// lookupEnv returns the value of the variable
+// name in env, or an empty string if not set.
+func lookupEnv(env []string, name string) string {
+	for _, variable := range env {
+		if n, value, _ := strings.Cut(variable, "="); n == name {
+			return value
+		}
+	}
+	return ""
+}
+
+// Dump writes to w the configuration in yaml format, with
+// a comment after every value describing where it was read
+// from. Values not read from any layer are marked as defaults.
+func (cfg *Config) Dump(w io.Writer) error {
+	var root yaml.Node
+	if err := root.Encode(cfg); err != nil {
+		return err
+	}
+	annotateSources(&root, "", cfg.sources)
+
+	enc := yaml.NewEncoder(w)
+	enc.SetIndent(2)
+	if err := enc.Encode(&root); err != nil {
+		return err
+	}
+	return enc.Close()
+}
+
+// annotateSources sets the comment of every value
+// in the mapping node to its source in sources.
+func annotateSources(node *yaml.Node, path string, sources Sources) {
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		key, value := node.Content[i], node.Content[i+1]
+		keyPath := path + key.Value
+		if source, ok := sources[keyPath]; ok {
+			if value.Kind == yaml.ScalarNode {
+				value.LineComment = source
+			} else {
+				key.LineComment = source
+			}
+			continue
+		}
+		if value.Kind == yaml.MappingNode && len(value.Content) > 0 {
+			annotateSources(value, keyPath+".", sources)
+			continue
+		}
+		if value.Kind == yaml.ScalarNode {
+			value.LineComment = "default"
+		} else {
+			key.LineComment = "default"
+		}
+	}
+}
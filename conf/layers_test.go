@@ -0,0 +1,207 @@
+package conf_test
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/meteocima/ensemble-runner/arguments"
+	"github.com/meteocima/ensemble-runner/conf"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const profilesConfig = `include: base.yaml
+WrfProc: 112
+profiles:
+  small:
+    WrfProc: 56
+    AssimilationCycles:
+      Count: 2
+`
+
+func TestLayers(t *testing.T) {
+	files := map[string]string{
+		"base.yaml":   validConfig,
+		"config.yaml": profilesConfig,
+	}
+
+	t.Run("Include", func(t *testing.T) {
+		cfg, problems := loadFiles(t, files, conf.Overrides{})
+		require.Empty(t, problems)
+		assert.Equal(t, 112, cfg.WrfProcCount)
+		assert.Equal(t, 36, cfg.RealProcCount)
+		assert.Equal(t, 3, cfg.AssimilationCycles.Count)
+	})
+
+	t.Run("Profile", func(t *testing.T) {
+		cfg, problems := loadFiles(t, files, conf.Overrides{Profile: "small"})
+		require.Empty(t, problems)
+		assert.Equal(t, 56, cfg.WrfProcCount)
+		assert.Equal(t, 2, cfg.AssimilationCycles.Count)
+		assert.Equal(t, conf.DefaultAssimilationCycles().Interval, cfg.AssimilationCycles.Interval)
+	})
+
+	t.Run("ProfileFromEnv", func(t *testing.T) {
+		cfg, problems := loadFiles(t, files, conf.Overrides{Env: []string{"ENSRUNNER_PROFILE=small"}})
+		require.Empty(t, problems)
+		assert.Equal(t, 56, cfg.WrfProcCount)
+	})
+
+	t.Run("UnknownProfile", func(t *testing.T) {
+		_, problems := loadFiles(t, files, conf.Overrides{Profile: "large"})
+		assert.Equal(t, []string{"profile `large` is not defined, available profiles are: small"}, problems)
+	})
+
+	t.Run("Overrides", func(t *testing.T) {
+		cfg, problems := loadFiles(t, files, conf.Overrides{
+			Profile: "small",
+			Env: []string{
+				"HOME=/root",
+				"ENSRUNNER_WRFPROC=28",
+				"ENSRUNNER_ASSIMILATIONCYCLES_WINDOW=1h",
+				"ENSRUNNER_MPIOPTIONS=--bind-to core",
+			},
+			Set: []string{"WrfProc=14", "PostprocRules.auxhist23_d01.*=postproc-aux.sh"},
+		})
+		require.Empty(t, problems)
+		assert.Equal(t, 14, cfg.WrfProcCount)
+		assert.Equal(t, "1h0m0s", cfg.AssimilationCycles.Window.String())
+		assert.Equal(t, "--bind-to core", cfg.MpiOptions)
+		assert.Equal(t, map[string]string{
+			"wrfout_d02.*":    "postproc-wrfout.sh",
+			"auxhist23_d01.*": "postproc-aux.sh",
+		}, cfg.PostprocRules)
+	})
+
+	t.Run("MapOverrides", func(t *testing.T) {
+		cfg, problems := loadFiles(t, files, conf.Overrides{
+			Env: []string{
+				"ENSRUNNER_TIMEOUTS_WRF=1h",
+				"ENSRUNNER_TIMEOUTS_WRF_STEP=30m",
+				"ENSRUNNER_RETRIES_DA_WRFVAR_ATTEMPTS=4",
+			},
+			Set: []string{
+				"Launchers.wrf.Type=srun",
+				"Retries.wrf.Attempts=2",
+				"Retries.Default.Jitter=0",
+			},
+		})
+		require.Empty(t, problems)
+		assert.Equal(t, map[string]time.Duration{"wrf": time.Hour, "wrf_step": 30 * time.Minute}, cfg.Timeouts)
+		assert.Equal(t, "srun", cfg.Launchers["wrf"].Type)
+		assert.Equal(t, 2, *cfg.Retry("wrf").Attempts)
+		assert.Equal(t, 4, *cfg.Retry("da_wrfvar").Attempts)
+		assert.Equal(t, 0.0, *cfg.Retry("real").Jitter)
+	})
+
+	t.Run("WrongOverrides", func(t *testing.T) {
+		_, problems := loadFiles(t, files, conf.Overrides{
+			Env: []string{"ENSRUNNER_WRFPROCS=28"},
+			Set: []string{"WrfProc=many", "RunWPS"},
+		})
+		assert.Equal(t, []string{
+			"ENSRUNNER_WRFPROCS: unknown key `WRFPROCS`, did you mean `WrfProc`?",
+			"--set RunWPS: overrides must be in the form Key=Value",
+			"--set WrfProc: cannot unmarshal !!str `many` into int",
+			"WrfProc must be a positive number of processes: 0",
+		}, problems)
+	})
+
+	t.Run("ProblemsInIncludedFiles", func(t *testing.T) {
+		_, problems := loadFiles(t, map[string]string{
+			"base.yaml":   "include: config.yaml\nWrfProcs: 12\n",
+			"config.yaml": "include: [base.yaml, missing.yaml]\n" + strings.TrimPrefix(validConfig, "\n"),
+		}, conf.Overrides{})
+		require.Len(t, problems, 3)
+		assert.Equal(t, "base.yaml: include cycle: config.yaml -> base.yaml -> config.yaml", problems[0])
+		assert.Contains(t, problems[1], "missing.yaml: no such file or directory")
+		assert.Equal(t, "base.yaml: line 2: unknown key `WrfProcs`, did you mean `WrfProc`?", problems[2])
+	})
+
+	t.Run("Dump", func(t *testing.T) {
+		cfg, problems := loadFiles(t, files, conf.Overrides{
+			Profile: "small",
+			Set:     []string{"EnsembleMembers=0"},
+		})
+		require.Empty(t, problems)
+
+		var buf bytes.Buffer
+		require.NoError(t, cfg.Dump(&buf))
+		dump := buf.String()
+		assert.Contains(t, dump, "GeogridProc: 36 # base.yaml:2\n")
+		assert.Contains(t, dump, "WrfProc: 56 # profile small, config.yaml:5\n")
+		assert.Contains(t, dump, "  Count: 2 # profile small, config.yaml:7\n")
+		assert.Contains(t, dump, "  Interval: 3h0m0s # default\n")
+		assert.Contains(t, dump, "EnsembleMembers: 0 # --set EnsembleMembers\n")
+		assert.Contains(t, dump, "Domains: # base.yaml:16\n")
+		assert.Contains(t, dump, "  wrfout_d02.*: postproc-wrfout.sh # base.yaml:21\n")
+	})
+
+	t.Run("DumpInvalid", func(t *testing.T) {
+		rootdir := t.TempDir()
+		config := strings.Replace(validConfig, "EnsembleParallelism: 1", "EnsembleParallelism: 0\nWrfProcs: 10", 1)
+		require.NoError(t, os.WriteFile(filepath.Join(rootdir, "config.yaml"), []byte(config), 0644))
+
+		cfg, err := conf.LoadUnchecked(rootdir, conf.Overrides{})
+		var validationErr conf.ValidationError
+		require.ErrorAs(t, err, &validationErr)
+		assert.Len(t, validationErr.Problems, 1, "values are not checked")
+		require.NotNil(t, cfg)
+
+		var buf bytes.Buffer
+		require.NoError(t, cfg.Dump(&buf))
+		assert.Contains(t, buf.String(), "EnsembleParallelism: 0 # config.yaml:")
+	})
+}
+
+func TestForRun(t *testing.T) {
+	cfg, problems := loadFiles(t, map[string]string{
+		"base.yaml":   validConfig,
+		"config.yaml": profilesConfig,
+	}, conf.Overrides{Set: []string{"EnsembleParallelism=2"}})
+	require.Empty(t, problems)
+
+	t.Run("Unchanged", func(t *testing.T) {
+		runCfg, err := cfg.ForRun(arguments.Run{})
+		require.NoError(t, err)
+		assert.Same(t, cfg, runCfg)
+	})
+
+	t.Run("Profile", func(t *testing.T) {
+		runCfg, err := cfg.ForRun(arguments.Run{Profile: "small"})
+		require.NoError(t, err)
+		assert.Equal(t, 56, runCfg.WrfProcCount)
+		assert.Equal(t, 2, runCfg.EnsembleParallelism, "overrides are applied again")
+		assert.Equal(t, 112, cfg.WrfProcCount)
+	})
+
+	t.Run("Options", func(t *testing.T) {
+		assimilate := false
+		runCfg, err := cfg.ForRun(arguments.Run{Assimilate: &assimilate})
+		require.NoError(t, err)
+		assert.False(t, runCfg.AssimilateObservations)
+		assert.True(t, cfg.AssimilateObservations)
+	})
+
+	t.Run("Invalid", func(t *testing.T) {
+		members := 2
+		runCfg, err := cfg.ForRun(arguments.Run{Members: &members})
+		require.NoError(t, err)
+		var validationErr conf.ValidationError
+		require.ErrorAs(t, runCfg.CheckEnvironment(), &validationErr)
+		require.Len(t, validationErr.Problems, 1)
+		assert.Contains(t, validationErr.Problems[0], "template wrf-ensmember")
+
+		members = -1
+		_, err = cfg.ForRun(arguments.Run{Members: &members})
+		require.ErrorAs(t, err, &validationErr)
+		assert.Equal(t, []string{"EnsembleMembers cannot be negative: -1"}, validationErr.Problems)
+
+		_, err = cfg.ForRun(arguments.Run{Profile: "large"})
+		assert.ErrorContains(t, err, "profile `large` is not defined")
+	})
+}
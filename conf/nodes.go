@@ -0,0 +1,79 @@
+package conf
+
+import (
+	"fmt"
+
+	"github.com/meteocima/ensemble-runner/mpiman"
+)
+
+// Schedulers contains the batch schedulers
+// that can be used in Scheduler.
+var Schedulers = []string{"slurm", "pbs", "lsf", "hostfile", "local"}
+
+// nodeSource returns the source of the nodes configured by
+// Scheduler and Hostfile, or nil when Scheduler is omitted
+// and no batch scheduler is found in the environment.
+func (cfg *Config) nodeSource() (mpiman.NodeSource, error) {
+	switch cfg.Scheduler {
+	case "":
+		if cfg.Hostfile != "" {
+			return mpiman.Hostfile{Path: cfg.Hostfile}, nil
+		}
+		return mpiman.DetectNodeSource(), nil
+	case "slurm":
+		return mpiman.Slurm{}, nil
+	case "pbs":
+		return mpiman.PBS{}, nil
+	case "lsf":
+		return mpiman.LSF{}, nil
+	case "hostfile":
+		if cfg.Hostfile == "" {
+			return nil, fmt.Errorf("Scheduler is hostfile, but Hostfile is not set")
+		}
+		return mpiman.Hostfile{Path: cfg.Hostfile}, nil
+	case "local":
+		return mpiman.Localhost{}, nil
+	default:
+		return nil, fmt.Errorf("unknown Scheduler `%s`, must be one of %v", cfg.Scheduler, Schedulers)
+	}
+}
+
+// NodeSource returns the source from which the nodes available
+// to the simulation are read, or nil when Scheduler is omitted
+// and no batch scheduler is found in the environment.
+func (cfg *Config) NodeSource() mpiman.NodeSource {
+	source, err := cfg.nodeSource()
+	if err != nil {
+		// Scheduler is checked by Load
+		panic(err)
+	}
+	return source
+}
+
+// validateScheduler checks that Scheduler and
+// Hostfile describe a valid source of nodes.
+func (cfg *Config) validateScheduler() error {
+	if cfg.Hostfile != "" && cfg.Scheduler != "" && cfg.Scheduler != "hostfile" {
+		return fmt.Errorf("Hostfile is set, but Scheduler is %s", cfg.Scheduler)
+	}
+	_, err := cfg.nodeSource()
+	return err
+}
+
+// allocatedNodes returns the number of nodes available to
+// the simulation, or 0 if they are not known. Scheduler and
+// Hostfile are checked by validateScheduler.
+func (cfg *Config) allocatedNodes() (int, error) {
+	source, err := cfg.nodeSource()
+	if err != nil {
+		return 0, err
+	}
+	if source == nil || !source.Available() {
+		return 0, nil
+	}
+	nodes, err := source.Nodes()
+	if err != nil {
+		return 0, fmt.Errorf("cannot read nodes from %s: %w", source, err)
+	}
+	return len(nodes), nil
+}
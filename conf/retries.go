@@ -0,0 +1,103 @@
+package conf
+
+import (
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"golang.org/x/exp/maps"
+)
+
+// RetryConfig contains the policy used to
+// retry a process of the simulation when it fails.
+// Values omitted, which are nil, are taken from the
+// `default` entry of Retries, or from
+// server.DefaultRetryPolicy. Zero values set
+// explicitly are kept.
+type RetryConfig struct {
+	// Attempts is the maximum number of times the
+	// process is run, including the first one.
+	Attempts *int `yaml:"Attempts,omitempty"`
+	// Backoff is the delay before the first retry, doubled
+	// for every following one, up to MaxBackoff.
+	Backoff    *time.Duration `yaml:"Backoff,omitempty"`
+	MaxBackoff *time.Duration `yaml:"MaxBackoff,omitempty"`
+	// Jitter is the fraction, between 0 and 1,
+	// of every delay that is randomized.
+	Jitter *float64 `yaml:"Jitter,omitempty"`
+}
+
+// Or returns rc with the values omitted
+// taken from other.
+func (rc RetryConfig) Or(other RetryConfig) RetryConfig {
+	if rc.Attempts == nil {
+		rc.Attempts = other.Attempts
+	}
+	if rc.Backoff == nil {
+		rc.Backoff = other.Backoff
+	}
+	if rc.MaxBackoff == nil {
+		rc.MaxBackoff = other.MaxBackoff
+	}
+	if rc.Jitter == nil {
+		rc.Jitter = other.Jitter
+	}
+	return rc
+}
+
+// String returns the values set in rc.
+func (rc RetryConfig) String() string {
+	var values []string
+	if rc.Attempts != nil {
+		values = append(values, fmt.Sprintf("Attempts:%d", *rc.Attempts))
+	}
+	if rc.Backoff != nil {
+		values = append(values, fmt.Sprintf("Backoff:%s", *rc.Backoff))
+	}
+	if rc.MaxBackoff != nil {
+		values = append(values, fmt.Sprintf("MaxBackoff:%s", *rc.MaxBackoff))
+	}
+	if rc.Jitter != nil {
+		values = append(values, fmt.Sprintf("Jitter:%g", *rc.Jitter))
+	}
+	return "{" + strings.Join(values, " ") + "}"
+}
+
+// Retry returns the policy used to retry the process `name`,
+// that is one of Processes, when it fails, with the values
+// omitted taken from the `default` entry of Retries. Values
+// omitted there too are nil.
+func (cfg *Config) Retry(name string) RetryConfig {
+	return cfg.Retries[name].Or(cfg.Retries["default"])
+}
+
+// validateRetries returns a description of every
+// problem found in the configuration of retries.
+func (cfg *Config) validateRetries() []string {
+	var problems []string
+	names := maps.Keys(cfg.Retries)
+	sort.Strings(names)
+
+	for _, name := range names {
+		if name != "default" && !slices.Contains(Processes, name) {
+			problems = append(problems, fmt.Sprintf("Retries: unknown process `%s`, must be default or one of %v", name, Processes))
+			continue
+		}
+		rc := cfg.Retries[name]
+		if rc.Attempts != nil && *rc.Attempts < 0 {
+			problems = append(problems, fmt.Sprintf("Retries.%s.Attempts cannot be negative: %d", name, *rc.Attempts))
+		}
+		if rc.Backoff != nil && *rc.Backoff < 0 {
+			problems = append(problems, fmt.Sprintf("Retries.%s.Backoff cannot be negative: %s", name, *rc.Backoff))
+		}
+		if rc.MaxBackoff != nil && *rc.MaxBackoff < 0 {
+			problems = append(problems, fmt.Sprintf("Retries.%s.MaxBackoff cannot be negative: %s", name, *rc.MaxBackoff))
+		}
+		if rc.Jitter != nil && (*rc.Jitter < 0 || *rc.Jitter > 1) {
+			problems = append(problems, fmt.Sprintf("Retries.%s.Jitter must be between 0 and 1: %g", name, *rc.Jitter))
+		}
+	}
+	return problems
+}
@@ -0,0 +1,359 @@
+package conf
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/meteocima/ensemble-runner/arguments"
+	"golang.org/x/exp/maps"
+	"gopkg.in/yaml.v3"
+)
+
+// ValidationError is the error returned when the configuration
+// file, or the environment it describes, contains one or more
+// problems. Problems contains a description of every one of them.
+type ValidationError struct {
+	File     string
+	Problems []string
+}
+
+func (e ValidationError) Error() string {
+	return fmt.Sprintf("invalid configuration %s:\n  - %s", e.File, strings.Join(e.Problems, "\n  - "))
+}
+
+// unknownKeys returns a problem for every key in node that
+// does not correspond to a field of the struct type t, searching
+// recursively in nested structs and slices of structs.
+// path is the path of node, used to report problems.
+func unknownKeys(node *yaml.Node, t reflect.Type, path string) []string {
+	if node.Kind == yaml.DocumentNode {
+		return unknownKeys(node.Content[0], t, path)
+	}
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+
+	var problems []string
+	switch {
+	case t.Kind() == reflect.Struct && node.Kind == yaml.MappingNode:
+		fields := yamlFields(t)
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			key := node.Content[i]
+			field, ok := fields[key.Value]
+			if !ok {
+				problem := fmt.Sprintf("line %d: unknown key `%s%s`", key.Line, path, key.Value)
+				if similar := similarKey(key.Value, fields); similar != "" {
+					problem += fmt.Sprintf(", did you mean `%s%s`?", path, similar)
+				}
+				problems = append(problems, problem)
+				continue
+			}
+			problems = append(problems, unknownKeys(node.Content[i+1], field.Type, path+key.Value+".")...)
+		}
+	case t.Kind() == reflect.Slice && node.Kind == yaml.SequenceNode:
+		for i, item := range node.Content {
+			itemPath := fmt.Sprintf("%s[%d].", strings.TrimSuffix(path, "."), i)
+			problems = append(problems, unknownKeys(item, t.Elem(), itemPath)...)
+		}
+	}
+	return problems
+}
+
+// yamlFields returns the fields of struct type t,
+// indexed by the name they have in yaml documents.
+func yamlFields(t reflect.Type) map[string]reflect.StructField {
+	res := map[string]reflect.StructField{}
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+		name, _, _ := strings.Cut(field.Tag.Get("yaml"), ",")
+		if name == "-" {
+			continue
+		}
+		if name == "" {
+			name = strings.ToLower(field.Name)
+		}
+		res[name] = field
+	}
+	return res
+}
+
+// similarKey returns the name of the field in fields
+// that is most similar to key, or an empty string
+// if none of them is similar enough.
+func similarKey(key string, fields map[string]reflect.StructField) string {
+	best := ""
+	bestDist := 3
+	for name := range fields {
+		dist := editDistance(strings.ToLower(key), strings.ToLower(name))
+		if dist < bestDist || (dist == bestDist && best != "" && name < best) {
+			best = name
+			bestDist = dist
+		}
+	}
+	return best
+}
+
+// editDistance returns the Levenshtein distance between a and b.
+func editDistance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	curr := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		curr[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			curr[j] = min(prev[j]+1, curr[j-1]+1, prev[j-1]+cost)
+		}
+		prev, curr = curr, prev
+	}
+	return prev[len(b)]
+}
+
+// validate checks the values of the configuration, without
+// reading the environment or the file system, so that commands
+// that do not run simulations can use the configuration anywhere.
+// It returns a description of every problem found.
+func (cfg *Config) validate() []string {
+	var problems []string
+	problemf := func(format string, args ...any) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+
+	if err := cfg.validateScheduler(); err != nil {
+		problemf("%s", err)
+	}
+	if cfg.CoresPerNode <= 0 {
+		problemf("CoresPerNode must be a positive number: %d", cfg.CoresPerNode)
+	}
+	if cfg.EnsembleParallelism <= 0 {
+		problemf("EnsembleParallelism must be at least 1: %d", cfg.EnsembleParallelism)
+	}
+	if cfg.QuarantineAfter < 1 {
+		problemf("QuarantineAfter must be at least 1: %d", cfg.QuarantineAfter)
+	}
+	if cfg.AllocationTimeout < 0 {
+		problemf("AllocationTimeout cannot be negative: %s", cfg.AllocationTimeout)
+	}
+	timeouts := maps.Keys(cfg.Timeouts)
+	sort.Strings(timeouts)
+	for _, name := range timeouts {
+		if !slices.Contains(Processes, name) {
+			problemf("Timeouts: unknown process `%s`, must be one of %v", name, Processes)
+		} else if cfg.Timeouts[name] < 0 {
+			problemf("Timeouts.%s cannot be negative: %s", name, cfg.Timeouts[name])
+		}
+	}
+	if cfg.RestartInterval < 0 || cfg.RestartInterval.Truncate(time.Hour) != cfg.RestartInterval {
+		problemf("RestartInterval must be a positive whole number of hours: %s", cfg.RestartInterval)
+	}
+	if cfg.DateParallelism < 1 {
+		problemf("DateParallelism must be at least 1: %d", cfg.DateParallelism)
+	}
+	if cfg.EnsembleMembers < 0 {
+		problemf("EnsembleMembers cannot be negative: %d", cfg.EnsembleMembers)
+	}
+
+	for _, procs := range cfg.procCounts() {
+		if procs.needed && procs.count <= 0 {
+			problemf("%s must be a positive number of processes: %d", procs.name, procs.count)
+		}
+	}
+
+	problems = append(problems, cfg.validateLaunchers()...)
+	problems = append(problems, cfg.validateRetries()...)
+
+	cycles := cfg.AssimilationCycles
+	if cycles.Count < 1 {
+		problemf("AssimilationCycles.Count must be at least 1: %d", cycles.Count)
+	}
+	if cycles.Interval < 0 || cycles.Interval%time.Hour != 0 {
+		problemf("AssimilationCycles.Interval must be a positive whole number of hours: %s", cycles.Interval)
+	}
+	// workdirs of the cycles are named using the hour of their start
+	if time.Duration(cycles.Count-1)*cycles.Interval >= 24*time.Hour {
+		problemf("AssimilationCycles must span less than 24 hours: %d cycles every %s", cycles.Count, cycles.Interval)
+	}
+	if cycles.Window < 0 {
+		problemf("AssimilationCycles.Window must be positive: %s", cycles.Window)
+	}
+
+	if cfg.AssimilateObservations && !slices.ContainsFunc(cfg.Domains, func(d Domain) bool { return d.Assimilate }) {
+		problemf("AssimilateObservations is true, but no domain is configured to assimilate observations")
+	}
+
+	return problems
+}
+
+// procCount is the number of processes
+// configured for an MPI executable.
+type procCount struct {
+	name  string
+	count int
+	// needed is true when the
+	// executable is run at all.
+	needed bool
+}
+
+// procCounts returns the number of processes
+// configured for every MPI executable.
+func (cfg *Config) procCounts() []procCount {
+	return []procCount{
+		{"GeogridProc", cfg.GeogridProcCount, cfg.RunWPS},
+		{"MetgridProc", cfg.MetgridProcCount, cfg.RunWPS},
+		{"RealProc", cfg.RealProcCount, cfg.RunWPS},
+		{"WrfProc", cfg.WrfProcCount, true},
+		{"WrfStepProc", cfg.WrfStepProcCount, cfg.AssimilateObservations},
+		{"WrfdaProc", cfg.WrfdaProcCount, cfg.AssimilateObservations},
+	}
+}
+
+// CheckEnvironment checks that the simulations described by cfg
+// can run in the current environment: that the nodes of the
+// allocation have enough cores for the processes, and that the
+// directories and files needed by the enabled features exist,
+// including the background errors for the seasons of the dates
+// to run, read from $START_FORECAST or `arguments.txt`. It
+// returns a ValidationError describing every problem found.
+func (cfg *Config) CheckEnvironment() error {
+	if problems := cfg.validateEnvironment(cfg.rootdir); len(problems) > 0 {
+		return ValidationError{File: filepath.Join(cfg.rootdir, "config.yaml"), Problems: problems}
+	}
+	return nil
+}
+
+// validateEnvironment returns a description of every problem
+// found by CheckEnvironment, using rootdir as root directory.
+func (cfg *Config) validateEnvironment(rootdir string) []string {
+	var problems []string
+	problemf := func(format string, args ...any) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+
+	nodes, err := cfg.allocatedNodes()
+	if err != nil {
+		problemf("%s", err)
+	}
+	if nodes > 0 && cfg.DateParallelism > nodes {
+		problemf("DateParallelism is %d, but the allocation has only %d nodes", cfg.DateParallelism, nodes)
+	} else if _, singleDate := os.LookupEnv("START_FORECAST"); !singleDate && cfg.DateParallelism > 1 {
+		// every date runs on its own pool of nodes:
+		// the smallest one is used for checks.
+		nodes /= cfg.DateParallelism
+	}
+	for _, procs := range cfg.procCounts() {
+		cores := cfg.CoresPerNode * nodes
+		if procs.needed && nodes > 0 && cfg.CoresPerNode > 0 && procs.count > cores {
+			problemf("%s is %d, but the nodes available to every date have only %d cores (%d nodes with %d cores each)", procs.name, procs.count, cores, nodes, cfg.CoresPerNode)
+		}
+	}
+
+	checkDir := func(name, dir string) {
+		if info, err := os.Stat(dir); err != nil {
+			problemf("%s: %s", name, err)
+		} else if !info.IsDir() {
+			problemf("%s: %s is not a directory", name, dir)
+		}
+	}
+
+	templates := []string{"wrf-forecast"}
+	if cfg.EnsembleMembers > 0 {
+		templates = append(templates, "wrf-ensmember")
+	}
+
+	if cfg.RunWPS {
+		checkDir("GeogDataDir", cfg.GeogDataDir)
+		checkDir("GfsDir", cfg.GfsDir)
+		templates = append(templates, "wps")
+	}
+
+	if cfg.AssimilateObservations {
+		checkDir("ObDataDir", cfg.ObDataDir)
+		checkDir("CovarMatrixesDir", cfg.CovarMatrixesDir)
+		if cfg.AssimilationCycles.Count > 1 {
+			templates = append(templates, "wrf-step")
+		}
+
+		starts, err := startDates(rootdir)
+		if err != nil {
+			problemf("%s", err)
+		}
+		seasons := map[string]bool{}
+		for _, start := range starts {
+			seasons[season(start)] = true
+		}
+
+		for n, domain := range cfg.Domains {
+			if !domain.Assimilate {
+				continue
+			}
+			templates = append(templates, fmt.Sprintf("wrfda_%02d", n+1))
+			for _, season := range []string{"winter", "spring", "summer", "fall"} {
+				if !seasons[season] {
+					continue
+				}
+				be := filepath.Join(cfg.CovarMatrixesDir, season, fmt.Sprintf("be_d%02d", n+1))
+				if _, err := os.Stat(be); err != nil {
+					problemf("CovarMatrixesDir: background errors for domain %d in %s: %s", n+1, season, err)
+				}
+			}
+		}
+	}
+
+	for _, name := range templates {
+		checkDir("template "+name, filepath.Join(rootdir, "templates", name))
+	}
+
+	return problems
+}
+
+// startDates returns the start dates of the forecasts
+// to run, read from $START_FORECAST or, when not set,
+// from the `arguments.txt` file in the inputs directory.
+func startDates(rootdir string) ([]time.Time, error) {
+	if startS, ok := os.LookupEnv("START_FORECAST"); ok {
+		start, err := time.Parse("2006-01-02-15", startS)
+		if err != nil {
+			return nil, fmt.Errorf("cannot parse $START_FORECAST: %w", err)
+		}
+		return []time.Time{start}, nil
+	}
+
+	args, err := arguments.ReadFile(filepath.Join(rootdir, "inputs", "arguments.txt"))
+	if err != nil {
+		return nil, fmt.Errorf("cannot read dates to run: %w", err)
+	}
+	var starts []time.Time
+	for _, run := range args.Runs {
+		starts = append(starts, run.Start)
+	}
+	return starts, nil
+}
+
+// season returns the season of instant, using
+// the same approximation used by prepvars.
+func season(instant time.Time) string {
+	switch instant.Month() {
+	case 12, 1, 2:
+		return "winter"
+	case 3, 4, 5:
+		return "spring"
+	case 6, 7, 8:
+		return "summer"
+	default:
+		return "fall"
+	}
+}
@@ -0,0 +1,78 @@
+package dirprep
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// CheckDir reads all the templates in srcdir, like RenderDirLookup
+// does, but without writing anything, and returns all the errors
+// found in them, such as references to variables not defined by
+// lookup, each one with its file and line. Files that the Policy
+// of srcdir does not expand are not read. The error returned
+// is not nil only when srcdir cannot be read.
+func CheckDir(srcdir string, lookup Lookup) ([]error, error) {
+	var problems []error
+	report := func(err error) {
+		problems = append(problems, err)
+	}
+	policy, err := ReadPolicy(srcdir)
+	if err != nil {
+		var syntax *SyntaxError
+		if !errors.As(err, &syntax) {
+			return nil, err
+		}
+		report(err)
+	}
+
+	err = filepath.WalkDir(srcdir, func(src string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if _, err := expandEnv(strings.TrimPrefix(src, srcdir), lookup); err != nil {
+			locate(err, src, 0)
+			report(err)
+		}
+
+		if d.Type()&os.ModeSymlink == os.ModeSymlink {
+			linkDst, err := os.Readlink(src)
+			if err != nil {
+				return fmt.Errorf("CheckDir: cannot read source symlink %s: %w", src, err)
+			}
+			if _, err := expandEnv(linkDst, lookup); err != nil {
+				locate(err, src, 0)
+				report(err)
+			}
+			return nil
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		rel, err := filepath.Rel(srcdir, src)
+		if err != nil {
+			return err
+		}
+		if rel == PolicyFile {
+			return nil
+		}
+		if action, err := policy.fileAction(src, rel); err != nil || action != Expand {
+			return err
+		}
+
+		r, err := os.Open(src)
+		if err != nil {
+			return fmt.Errorf("CheckDir: cannot open source file %s: %w", src, err)
+		}
+		defer r.Close()
+		return render(r, io.Discard, lookup, src, 0, report)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("CheckDir: cannot walk `%s` directory: %w", srcdir, err)
+	}
+	return problems, nil
+}
@@ -1,14 +1,16 @@
 package dirprep
 
 import (
-	"bufio"
 	"errors"
 	"fmt"
 	"io"
 	"io/fs"
 	"os"
 	"path/filepath"
+	"slices"
 	"strings"
+
+	"golang.org/x/exp/maps"
 )
 
 // Transformer is a function that read the file or directory
@@ -37,9 +39,16 @@ func getShellName(s string) (string, int) {
 		if len(s) > 2 && isShellSpecialVar(s[1]) && s[2] == '}' {
 			return s[1:2], 3
 		}
-		// Scan to closing brace
+		// Scan to closing brace, skipping the
+		// ones of ${} nested in a default value
+		depth := 0
 		for i := 1; i < len(s); i++ {
-			if s[i] == '}' {
+			switch {
+			case s[i] == '{':
+				depth++
+			case s[i] == '}' && depth > 0:
+				depth--
+			case s[i] == '}':
 				if i == 1 {
 					return "", 2 // Bad syntax; eat "${}"
 				}
@@ -62,10 +71,16 @@ func isAlphaNum(c uint8) bool {
 	return c == '_' || '0' <= c && c <= '9' || 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z'
 }
 
-// Expand replaces ${var} or $var in the string based on the mapping function.
-// For example, expandEnv(s) is equivalent to os.Expand(s, os.Getenv).
-func expandEnv(s string, mapping func(key string) string) string {
+// expandEnv replaces $var, ${var}, ${var:-default} and
+// ${var:?message} in the string with the values returned
+// by lookup. default and message are used when var is not
+// defined or is empty: `default` is expanded in its place,
+// while `message` is returned in a RequiredVarError. When
+// a plain $var or ${var} is not defined, expandEnv returns
+// an UndefinedVarError with the names of all such variables.
+func expandEnv(s string, lookup Lookup) (string, error) {
 	var buf []byte
+	var undefined []string
 	// ${} is all ASCII, so bytes are fine for this operation.
 	i := 0
 	for j := 0; j < len(s); j++ {
@@ -82,17 +97,56 @@ func expandEnv(s string, mapping func(key string) string) string {
 				// Valid syntax, but $ was not followed by a
 				// name. Leave the dollar character untouched.
 				buf = append(buf, s[j])
-			} else {
-				buf = append(buf, mapping(name)...)
+			} else if name, word, op := splitOperator(name); op != "" {
+				val, err := expandOperator(name, word, op, lookup)
+				if err != nil {
+					return "", err
+				}
+				buf = append(buf, val...)
+			} else if val, ok := lookup(name); ok {
+				buf = append(buf, val...)
+			} else if !slices.Contains(undefined, name) {
+				undefined = append(undefined, name)
 			}
 			j += w
 			i = j + 1
 		}
 	}
+	if len(undefined) > 0 {
+		return "", &UndefinedVarError{Vars: undefined}
+	}
 	if buf == nil {
-		return s
+		return s, nil
+	}
+	return string(buf) + s[i:], nil
+}
+
+// splitOperator splits the content of a ${} expansion in the name
+// of the variable, the operator that follows it (`:-` or `:?`)
+// and its argument. op is empty when there's no operator.
+func splitOperator(s string) (name, word, op string) {
+	var i int
+	for i = 0; i < len(s) && isAlphaNum(s[i]); i++ {
+	}
+	if i > 0 && i+1 < len(s) && s[i] == ':' && (s[i+1] == '-' || s[i+1] == '?') {
+		return s[:i], s[i+2:], s[i : i+2]
+	}
+	return s, "", ""
+}
+
+// expandOperator returns the value of ${name:-word}
+// or ${name:?word}, according to op.
+func expandOperator(name, word, op string, lookup Lookup) (string, error) {
+	if val, ok := lookup(name); ok && val != "" {
+		return val, nil
+	}
+	if op == ":?" {
+		if word == "" {
+			word = "not set"
+		}
+		return "", &RequiredVarError{Var: name, Message: word}
 	}
-	return string(buf) + s[i:]
+	return expandEnv(word, lookup)
 }
 
 // EnvExpander is a Transformer function that
@@ -105,6 +159,12 @@ func expandEnv(s string, mapping func(key string) string) string {
 //     dst path, create it as a new file, and copy the content
 //     from src using `CopyExpanding`
 func EnvExpander(src, dst string, d fs.DirEntry, mapping func(key string) string) (err error) {
+	return envExpander(src, dst, d, mappingLookup(mapping))
+}
+
+// envExpander works like EnvExpander, but
+// reads the variables with lookup.
+func envExpander(src, dst string, d fs.DirEntry, lookup Lookup) (err error) {
 	if err != nil {
 		return fmt.Errorf("EnvExpander: cannot read source file info %s: %w", src, err)
 	}
@@ -125,7 +185,10 @@ func EnvExpander(src, dst string, d fs.DirEntry, mapping func(key string) string
 		if err != nil {
 			return fmt.Errorf("EnvExpander: cannot read source symlink %s: %w", src, err)
 		}
-		linkDst = expandEnv(linkDst, mapping)
+		linkDst, err = expandEnv(linkDst, lookup)
+		if err != nil {
+			return err
+		}
 
 		if err := os.Remove(dst); err != nil && !errors.Is(err, os.ErrNotExist) {
 			return fmt.Errorf("EnvExpander: cannot delete existing symlink %s: %w", dst, err)
@@ -138,7 +201,23 @@ func EnvExpander(src, dst string, d fs.DirEntry, mapping func(key string) string
 		return nil
 	}
 
-	// copy & expand regular files
+	// copy binary files unchanged
+	binary, err := IsBinary(src)
+	if err != nil {
+		return fmt.Errorf("EnvExpander: %w", err)
+	}
+	if binary {
+		if err := copyFile(src, dst); err != nil {
+			return fmt.Errorf("EnvExpander: %w", err)
+		}
+		return nil
+	}
+	return expandFile(src, dst, lookup)
+}
+
+// expandFile copies the regular file src to dst,
+// expanding its variables and running its directives.
+func expandFile(src, dst string, lookup Lookup) (err error) {
 	r, err := os.Open(src)
 	if err != nil {
 		return fmt.Errorf("EnvExpander: cannot open source file %s: %w", src, err)
@@ -155,7 +234,7 @@ func EnvExpander(src, dst string, d fs.DirEntry, mapping func(key string) string
 		err = errors.Join(err, w.Close())
 	}()
 
-	return CopyExpanding(r, w, mapping)
+	return render(r, w, lookup, src, 0, nil)
 }
 
 type Permissions map[string]fs.FileMode
@@ -165,13 +244,25 @@ type Permissions map[string]fs.FileMode
 // function passing the src path and the corresponding
 // path under dstdir
 func RecurseDir(srcdir, dstdir string, tr Transformer, mapping func(key string) string) (Permissions, error) {
+	return recurseDir(srcdir, dstdir, func(src, dst string, d fs.DirEntry) error {
+		return tr(src, dst, d, mapping)
+	}, mappingLookup(mapping))
+}
+
+// recurseDir works like RecurseDir, but
+// reads the variables with lookup.
+func recurseDir(srcdir, dstdir string, tr func(src, dst string, d fs.DirEntry) error, lookup Lookup) (Permissions, error) {
 	perm := Permissions{}
 	err := filepath.WalkDir(srcdir, func(src string, d fs.DirEntry, err error) error {
 		if err != nil {
 			return err
 		}
 		dst := filepath.Join(dstdir, strings.TrimPrefix(src, srcdir))
-		dst = expandEnv(dst, mapping)
+		dst, err = expandEnv(dst, lookup)
+		if err != nil {
+			locate(err, src, 0)
+			return err
+		}
 
 		i, err := d.Info()
 		if err != nil {
@@ -182,7 +273,11 @@ func RecurseDir(srcdir, dstdir string, tr Transformer, mapping func(key string)
 			// changed and is always 0777
 			perm[dst] = i.Mode()
 		}
-		return tr(src, dst, d, mapping)
+		err = tr(src, dst, d)
+		if err != nil {
+			locate(err, src, 0)
+		}
+		return err
 	})
 	if err != nil {
 		return nil, fmt.Errorf("RecurseDir: cannot walk `%s` directory: %w", srcdir, err)
@@ -193,42 +288,223 @@ func RecurseDir(srcdir, dstdir string, tr Transformer, mapping func(key string)
 
 // CopyExpanding read from `r` line by line,
 // exe each line using `expandEnv`
-// and write the result to `w`
+// and write the result to `w`.
+// Directives in the lines are run as described
+// in the readme, and included files are
+// resolved against the working directory.
 func CopyExpanding(r io.Reader, w io.Writer, mapping func(key string) string) error {
-	scanner := bufio.NewScanner(r)
-	for scanner.Scan() {
-		l := expandEnv(scanner.Text(), mapping)
+	return render(r, w, mappingLookup(mapping), "", 0, nil)
+}
+
+// ApplyPermissions applies the permissions in perms. Files come
+// first, and directories last, the deepest first, so that a
+// read-only directory does not prevent changing its content.
+// Within these groups, paths are sorted.
+func ApplyPermissions(perms Permissions) error {
+	files := maps.Keys(perms)
+	slices.SortFunc(files, func(a, b string) int {
+		aDir, bDir := perms[a].IsDir(), perms[b].IsDir()
+		switch {
+		case aDir != bDir && aDir:
+			return 1
+		case aDir != bDir:
+			return -1
+		case aDir:
+			if depth := pathDepth(b) - pathDepth(a); depth != 0 {
+				return depth
+			}
+		}
+		return strings.Compare(a, b)
+	})
 
-		if _, err := w.Write([]byte(l + "\n")); err != nil {
-			return fmt.Errorf("CopyExpanding: cannot write to target file: %w", err)
+	for _, file := range files {
+		err := os.Chmod(file, perms[file])
+		if err != nil {
+			return fmt.Errorf("ApplyPermissions: cannot apply permissions to %s: %w", file, err)
 		}
 	}
+	return nil
+}
+
+// pathDepth returns the number of elements of path.
+func pathDepth(path string) int {
+	return strings.Count(filepath.Clean(path), string(filepath.Separator))
+}
+
+// RenderDirEnv renders the templates in srcdir to dstdir,
+// expanding the variables with mapping, and writes the manifest
+// of the render next to dstdir, at ManifestPath(dstdir).
+//
+// The templates are rendered in a staging directory next to
+// dstdir, that then replaces dstdir with a rename, so that
+// dstdir never contains a partial render or files of a previous
+// one. When rendering fails, dstdir and its manifest are left
+// untouched.
+func RenderDirEnv(srcdir, dstdir string, mapping func(key string) string) error {
+	if err := renderDirs([]string{srcdir}, dstdir, mappingLookup(mapping), nil); err != nil {
+		return fmt.Errorf("RenderDirEnv: %w", err)
+	}
+	return nil
+}
+
+// RenderDir works like RenderDirEnv, but expands the variables
+// in vars. When a file refers to variables not in vars,
+// it fails with an UndefinedVarError.
+func RenderDir(srcdir, dstdir string, vars map[string]string) error {
+	return RenderDirLookup(srcdir, dstdir, func(key string) (string, bool) {
+		val, ok := vars[key]
+		return val, ok
+	})
+}
 
-	if err := scanner.Err(); err != nil {
-		return fmt.Errorf("CopyExpanding: cannot read from source file: %w", err)
+// RenderDirLookup works like RenderDir, but
+// reads the variables with lookup.
+func RenderDirLookup(srcdir, dstdir string, lookup Lookup) error {
+	return RenderDirsLookup([]string{srcdir}, dstdir, lookup)
+}
+
+// RenderDirsLookup works like RenderDirLookup, but renders
+// all of srcdirs, one over the other, in the same dstdir.
+func RenderDirsLookup(srcdirs []string, dstdir string, lookup Lookup) error {
+	if err := renderDirs(srcdirs, dstdir, lookup, nil); err != nil {
+		return fmt.Errorf("RenderDir: %w", err)
 	}
+	return nil
+}
 
+// RenderDirChecked works like RenderDir, but calls check with
+// the staging directory once the templates are rendered in it,
+// e.g. CheckNamelists. When check fails, the render fails and
+// dstdir is left untouched.
+func RenderDirChecked(srcdir, dstdir string, vars map[string]string, check func(dir string) error) error {
+	lookup := func(key string) (string, bool) {
+		val, ok := vars[key]
+		return val, ok
+	}
+	if err := renderDirs([]string{srcdir}, dstdir, lookup, check); err != nil {
+		return fmt.Errorf("RenderDirChecked: %w", err)
+	}
 	return nil
 }
 
-func ApplyPermissions(perms Permissions) error {
-	for file, perm := range perms {
-		err := os.Chmod(file, perm)
+// renderDirs renders srcdirs to dstdir, through a staging
+// directory, reading the variables with lookup, and saves
+// the manifest of the render. When check is not nil, it's
+// called with the staging directory before it replaces dstdir.
+func renderDirs(srcdirs []string, dstdir string, lookup Lookup, check func(dir string) error) (err error) {
+	staging, err := newStaging(dstdir)
+	if err != nil {
+		return err
+	}
+	defer func() {
 		if err != nil {
-			return fmt.Errorf("ApplyPermissions: cannot apply permissions to %s: %w", file, err)
+			err = errors.Join(err, removeDir(staging))
 		}
+	}()
+
+	manifest, err := newManifest(srcdirs, dstdir, staging)
+	if err != nil {
+		return err
 	}
-	return nil
+	perms := Permissions{}
+	for template, srcdir := range srcdirs {
+		if err := renderDir(template, srcdir, staging, lookup, manifest, perms); err != nil {
+			return err
+		}
+	}
+	if check != nil {
+		if err := check(staging); err != nil {
+			return err
+		}
+	}
+	if err := ApplyPermissions(perms); err != nil {
+		return err
+	}
+	// the manifest of the previous render is removed
+	// with the directory it describes, and a failed
+	// replace leaves neither of them
+	err = os.Remove(ManifestPath(dstdir))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("cannot remove previous manifest: %w", err)
+	}
+	if err := replaceDir(staging, dstdir); err != nil {
+		return err
+	}
+	return manifest.Save()
 }
 
-func RenderDirEnv(srcdir, dstdir string, mapping func(key string) string) error {
-	perms, err := RecurseDir(srcdir, dstdir, EnvExpander, mapping)
+// renderDir renders srcdir, the template directory with index
+// template in manifest, to dstdir, reading the variables with
+// lookup, recording the files rendered in manifest and adding
+// to perms the permissions to apply to them.
+func renderDir(template int, srcdir, dstdir string, lookup Lookup, manifest *Manifest, perms Permissions) error {
+	// fileVars contains the variables used by the
+	// path and the content of the file being rendered
+	var fileVars []string
+	tracked := func(key string) (string, bool) {
+		val, ok := lookup(key)
+		if ok {
+			manifest.Vars[key] = val
+		}
+		if !slices.Contains(fileVars, key) {
+			fileVars = append(fileVars, key)
+		}
+		return val, ok
+	}
+
+	policy, err := ReadPolicy(srcdir)
 	if err != nil {
-		return fmt.Errorf("RenderDirEnv: %w", err)
+		return err
 	}
-	err = ApplyPermissions(perms)
+	// unmanaged contains the files whose permissions are
+	// not applied: the policy file, that is not rendered,
+	// and the files linked to the template directory,
+	// whose permissions would change in it too
+	var unmanaged []string
+
+	srcPerms, err := recurseDir(srcdir, dstdir, func(src, dst string, d fs.DirEntry) error {
+		defer func() { fileVars = nil }()
+		if !d.Type().IsRegular() {
+			if err := envExpander(src, dst, d, tracked); err != nil {
+				return err
+			}
+			return manifest.add(template, src, dst, d, "", fileVars)
+		}
+
+		rel, err := filepath.Rel(srcdir, src)
+		if err != nil {
+			return err
+		}
+		if rel == PolicyFile {
+			unmanaged = append(unmanaged, dst)
+			return nil
+		}
+		action, err := policy.fileAction(src, rel)
+		if err != nil {
+			return err
+		}
+		action, err = renderFile(action, src, dst, tracked)
+		if err != nil {
+			return err
+		}
+		if action == Hardlink || action == Symlink {
+			unmanaged = append(unmanaged, dst)
+		}
+		return manifest.add(template, src, dst, d, action, fileVars)
+	}, tracked)
 	if err != nil {
-		return fmt.Errorf("RenderDirEnv: %w", err)
+		return err
+	}
+	for _, dst := range unmanaged {
+		delete(srcPerms, dst)
+	}
+	for dst, perm := range srcPerms {
+		perms[dst] = perm
+	}
+	// a file rendered by a previous srcdir can
+	// be replaced by a link, or by the policy file
+	for _, dst := range unmanaged {
+		delete(perms, dst)
 	}
 	return nil
 }
@@ -78,6 +78,477 @@ func TestEnvExpander(t *testing.T) {
 
 }
 
+func TestRenderDir(t *testing.T) {
+	src := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(src, "namelist"), []byte("start = $START\n"), 0644))
+
+	t.Run("ExpandsVars", func(t *testing.T) {
+		dst := filepath.Join(t.TempDir(), "result")
+		require.NoError(t, RenderDir(src, dst, map[string]string{"START": "2020-01-01"}))
+		content, err := os.ReadFile(filepath.Join(dst, "namelist"))
+		require.NoError(t, err)
+		assert.Equal(t, "start = 2020-01-01\n", string(content))
+	})
+
+	t.Run("FailsOnUndefinedVars", func(t *testing.T) {
+		dst := filepath.Join(t.TempDir(), "result")
+		err := RenderDir(src, dst, map[string]string{})
+		var undefined *UndefinedVarError
+		require.True(t, errors.As(err, &undefined))
+		assert.Equal(t, filepath.Join(src, "namelist"), undefined.File)
+		assert.Equal(t, []string{"START"}, undefined.Vars)
+		assert.ErrorContains(t, err, "namelist:1: undefined variable $START")
+	})
+}
+
+func TestTemplate(t *testing.T) {
+	vars := map[string]string{"RESTART": ".true.", "SEED": "42", "EMPTY": ""}
+	lookup := func(key string) (string, bool) {
+		val, ok := vars[key]
+		return val, ok
+	}
+	renderString := func(tmpl string) (string, error) {
+		var dest bytes.Buffer
+		err := render(strings.NewReader(tmpl), &dest, lookup, "namelist.input", 0, nil)
+		return dest.String(), err
+	}
+
+	t.Run("Defaults", func(t *testing.T) {
+		res, err := renderString("restart = ${RESTART:-.false.}, seed = ${MISSING:-${SEED}}, empty = ${EMPTY:-none}")
+		require.NoError(t, err)
+		assert.Equal(t, "restart = .true., seed = 42, empty = none\n", res)
+	})
+
+	t.Run("Required", func(t *testing.T) {
+		_, err := renderString("\nseed = ${MISSING:?needed by ensemble members}")
+		var required *RequiredVarError
+		require.True(t, errors.As(err, &required))
+		assert.Equal(t, Pos{File: "namelist.input", Line: 2}, required.Pos)
+		assert.EqualError(t, err, "namelist.input:2: $MISSING: needed by ensemble members")
+	})
+
+	t.Run("Undefined", func(t *testing.T) {
+		_, err := renderString("a = $MISSING, b = ${OTHER}")
+		assert.EqualError(t, err, "namelist.input:1: undefined variable $MISSING, $OTHER")
+	})
+
+	t.Run("Conditionals", func(t *testing.T) {
+		res, err := renderString(strings.Join([]string{
+			"@if SEED",
+			"iseed = $SEED",
+			"@if RESTART == .false.",
+			"cold start",
+			"@else",
+			"warm start",
+			"@end",
+			"@end",
+			"@if !SEED",
+			"no seed $MISSING",
+			"@end",
+			"@if EMPTY",
+			"empty",
+			"@else",
+			"not empty",
+			"@end",
+			"@ignored",
+		}, "\n"))
+		require.NoError(t, err)
+		assert.Equal(t, "iseed = 42\nwarm start\nnot empty\n@ignored\n", res)
+	})
+
+	t.Run("UnbalancedConditionals", func(t *testing.T) {
+		_, err := renderString("@if SEED\n")
+		assert.EqualError(t, err, "namelist.input:1: @if without @end")
+		_, err = renderString("@end\n")
+		assert.EqualError(t, err, "namelist.input:1: @end without @if")
+		_, err = renderString("@if SEED\n@else\n@else\n@end")
+		assert.EqualError(t, err, "namelist.input:3: @else without @if")
+	})
+
+	t.Run("Includes", func(t *testing.T) {
+		dir := t.TempDir()
+		require.NoError(t, os.WriteFile(filepath.Join(dir, "stoch-42"), []byte("iseed = $SEED\n"), 0644))
+		require.NoError(t, os.WriteFile(filepath.Join(dir, "broken"), []byte("\n$MISSING\n"), 0644))
+		require.NoError(t, os.WriteFile(filepath.Join(dir, "loop"), []byte("@include loop\n"), 0644))
+		file := filepath.Join(dir, "namelist.input")
+
+		var dest bytes.Buffer
+		require.NoError(t, render(strings.NewReader("&stoch\n@include stoch-$SEED\n/"), &dest, lookup, file, 0, nil))
+		assert.Equal(t, "&stoch\niseed = 42\n/\n", dest.String())
+
+		err := render(strings.NewReader("@include broken"), &dest, lookup, file, 0, nil)
+		assert.EqualError(t, err, filepath.Join(dir, "broken")+":2: undefined variable $MISSING")
+
+		err = render(strings.NewReader("@include loop"), &dest, lookup, file, 0, nil)
+		assert.ErrorContains(t, err, "more than 16 nested includes")
+	})
+}
+
+func TestCheckDir(t *testing.T) {
+	src := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(src, "namelist"), []byte("a = $A\n@if B\nb = $MISSING\n@end\nc = ${C:?needed}\n"), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(src, "file${DIR}"), []byte("@if A\n"), 0644))
+	require.NoError(t, os.Symlink("$LINK/file", filepath.Join(src, "link")))
+	lookup := func(key string) (string, bool) {
+		if key == "B" {
+			return "yes", true
+		}
+		return "", false
+	}
+
+	problems, err := CheckDir(src, lookup)
+	require.NoError(t, err)
+	var msgs []string
+	for _, problem := range problems {
+		msgs = append(msgs, strings.TrimPrefix(problem.Error(), src+"/"))
+	}
+	assert.Equal(t, []string{
+		"file${DIR}: undefined variable $DIR",
+		"file${DIR}:1: @if without @end",
+		"link: undefined variable $LINK",
+		"namelist:1: undefined variable $A",
+		"namelist:3: undefined variable $MISSING",
+		"namelist:5: $C: needed",
+	}, msgs)
+}
+
+func TestManifest(t *testing.T) {
+	src := t.TempDir()
+	require.NoError(t, os.Mkdir(filepath.Join(src, "dir"), 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(src, "dir", "file_$NAME"), []byte("$CONTENT\n"), 0644))
+	require.NoError(t, os.Symlink("$TARGET", filepath.Join(src, "link")))
+	dst := filepath.Join(t.TempDir(), "result")
+	vars := map[string]string{"NAME": "a", "CONTENT": "hello", "TARGET": "/data", "UNUSED": "x"}
+
+	require.NoError(t, RenderDir(src, dst, vars))
+	m, err := ReadManifest(dst)
+	require.NoError(t, err)
+	assert.Equal(t, []string{src}, m.Sources)
+	assert.Equal(t, dst, m.Destination)
+	assert.Equal(t, []ManifestFile{
+		{
+			Source:      "dir/file_$NAME",
+			Destination: "dir/file_a",
+			Action:      Expand,
+			// sha256 of "hello\n"
+			SHA256: "5891b5b522d5df086d0ff0b110fbd9d21bb4fc7163af34d08286a2e846f6be03",
+			Vars:   []string{"NAME", "CONTENT"},
+		},
+		{Source: "link", Destination: "link", Link: "/data", Vars: []string{"TARGET"}},
+	}, m.Files)
+	assert.Equal(t, map[string]string{"NAME": "a", "CONTENT": "hello", "TARGET": "/data"}, m.Vars)
+
+	t.Run("KeptOnFailure", func(t *testing.T) {
+		delete(vars, "CONTENT")
+		require.Error(t, RenderDir(src, dst, vars))
+		kept, err := ReadManifest(dst)
+		require.NoError(t, err)
+		assert.Equal(t, m.Files, kept.Files)
+	})
+}
+
+func TestRenderDirStaging(t *testing.T) {
+	src := t.TempDir()
+	require.NoError(t, os.Mkdir(filepath.Join(src, "ro"), 0555))
+	require.NoError(t, os.WriteFile(filepath.Join(src, "file"), []byte("$CONTENT\n"), 0644))
+	parent := t.TempDir()
+	dst := filepath.Join(parent, "result")
+	require.NoError(t, os.Mkdir(dst, 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(dst, "stale"), []byte("old"), 0644))
+
+	// entries in parent other than dst and its manifest
+	leftovers := func() []string {
+		entries, err := os.ReadDir(parent)
+		require.NoError(t, err)
+		var names []string
+		for _, e := range entries {
+			if e.Name() != "result" && e.Name() != "result.manifest.json" {
+				names = append(names, e.Name())
+			}
+		}
+		return names
+	}
+
+	require.NoError(t, RenderDir(src, dst, map[string]string{"CONTENT": "new"}))
+	assert.NoFileExists(t, filepath.Join(dst, "stale"))
+	content, err := os.ReadFile(filepath.Join(dst, "file"))
+	require.NoError(t, err)
+	assert.Equal(t, "new\n", string(content))
+	assert.Empty(t, leftovers())
+
+	t.Run("FailureKeepsTarget", func(t *testing.T) {
+		require.Error(t, RenderDir(src, dst, map[string]string{}))
+		content, err := os.ReadFile(filepath.Join(dst, "file"))
+		require.NoError(t, err)
+		assert.Equal(t, "new\n", string(content))
+		assert.Empty(t, leftovers())
+	})
+
+	t.Run("CheckFailureKeepsTarget", func(t *testing.T) {
+		var checked string
+		err := RenderDirChecked(src, dst, map[string]string{"CONTENT": "checked"}, func(dir string) error {
+			checked = dir
+			assert.FileExists(t, filepath.Join(dir, "file"))
+			return errors.New("invalid")
+		})
+		require.ErrorContains(t, err, "invalid")
+		assert.NotEqual(t, dst, checked)
+		content, err := os.ReadFile(filepath.Join(dst, "file"))
+		require.NoError(t, err)
+		assert.Equal(t, "new\n", string(content))
+		assert.FileExists(t, ManifestPath(dst))
+		assert.Empty(t, leftovers())
+	})
+
+	t.Run("Layers", func(t *testing.T) {
+		over := t.TempDir()
+		require.NoError(t, os.WriteFile(filepath.Join(over, "file"), []byte("over\n"), 0644))
+		require.NoError(t, RenderDirsLookup([]string{src, over}, dst, func(key string) (string, bool) {
+			return "new", true
+		}))
+		content, err := os.ReadFile(filepath.Join(dst, "file"))
+		require.NoError(t, err)
+		assert.Equal(t, "over\n", string(content))
+
+		m, err := ReadManifest(dst)
+		require.NoError(t, err)
+		require.Len(t, m.Files, 1)
+		assert.Equal(t, 1, m.Files[0].Template)
+	})
+}
+
+func TestPolicy(t *testing.T) {
+	src := t.TempDir()
+	write := func(name, content string, perm fs.FileMode) {
+		require.NoError(t, os.MkdirAll(filepath.Dir(filepath.Join(src, name)), 0755))
+		require.NoError(t, os.WriteFile(filepath.Join(src, name), []byte(content), perm))
+	}
+	write(PolicyFile, "# static inputs\n*.bin symlink\nstatic/* hardlink\nraw.txt copy\n", 0644)
+	write("coeff.bin", "$NOT_EXPANDED", 0600)
+	write("static/be.dat", "$NOT_EXPANDED", 0600)
+	write("raw.txt", "$NOT_EXPANDED", 0644)
+	write("table.dat", "binary\x00$NOT_EXPANDED", 0644)
+	longLine := strings.Repeat("x", 100*1024)
+	write("namelist", longLine+" $VAR\r\nend", 0644)
+	dst := filepath.Join(t.TempDir(), "result")
+
+	syscall.Umask(0)
+	require.NoError(t, RenderDir(src, dst, map[string]string{"VAR": "value"}))
+
+	target, err := os.Readlink(filepath.Join(dst, "coeff.bin"))
+	require.NoError(t, err)
+	assert.Equal(t, filepath.Join(src, "coeff.bin"), target)
+
+	srcInfo, err := os.Stat(filepath.Join(src, "static/be.dat"))
+	require.NoError(t, err)
+	dstInfo, err := os.Stat(filepath.Join(dst, "static/be.dat"))
+	require.NoError(t, err)
+	assert.True(t, os.SameFile(srcInfo, dstInfo))
+	// permissions of linked files are not changed
+	assert.Equal(t, fs.FileMode(0600), srcInfo.Mode().Perm())
+
+	content, err := os.ReadFile(filepath.Join(dst, "raw.txt"))
+	require.NoError(t, err)
+	assert.Equal(t, "$NOT_EXPANDED", string(content))
+	content, err = os.ReadFile(filepath.Join(dst, "table.dat"))
+	require.NoError(t, err)
+	assert.Equal(t, "binary\x00$NOT_EXPANDED", string(content))
+	content, err = os.ReadFile(filepath.Join(dst, "namelist"))
+	require.NoError(t, err)
+	assert.Equal(t, longLine+" value\nend\n", string(content))
+
+	_, err = os.Lstat(filepath.Join(dst, PolicyFile))
+	assert.ErrorIs(t, err, os.ErrNotExist)
+
+	m, err := ReadManifest(dst)
+	require.NoError(t, err)
+	actions := map[string]Action{}
+	for _, file := range m.Files {
+		actions[file.Source] = file.Action
+	}
+	assert.Equal(t, map[string]Action{
+		"coeff.bin":     Symlink,
+		"static/be.dat": Hardlink,
+		"raw.txt":       Copy,
+		"table.dat":     Copy,
+		"namelist":      Expand,
+	}, actions)
+
+	t.Run("LayerOverLinks", func(t *testing.T) {
+		over := t.TempDir()
+		require.NoError(t, os.Mkdir(filepath.Join(over, "static"), 0755))
+		require.NoError(t, os.WriteFile(filepath.Join(over, "coeff.bin"), []byte("OVERRIDE $VAR\n"), 0644))
+		require.NoError(t, os.WriteFile(filepath.Join(over, "static", "be.dat"), []byte("OVERRIDE $VAR\n"), 0644))
+		require.NoError(t, RenderDirsLookup([]string{src, over}, dst, func(key string) (string, bool) {
+			return "value", true
+		}))
+
+		for _, name := range []string{"coeff.bin", "static/be.dat"} {
+			content, err := os.ReadFile(filepath.Join(dst, name))
+			require.NoError(t, err)
+			assert.Equal(t, "OVERRIDE value\n", string(content), name)
+			content, err = os.ReadFile(filepath.Join(src, name))
+			require.NoError(t, err)
+			assert.Equal(t, "$NOT_EXPANDED", string(content), name)
+		}
+	})
+
+	t.Run("InvalidPolicy", func(t *testing.T) {
+		_, err := ParsePolicy(strings.NewReader("*.bin link\n"))
+		assert.EqualError(t, err, "line 1: unknown action `link`, must be one of expand, copy, hardlink or symlink")
+		_, err = ParsePolicy(strings.NewReader("\n*.bin\n"))
+		assert.EqualError(t, err, "line 2: expected `<glob> <action>`, found `*.bin`")
+	})
+}
+
+func TestNamelist(t *testing.T) {
+	const src = `! rendered by dirprep
+&time_control
+ run_hours = 24,
+ start_year = 2020, 2020 2020,
+ restart = .false.,
+ auxinput4_inname = "wrflowinp_d<domain>", ! comment
+ history_interval = 60, , 3*180
+/
+
+&domains
+ max_dom = 3,
+&end
+`
+	t.Run("Parse", func(t *testing.T) {
+		nl, err := ParseNamelist(strings.NewReader(src))
+		require.NoError(t, err)
+		require.Len(t, nl.Groups, 2)
+		assert.Equal(t, 2, nl.Groups[0].Line)
+		assert.Equal(t, []string{"24"}, nl.Get("time_control", "run_hours"))
+		assert.Equal(t, []string{"2020", "2020", "2020"}, nl.Get("TIME_CONTROL", "Start_Year"))
+		assert.Equal(t, []string{`"wrflowinp_d<domain>"`}, nl.Get("time_control", "auxinput4_inname"))
+		assert.Equal(t, []string{"60", "", "3*180"}, nl.Get("time_control", "history_interval"))
+		assert.Equal(t, []string{"3"}, nl.Get("domains", "max_dom"))
+		assert.Nil(t, nl.Get("physics", "mp_physics"))
+	})
+
+	t.Run("Write", func(t *testing.T) {
+		nl, err := ParseNamelist(strings.NewReader(src))
+		require.NoError(t, err)
+		nl.Set("time_control", "run_hours", "48")
+		nl.SetColumn("time_control", "restart", 3, ".true.")
+		nl.Set("physics", "mp_physics", "8")
+		nl.Set("share", "wrf_core", Quote("ARW"))
+
+		var out bytes.Buffer
+		_, err = nl.WriteTo(&out)
+		require.NoError(t, err)
+		assert.Equal(t, `&time_control
+ run_hours = 48,
+ start_year = 2020, 2020, 2020,
+ restart = .false., .false., .true.,
+ auxinput4_inname = "wrflowinp_d<domain>",
+ history_interval = 60, , 3*180,
+/
+
+&domains
+ max_dom = 3,
+/
+
+&physics
+ mp_physics = 8,
+/
+
+&share
+ wrf_core = 'ARW',
+/
+
+`, out.String())
+
+		parsed, err := ParseNamelist(&out)
+		require.NoError(t, err)
+		assert.Equal(t, []string{".false.", ".false.", ".true."}, parsed.Get("time_control", "restart"))
+	})
+
+	t.Run("SyntaxErrors", func(t *testing.T) {
+		for src, msg := range map[string]string{
+			"&share\n max_dom = 1,\n":                "line 1: &share is not closed by `/`",
+			"&diags\n p = 1,\n&physics\n mp = 1,\n/": "line 3: &physics starts before &diags is closed by `/`",
+			"&share\n 3,\n/":                         "line 2: value `3` without key in &share",
+			"&share\n name = 'ARW\n/":                "line 2: unterminated string",
+			"&share\n = 3\n/":                        "line 2: missing key before `=` in &share",
+			"&share\n max-dom = 3\n/":                "line 2: invalid key `max-dom` in &share",
+		} {
+			_, err := ParseNamelist(strings.NewReader(src))
+			var syntax *SyntaxError
+			require.True(t, errors.As(err, &syntax), src)
+			assert.Equal(t, msg, fmt.Sprintf("line %d: %s", syntax.Line, syntax.Msg))
+		}
+	})
+
+	t.Run("Check", func(t *testing.T) {
+		nl, err := ParseNamelist(strings.NewReader(`
+&time_control
+ run_hours = ,
+ run_hour = 3,
+ start_year = 2020, 20.5,
+ restart = yes,
+ restart = .true.,
+/
+&unknown
+/
+`))
+		require.NoError(t, err)
+		assert.Equal(t, []string{
+			"line 3: &time_control: `run_hours` has no value",
+			"line 4: &time_control: unknown key `run_hour`",
+			"line 5: &time_control: `start_year`: 20.5 is not a valid integer value",
+			"line 6: &time_control: `restart`: yes is not a valid logical value",
+			"line 7: &time_control: `restart` is repeated",
+			"line 9: unknown group &unknown",
+		}, WRFSchema.Check(nl))
+	})
+
+	t.Run("CheckNamelists", func(t *testing.T) {
+		dir := t.TempDir()
+		require.NoError(t, os.WriteFile(filepath.Join(dir, "namelist.input"), []byte("&time_control\n run_hours = ,\n/\n"), 0644))
+		require.NoError(t, os.WriteFile(filepath.Join(dir, "namelist.txt"), []byte("not a namelist"), 0644))
+		err := CheckNamelists(dir)
+		assert.EqualError(t, err, filepath.Join(dir, "namelist.input")+": invalid namelist:\n\tline 2: &time_control: `run_hours` has no value")
+	})
+}
+
+// TestTemplatesNamelists checks that the namelists
+// of the templates of the repository are valid.
+func TestTemplatesNamelists(t *testing.T) {
+	vars := map[string]string{
+		"RESTART":       ".false.",
+		"ENSEMBLE_SEED": "42",
+		"GEOG_DATA":     "/geog",
+		"WPS_DIR":       "/wps",
+		"RUN_HOURS":     "48",
+		"ANL_DATE":      "2020-07-01_00:00:00",
+		"WIN_MIN":       "2020-06-30_23:00:00",
+		"WIN_MAX":       "2020-07-01_01:00:00",
+
+		"METGRID_LEVELS":    "34",
+		"METGRID_CONSTANTS": "constants_name = 'TAVGSFC',",
+	}
+	for _, name := range []string{"START", "END"} {
+		vars[name+"_YEAR"] = "2020"
+		vars[name+"_MONTH"] = "07"
+		vars[name+"_DAY"] = "01"
+		vars[name+"_HOUR"] = "00"
+	}
+
+	dirs, err := filepath.Glob(filepath.Join(fixtures, "../../templates/*/*"))
+	require.NoError(t, err)
+	require.NotEmpty(t, dirs)
+	for _, dir := range dirs {
+		dst := t.TempDir()
+		// variables not used by namelists, such as the
+		// paths of the links to the tables, are left empty
+		require.NoError(t, RenderDirEnv(dir, dst, func(key string) string { return vars[key] }))
+		assert.NoError(t, CheckNamelists(dst))
+	}
+}
+
 func TestLinks(t *testing.T) {
 	cleanResult(t)
 	require.NoError(t, os.Setenv("INVAR", "INDIR"))
@@ -133,6 +604,35 @@ func TestApplyPermissionsRODir(t *testing.T) {
 
 }
 
+func TestApplyPermissionsOrder(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, "a", "b"), 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "a", "b", "file"), nil, 0644))
+	t.Cleanup(func() { require.NoError(t, removeDir(dir)) })
+
+	// directories without search permission would prevent
+	// changing their content if applied before it
+	perms := Permissions{
+		filepath.Join(dir, "a"):              fs.ModeDir | 0600,
+		filepath.Join(dir, "a", "b"):         fs.ModeDir | 0500,
+		filepath.Join(dir, "a", "b", "file"): 0400,
+	}
+	require.NoError(t, ApplyPermissions(perms))
+
+	info, err := os.Stat(filepath.Join(dir, "a"))
+	require.NoError(t, err)
+	assert.Equal(t, fs.ModeDir|0600, info.Mode())
+	require.NoError(t, os.Chmod(filepath.Join(dir, "a"), 0700))
+	for path, perm := range perms {
+		if path == filepath.Join(dir, "a") {
+			continue
+		}
+		info, err := os.Stat(path)
+		require.NoError(t, err)
+		assert.Equal(t, perm, info.Mode(), path)
+	}
+}
+
 func TestWODir(t *testing.T) {
 	cleanResult(t)
 
@@ -0,0 +1,180 @@
+package dirprep
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+)
+
+// Manifest records what a render of a template directory
+// produced, and the variables it used, so that the inputs
+// of every run can be audited. It's saved as JSON
+// in the file at ManifestPath(Destination).
+type Manifest struct {
+	// Sources contains the absolute paths of the template
+	// directories rendered, one over the other, in order,
+	// and Destination the absolute path of the directory
+	// they were rendered to.
+	Sources     []string  `json:"sources"`
+	Destination string    `json:"destination"`
+	Rendered    time.Time `json:"rendered"`
+	// Files contains all the files rendered,
+	// excluding directories, in walk order.
+	Files []ManifestFile `json:"files"`
+	// Vars contains the value of all the
+	// variables used by the template.
+	Vars map[string]string `json:"vars"`
+
+	// root is the directory the files are rendered
+	// to, that is the staging directory of the render.
+	root string
+}
+
+// ManifestFile records a file rendered.
+type ManifestFile struct {
+	// Template is the index in Manifest.Sources of the template
+	// directory of the file, and Source is relative to it, while
+	// Destination is relative to Manifest.Destination.
+	Template    int    `json:"template"`
+	Source      string `json:"source"`
+	Destination string `json:"destination"`
+	// Action is the action used to render regular files.
+	Action Action `json:"action,omitempty"`
+	// SHA256 is the hash of the content of the files expanded
+	// or copied, while Link is the target of symbolic links,
+	// or the template file for files linked by the Policy.
+	SHA256 string `json:"sha256,omitempty"`
+	Link   string `json:"link,omitempty"`
+	// Vars contains the names of the variables used
+	// by the path and by the content of the file.
+	Vars []string `json:"vars,omitempty"`
+}
+
+// ManifestPath returns the path of the manifest
+// of a render to dstdir, that is next to it.
+func ManifestPath(dstdir string) string {
+	return filepath.Clean(dstdir) + ".manifest.json"
+}
+
+// newManifest returns an empty manifest for a render
+// of srcdirs to dstdir, through the directory root.
+func newManifest(srcdirs []string, dstdir, root string) (*Manifest, error) {
+	m := &Manifest{
+		Rendered: time.Now(),
+		Files:    []ManifestFile{},
+		Vars:     map[string]string{},
+	}
+	for _, srcdir := range srcdirs {
+		src, err := filepath.Abs(srcdir)
+		if err != nil {
+			return nil, fmt.Errorf("cannot resolve source directory: %w", err)
+		}
+		m.Sources = append(m.Sources, src)
+	}
+	var err error
+	if m.Destination, err = filepath.Abs(dstdir); err != nil {
+		return nil, fmt.Errorf("cannot resolve target directory: %w", err)
+	}
+	if m.root, err = filepath.Abs(root); err != nil {
+		return nil, fmt.Errorf("cannot resolve staging directory: %w", err)
+	}
+	return m, nil
+}
+
+// add records in m the file rendered from src, in the
+// template directory m.Sources[template], to dst with
+// action, that is empty for symbolic links, using the
+// variables vars. A file rendered again by a later
+// template directory replaces the previous record.
+func (m *Manifest) add(template int, src, dst string, d fs.DirEntry, action Action, vars []string) error {
+	if d.IsDir() {
+		return nil
+	}
+	file := ManifestFile{Template: template, Action: action, Vars: vars}
+	var err error
+	if file.Source, err = relPath(m.Sources[template], src); err != nil {
+		return err
+	}
+	if file.Destination, err = relPath(m.root, dst); err != nil {
+		return err
+	}
+	m.Files = slices.DeleteFunc(m.Files, func(f ManifestFile) bool {
+		return f.Destination == file.Destination
+	})
+
+	if action == Hardlink {
+		file.Link, err = filepath.Abs(src)
+		if err != nil {
+			return fmt.Errorf("cannot resolve %s: %w", src, err)
+		}
+	} else if action == Symlink || d.Type()&os.ModeSymlink == os.ModeSymlink {
+		file.Link, err = os.Readlink(dst)
+		if err != nil {
+			return fmt.Errorf("cannot read target symlink %s: %w", dst, err)
+		}
+	} else if file.SHA256, err = fileHash(dst); err != nil {
+		return err
+	}
+	m.Files = append(m.Files, file)
+	return nil
+}
+
+// relPath returns path relative to the absolute directory dir.
+func relPath(dir, path string) (string, error) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return "", fmt.Errorf("cannot resolve %s: %w", path, err)
+	}
+	return filepath.Rel(dir, abs)
+}
+
+// fileHash returns the SHA-256 of
+// the content of the file at path.
+func fileHash(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", fmt.Errorf("cannot open target file %s: %w", path, err)
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", fmt.Errorf("cannot read target file %s: %w", path, err)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// Save writes m to ManifestPath(m.Destination).
+func (m *Manifest) Save() error {
+	content, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return fmt.Errorf("cannot encode manifest: %w", err)
+	}
+	path := ManifestPath(m.Destination)
+	if err := os.WriteFile(path, append(content, '\n'), 0644); err != nil {
+		return fmt.Errorf("cannot write manifest %s: %w", path, err)
+	}
+	return nil
+}
+
+// ReadManifest reads the manifest
+// of a render to dstdir.
+func ReadManifest(dstdir string) (*Manifest, error) {
+	path := ManifestPath(dstdir)
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("ReadManifest: cannot read manifest %s: %w", path, err)
+	}
+	var m Manifest
+	if err := json.Unmarshal(content, &m); err != nil {
+		return nil, fmt.Errorf("ReadManifest: cannot decode manifest %s: %w", path, err)
+	}
+	return &m, nil
+}
@@ -0,0 +1,340 @@
+package dirprep
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// Namelist is a Fortran namelist file, such
+// as `namelist.input` or `namelist.wps`.
+// Names of groups and keys are lower case,
+// since Fortran names are case insensitive.
+type Namelist struct {
+	Groups []*Group
+}
+
+// Group is a group of a namelist,
+// such as `&time_control`.
+type Group struct {
+	Name    string
+	Entries []*Entry
+	// Line is the line of the namelist
+	// file where the group starts.
+	Line int
+}
+
+// Entry is an assignment of values to a key of a group.
+// Values contains the literal text of every value,
+// with quotes for strings, or an empty string
+// for null values, as in `key = 1, , 3`.
+type Entry struct {
+	Key    string
+	Values []string
+	// Line is the line of the namelist
+	// file where the entry starts.
+	Line int
+}
+
+// Group returns the group name of
+// nl, or nil when there is not.
+func (nl *Namelist) Group(name string) *Group {
+	name = strings.ToLower(name)
+	for _, g := range nl.Groups {
+		if g.Name == name {
+			return g
+		}
+	}
+	return nil
+}
+
+// Entry returns the last entry of g for
+// key, or nil when there is not.
+func (g *Group) Entry(key string) *Entry {
+	key = strings.ToLower(key)
+	for n := len(g.Entries) - 1; n >= 0; n-- {
+		if g.Entries[n].Key == key {
+			return g.Entries[n]
+		}
+	}
+	return nil
+}
+
+// Get returns the values of key in group, or
+// nil when the group or the key are missing.
+func (nl *Namelist) Get(group, key string) []string {
+	g := nl.Group(group)
+	if g == nil {
+		return nil
+	}
+	e := g.Entry(key)
+	if e == nil {
+		return nil
+	}
+	return e.Values
+}
+
+// Set sets the values of key in group, adding
+// the group or the key when they are missing.
+// Values are written as they are: strings
+// must be quoted, e.g. with Quote.
+func (nl *Namelist) Set(group, key string, values ...string) {
+	nl.entry(group, key).Values = values
+}
+
+// SetColumn sets the value of key in group for
+// domain number domain, starting from 1. When the
+// key has less values, the last one is repeated for
+// the domains in between, or value when there's none.
+func (nl *Namelist) SetColumn(group, key string, domain int, value string) {
+	e := nl.entry(group, key)
+	for len(e.Values) < domain {
+		if len(e.Values) == 0 {
+			e.Values = append(e.Values, value)
+		} else {
+			e.Values = append(e.Values, e.Values[len(e.Values)-1])
+		}
+	}
+	e.Values[domain-1] = value
+}
+
+// entry returns the entry of key in group,
+// adding the group or the key when missing.
+func (nl *Namelist) entry(group, key string) *Entry {
+	g := nl.Group(group)
+	if g == nil {
+		g = &Group{Name: strings.ToLower(group)}
+		nl.Groups = append(nl.Groups, g)
+	}
+	e := g.Entry(key)
+	if e == nil {
+		e = &Entry{Key: strings.ToLower(key)}
+		g.Entries = append(g.Entries, e)
+	}
+	return e
+}
+
+// Quote returns s as a Fortran string value.
+func Quote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", "''") + "'"
+}
+
+// WriteTo writes nl to w, one group after the other,
+// with every entry on a line of its own. Comments
+// and text outside of the groups are not written.
+func (nl *Namelist) WriteTo(w io.Writer) (int64, error) {
+	var written int64
+	bw := bufio.NewWriter(w)
+	for _, g := range nl.Groups {
+		n, _ := fmt.Fprintf(bw, "&%s\n", g.Name)
+		written += int64(n)
+		for _, e := range g.Entries {
+			n, _ = fmt.Fprintf(bw, " %s = %s,\n", e.Key, strings.Join(e.Values, ", "))
+			written += int64(n)
+		}
+		n, _ = fmt.Fprintf(bw, "/\n\n")
+		written += int64(n)
+	}
+	if err := bw.Flush(); err != nil {
+		return written, fmt.Errorf("Namelist.WriteTo: cannot write namelist: %w", err)
+	}
+	return written, nil
+}
+
+// keyRe matches the keys of the entries,
+// optionally followed by an array subscript.
+var keyRe = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9_%]*(\([0-9:]*\))?$`)
+
+// ParseNamelist reads a namelist from r. Text outside
+// of the groups is ignored, as Fortran does, while
+// comments start with `!`. Groups start with `&name`
+// and end with `/` or `&end`.
+func ParseNamelist(r io.Reader) (*Namelist, error) {
+	src, err := io.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("ParseNamelist: cannot read namelist: %w", err)
+	}
+	p := &nlParser{src: src, line: 1}
+	nl := &Namelist{}
+	for {
+		p.skipSpace()
+		if p.eof() {
+			return nl, nil
+		}
+		if c := p.peek(); c != '&' && c != '$' {
+			p.skipLine()
+			continue
+		}
+		p.pos++
+		line := p.line
+		name := strings.ToLower(p.token())
+		if name == "" || name == "end" {
+			return nil, p.errorf("expected group name after `&`")
+		}
+		g := &Group{Name: name, Line: line}
+		if err := p.parseGroup(g); err != nil {
+			return nil, err
+		}
+		nl.Groups = append(nl.Groups, g)
+	}
+}
+
+// ReadNamelist reads the namelist in the file at path.
+func ReadNamelist(path string) (*Namelist, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("ReadNamelist: cannot open namelist: %w", err)
+	}
+	defer f.Close()
+	nl, err := ParseNamelist(f)
+	if err != nil {
+		locate(err, path, 0)
+		return nil, err
+	}
+	return nl, nil
+}
+
+// nlParser reads a namelist from src.
+type nlParser struct {
+	src  []byte
+	pos  int
+	line int
+}
+
+func (p *nlParser) eof() bool {
+	return p.pos >= len(p.src)
+}
+
+func (p *nlParser) peek() byte {
+	return p.src[p.pos]
+}
+
+func (p *nlParser) errorf(format string, args ...any) error {
+	return &SyntaxError{Pos: Pos{Line: p.line}, Msg: fmt.Sprintf(format, args...)}
+}
+
+// skipSpace skips spaces, new lines and comments.
+func (p *nlParser) skipSpace() {
+	for !p.eof() {
+		switch p.peek() {
+		case '\n':
+			p.line++
+		case ' ', '\t', '\r':
+		case '!':
+			p.skipLine()
+			continue
+		default:
+			return
+		}
+		p.pos++
+	}
+}
+
+// skipLine skips the rest of the line,
+// excluding the new line character.
+func (p *nlParser) skipLine() {
+	for !p.eof() && p.peek() != '\n' {
+		p.pos++
+	}
+}
+
+// token reads a name or an unquoted value.
+func (p *nlParser) token() string {
+	start := p.pos
+	for !p.eof() && !strings.ContainsRune(" \t\r\n,/=!'\"&$", rune(p.peek())) {
+		p.pos++
+	}
+	return string(p.src[start:p.pos])
+}
+
+// quoted reads a quoted string, with the quotes. Quotes
+// inside the string are escaped by doubling them.
+func (p *nlParser) quoted() (string, error) {
+	start, line := p.pos, p.line
+	quote := p.peek()
+	p.pos++
+	for !p.eof() {
+		c := p.peek()
+		p.pos++
+		switch {
+		case c == '\n':
+			p.line++
+		case c == quote && !p.eof() && p.peek() == quote:
+			p.pos++
+		case c == quote:
+			return string(p.src[start:p.pos]), nil
+		}
+	}
+	return "", &SyntaxError{Pos: Pos{Line: line}, Msg: "unterminated string"}
+}
+
+// parseGroup reads the entries of g, up to the end of the group.
+func (p *nlParser) parseGroup(g *Group) error {
+	var entry *Entry
+	// afterSeparator is true after `=` or `,`, when
+	// another `,` means a null value.
+	afterSeparator := false
+	for {
+		p.skipSpace()
+		if p.eof() {
+			return &SyntaxError{Pos: Pos{Line: g.Line}, Msg: fmt.Sprintf("&%s is not closed by `/`", g.Name)}
+		}
+		switch c := p.peek(); c {
+		case '/':
+			p.pos++
+			return nil
+		case '&', '$':
+			p.pos++
+			if name := p.token(); strings.ToLower(name) != "end" {
+				return p.errorf("%c%s starts before &%s is closed by `/`", c, name, g.Name)
+			}
+			return nil
+		case ',':
+			p.pos++
+			if entry == nil {
+				return p.errorf("unexpected `,` in &%s", g.Name)
+			}
+			if afterSeparator {
+				entry.Values = append(entry.Values, "")
+			}
+			afterSeparator = true
+		case '=':
+			return p.errorf("missing key before `=` in &%s", g.Name)
+		case '\'', '"':
+			value, err := p.quoted()
+			if err != nil {
+				return err
+			}
+			if entry == nil {
+				return p.errorf("value %s without key in &%s", value, g.Name)
+			}
+			entry.Values = append(entry.Values, value)
+			afterSeparator = false
+		default:
+			line := p.line
+			tok := p.token()
+			if tok == "" {
+				return p.errorf("unexpected `%c` in &%s", c, g.Name)
+			}
+			p.skipSpace()
+			if !p.eof() && p.peek() == '=' {
+				p.pos++
+				if !keyRe.MatchString(tok) {
+					return &SyntaxError{Pos: Pos{Line: line}, Msg: fmt.Sprintf("invalid key `%s` in &%s", tok, g.Name)}
+				}
+				entry = &Entry{Key: strings.ToLower(tok), Line: line}
+				g.Entries = append(g.Entries, entry)
+				afterSeparator = true
+				continue
+			}
+			if entry == nil {
+				return &SyntaxError{Pos: Pos{Line: line}, Msg: fmt.Sprintf("value `%s` without key in &%s", tok, g.Name)}
+			}
+			entry.Values = append(entry.Values, tok)
+			afterSeparator = false
+		}
+	}
+}
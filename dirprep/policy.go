@@ -0,0 +1,224 @@
+package dirprep
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/gobwas/glob"
+)
+
+// Action tells how a regular file of
+// a template directory is rendered.
+type Action string
+
+const (
+	// Expand copies the file expanding its
+	// variables and running its directives.
+	Expand Action = "expand"
+	// Copy copies the file unchanged.
+	Copy Action = "copy"
+	// Hardlink links the rendered file to the template file,
+	// or copies it when they are on different file systems.
+	Hardlink Action = "hardlink"
+	// Symlink creates a symbolic link
+	// to the template file.
+	Symlink Action = "symlink"
+)
+
+// PolicyFile is the name of the file, in the root
+// of a template directory, containing its Policy.
+// The file itself is not rendered.
+const PolicyFile = ".dirprep-policy"
+
+// PolicyRule applies Action to the files matching Pattern.
+type PolicyRule struct {
+	Pattern string
+	Action  Action
+	glob    glob.Glob
+}
+
+// Policy tells how the regular files of a template directory
+// are rendered: the first rule matching a file decides its
+// Action. Files that match no rule are copied when they are
+// binary, and expanded otherwise.
+type Policy []PolicyRule
+
+// ParsePolicy reads a policy from r. Every line contains a
+// glob and an action, separated by spaces, e.g. `*.bin symlink`.
+// Globs containing a `/` are matched against the path of the
+// file relative to the template directory, the others against
+// its name. Empty lines and comments starting with `#` are ignored.
+func ParsePolicy(r io.Reader) (Policy, error) {
+	var policy Policy
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text, _, _ := strings.Cut(scanner.Text(), "#")
+		fields := strings.Fields(text)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) != 2 {
+			return nil, &SyntaxError{Pos: Pos{Line: line}, Msg: fmt.Sprintf("expected `<glob> <action>`, found `%s`", strings.TrimSpace(text))}
+		}
+		rule := PolicyRule{Pattern: fields[0], Action: Action(fields[1])}
+		switch rule.Action {
+		case Expand, Copy, Hardlink, Symlink:
+		default:
+			return nil, &SyntaxError{Pos: Pos{Line: line}, Msg: fmt.Sprintf("unknown action `%s`, must be one of expand, copy, hardlink or symlink", rule.Action)}
+		}
+		var err error
+		if rule.glob, err = glob.Compile(rule.Pattern, '/'); err != nil {
+			return nil, &SyntaxError{Pos: Pos{Line: line}, Msg: fmt.Sprintf("invalid glob `%s`: %s", rule.Pattern, err)}
+		}
+		policy = append(policy, rule)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("ParsePolicy: cannot read policy: %w", err)
+	}
+	return policy, nil
+}
+
+// ReadPolicy reads the policy of the template directory
+// srcdir, that is empty when srcdir has no PolicyFile.
+func ReadPolicy(srcdir string) (Policy, error) {
+	path := filepath.Join(srcdir, PolicyFile)
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("ReadPolicy: cannot open policy: %w", err)
+	}
+	defer f.Close()
+	policy, err := ParsePolicy(f)
+	if err != nil {
+		locate(err, path, 0)
+		return nil, err
+	}
+	return policy, nil
+}
+
+// Action returns the action of the first rule matching the file at
+// path rel, relative to the template directory, and whether any
+// rule matched.
+func (p Policy) Action(rel string) (Action, bool) {
+	rel = filepath.ToSlash(rel)
+	for _, rule := range p {
+		name := rel
+		if !strings.Contains(rule.Pattern, "/") {
+			name = filepath.Base(rel)
+		}
+		if rule.glob.Match(name) {
+			return rule.Action, true
+		}
+	}
+	return "", false
+}
+
+// fileAction returns the action used to render
+// src, at path rel in the template directory.
+func (p Policy) fileAction(src, rel string) (Action, error) {
+	if action, ok := p.Action(rel); ok {
+		return action, nil
+	}
+	binary, err := IsBinary(src)
+	if err != nil {
+		return "", err
+	}
+	if binary {
+		return Copy, nil
+	}
+	return Expand, nil
+}
+
+// binarySniffLen is the number of bytes read
+// by IsBinary at the start of the file.
+const binarySniffLen = 8000
+
+// IsBinary returns whether the file at path is binary,
+// that is when a NUL byte is found at its start.
+func IsBinary(path string) (bool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return false, fmt.Errorf("IsBinary: cannot open file %s: %w", path, err)
+	}
+	defer f.Close()
+
+	buf := make([]byte, binarySniffLen)
+	n, err := io.ReadFull(f, buf)
+	if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+		return false, fmt.Errorf("IsBinary: cannot read file %s: %w", path, err)
+	}
+	return bytes.IndexByte(buf[:n], 0) != -1, nil
+}
+
+// renderFile renders the regular file src to dst with action,
+// and returns the action actually used, that is Copy when
+// a Hardlink cannot be created. An existing file at dst is
+// removed first, so that a link created by a previous
+// template directory is replaced, and the file it
+// links to is not written.
+func renderFile(action Action, src, dst string, lookup Lookup) (Action, error) {
+	if err := removeTarget(dst); err != nil {
+		return "", err
+	}
+	switch action {
+	case Copy:
+		return Copy, copyFile(src, dst)
+	case Hardlink:
+		if err := os.Link(src, dst); err != nil {
+			// e.g. src and dst are on different file systems
+			return Copy, copyFile(src, dst)
+		}
+		return Hardlink, nil
+	case Symlink:
+		target, err := filepath.Abs(src)
+		if err != nil {
+			return "", fmt.Errorf("cannot resolve source file %s: %w", src, err)
+		}
+		if err := os.Symlink(target, dst); err != nil {
+			return "", fmt.Errorf("cannot create target symlink %s: %w", dst, err)
+		}
+		return Symlink, nil
+	}
+	return Expand, expandFile(src, dst, lookup)
+}
+
+// removeTarget removes the file at dst, if it exists,
+// so that a new file can be created in its place.
+func removeTarget(dst string) error {
+	if err := os.Remove(dst); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("cannot delete existing file %s: %w", dst, err)
+	}
+	return nil
+}
+
+// copyFile copies the content of src to dst.
+func copyFile(src, dst string) (err error) {
+	r, err := os.Open(src)
+	if err != nil {
+		return fmt.Errorf("cannot open source file %s: %w", src, err)
+	}
+	defer func() {
+		err = errors.Join(err, r.Close())
+	}()
+
+	w, err := os.OpenFile(dst, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0777)
+	if err != nil {
+		return fmt.Errorf("cannot create target file %s: %w", dst, err)
+	}
+	defer func() {
+		err = errors.Join(err, w.Close())
+	}()
+
+	if _, err := io.Copy(w, r); err != nil {
+		return fmt.Errorf("cannot copy %s to %s: %w", src, dst, err)
+	}
+	return nil
+}
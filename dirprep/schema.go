@@ -0,0 +1,188 @@
+package dirprep
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// Kind is the type of the values of a namelist key.
+type Kind int
+
+const (
+	// Any accepts every value.
+	Any Kind = iota
+	Integer
+	// Real accepts integers too.
+	Real
+	// Logical accepts `.true.`, `.false.`,
+	// `true`, `false`, `t` and `f`, in any case.
+	Logical
+	// String accepts quoted strings.
+	String
+)
+
+func (k Kind) String() string {
+	switch k {
+	case Integer:
+		return "integer"
+	case Real:
+		return "real"
+	case Logical:
+		return "logical"
+	case String:
+		return "string"
+	}
+	return "any"
+}
+
+var (
+	integerRe = regexp.MustCompile(`^[+-]?[0-9]+$`)
+	realRe    = regexp.MustCompile(`^[+-]?([0-9]+\.?[0-9]*|\.[0-9]+)([eEdD][+-]?[0-9]+)?$`)
+	logicalRe = regexp.MustCompile(`^(?i)(\.true\.|\.false\.|true|false|\.?t\.?|\.?f\.?)$`)
+	repeatRe  = regexp.MustCompile(`^[0-9]+\*`)
+)
+
+// accepts returns whether value, the literal
+// text of a namelist value, is of kind k.
+func (k Kind) accepts(value string) bool {
+	switch k {
+	case Integer:
+		return integerRe.MatchString(value)
+	case Real:
+		return realRe.MatchString(value)
+	case Logical:
+		return logicalRe.MatchString(value)
+	case String:
+		return len(value) >= 2 && (value[0] == '\'' || value[0] == '"') && value[len(value)-1] == value[0]
+	}
+	return true
+}
+
+// Schema contains the kind of the values of every key
+// allowed in a namelist, indexed by group and key.
+type Schema map[string]map[string]Kind
+
+// Check returns a description of every problem found in nl:
+// groups or keys not in the schema, keys repeated in the same
+// group, keys without values and values of the wrong kind.
+func (s Schema) Check(nl *Namelist) []string {
+	var problems []string
+	problemf := func(line int, format string, args ...any) {
+		problems = append(problems, fmt.Sprintf("line %d: ", line)+fmt.Sprintf(format, args...))
+	}
+
+	for _, g := range nl.Groups {
+		keys, ok := s[g.Name]
+		if !ok {
+			problemf(g.Line, "unknown group &%s", g.Name)
+			continue
+		}
+		seen := map[string]bool{}
+		for _, e := range g.Entries {
+			// array subscripts are checked as the whole key
+			key, _, _ := strings.Cut(e.Key, "(")
+			kind, ok := keys[key]
+			if !ok {
+				problemf(e.Line, "&%s: unknown key `%s`", g.Name, e.Key)
+				continue
+			}
+			if seen[e.Key] {
+				problemf(e.Line, "&%s: `%s` is repeated", g.Name, e.Key)
+			}
+			seen[e.Key] = true
+
+			null := true
+			for _, value := range e.Values {
+				value = repeatRe.ReplaceAllString(value, "")
+				if value == "" {
+					continue
+				}
+				null = false
+				if !kind.accepts(value) {
+					problemf(e.Line, "&%s: `%s`: %s is not a valid %s value", g.Name, e.Key, value, kind)
+				}
+			}
+			if null {
+				problemf(e.Line, "&%s: `%s` has no value", g.Name, e.Key)
+			}
+		}
+	}
+	return problems
+}
+
+// NamelistError is the error returned by CheckNamelist
+// when a namelist does not comply with its schema.
+type NamelistError struct {
+	File     string
+	Problems []string
+}
+
+func (e *NamelistError) Error() string {
+	return fmt.Sprintf("%s: invalid namelist:\n\t%s", e.File, strings.Join(e.Problems, "\n\t"))
+}
+
+// SchemaFor returns the schema of the namelist nl, read
+// from the file with base name name, or nil if it's not
+// a namelist of WPS, WRF or WRFDA.
+func SchemaFor(name string, nl *Namelist) Schema {
+	switch name {
+	case "namelist.wps":
+		return WPSSchema
+	case "namelist.input":
+		if nl.Group("wrfvar1") != nil {
+			return WRFDASchema
+		}
+		return WRFSchema
+	}
+	return nil
+}
+
+// CheckNamelist reads the namelist in the file at path,
+// and checks it against the schema returned by SchemaFor.
+// Files that are not namelists are not read.
+func CheckNamelist(path string) error {
+	if !IsNamelist(path) {
+		return nil
+	}
+	nl, err := ReadNamelist(path)
+	if err != nil {
+		return err
+	}
+	schema := SchemaFor(filepath.Base(path), nl)
+	if problems := schema.Check(nl); len(problems) > 0 {
+		return &NamelistError{File: path, Problems: problems}
+	}
+	return nil
+}
+
+// IsNamelist returns whether the file at path
+// is a namelist of WPS, WRF or WRFDA.
+func IsNamelist(path string) bool {
+	name := filepath.Base(path)
+	return name == "namelist.wps" || name == "namelist.input"
+}
+
+// CheckNamelists checks, with CheckNamelist, all the
+// namelists in dir and in its subdirectories, returning
+// the errors of all the invalid ones. Symbolic links
+// are not followed.
+func CheckNamelists(dir string) error {
+	var errs []error
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.Type().IsRegular() {
+			errs = append(errs, CheckNamelist(path))
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("CheckNamelists: cannot walk `%s` directory: %w", dir, err)
+	}
+	return errors.Join(errs...)
+}
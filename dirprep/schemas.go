@@ -0,0 +1,340 @@
+package dirprep
+
+// The schemas contain the groups and keys used by the templates
+// of this repository. Keys used by new templates must be added
+// here, otherwise the namelists rendered from them are rejected.
+
+// WPSSchema is the schema of `namelist.wps`, the
+// namelist of geogrid.exe, ungrib.exe and metgrid.exe.
+var WPSSchema = Schema{
+	"geogrid": {
+		"dx":                   Real,
+		"dy":                   Real,
+		"e_sn":                 Integer,
+		"e_we":                 Integer,
+		"geog_data_path":       String,
+		"geog_data_res":        String,
+		"i_parent_start":       Integer,
+		"j_parent_start":       Integer,
+		"map_proj":             String,
+		"opt_geogrid_tbl_path": String,
+		"parent_grid_ratio":    Integer,
+		"parent_id":            Integer,
+		"ref_lat":              Real,
+		"ref_lon":              Real,
+		"ref_x":                Real,
+		"ref_y":                Real,
+		"stand_lon":            Real,
+		"truelat1":             Real,
+		"truelat2":             Real,
+	},
+	"metgrid": {
+		"constants_name":               String,
+		"fg_name":                      String,
+		"io_form_metgrid":              Integer,
+		"opt_metgrid_tbl_path":         String,
+		"opt_output_from_metgrid_path": String,
+	},
+	"mod_levs": {
+		"press_pa": Real,
+	},
+	"share": {
+		"debug_level":                  Integer,
+		"end_date":                     String,
+		"interval_seconds":             Integer,
+		"io_form_geogrid":              Integer,
+		"max_dom":                      Integer,
+		"opt_output_from_geogrid_path": String,
+		"start_date":                   String,
+		"wrf_core":                     String,
+	},
+	"ungrib": {
+		"out_format": String,
+		"prefix":     String,
+	},
+}
+
+// WRFSchema is the schema of `namelist.input`,
+// the namelist of real.exe and wrf.exe.
+var WRFSchema = Schema{
+	"bdy_control": {
+		"nested":         Logical,
+		"relax_zone":     Integer,
+		"spec_bdy_width": Integer,
+		"spec_zone":      Integer,
+		"specified":      Logical,
+	},
+	"diags": {
+		"num_press_levels": Integer,
+		"p_lev_diags":      Integer,
+		"press_levels":     Real,
+	},
+	"domains": {
+		"adaptation_domain":       Integer,
+		"dx":                      Real,
+		"dy":                      Real,
+		"e_sn":                    Integer,
+		"e_vert":                  Integer,
+		"e_we":                    Integer,
+		"feedback":                Integer,
+		"grid_id":                 Integer,
+		"i_parent_start":          Integer,
+		"j_parent_start":          Integer,
+		"max_dom":                 Integer,
+		"max_step_increase_pct":   Integer,
+		"max_time_step":           Integer,
+		"min_time_step":           Integer,
+		"num_metgrid_levels":      Integer,
+		"num_metgrid_soil_levels": Integer,
+		"p_top_requested":         Real,
+		"parent_grid_ratio":       Integer,
+		"parent_id":               Integer,
+		"parent_time_step_ratio":  Integer,
+		"smooth_option":           Integer,
+		"starting_time_step":      Integer,
+		"step_to_output_time":     Logical,
+		"target_cfl":              Real,
+		"target_hcfl":             Real,
+		"time_step":               Integer,
+		"time_step_fract_den":     Integer,
+		"time_step_fract_num":     Integer,
+		"use_adaptive_time_step":  Logical,
+	},
+	"dynamics": {
+		"base_temp":       Real,
+		"damp_opt":        Integer,
+		"dampcoef":        Real,
+		"diff_6th_factor": Real,
+		"diff_6th_opt":    Integer,
+		"diff_opt":        Integer,
+		"khdif":           Real,
+		"km_opt":          Integer,
+		"kvdif":           Real,
+		"moist_adv_opt":   Integer,
+		"non_hydrostatic": Logical,
+		"scalar_adv_opt":  Integer,
+		"w_damping":       Integer,
+		"zdamp":           Real,
+	},
+	"fdda":  {},
+	"grib2": {},
+	"namelist_quilt": {
+		"nio_groups":          Integer,
+		"nio_tasks_per_group": Integer,
+	},
+	"physics": {
+		"bl_pbl_physics":          Integer,
+		"bldt":                    Real,
+		"cellcount_method":        Integer,
+		"cldtop_adjustment":       Real,
+		"cu_physics":              Integer,
+		"cudt":                    Real,
+		"do_radar_ref":            Integer,
+		"ensdim":                  Integer,
+		"flashrate_factor":        Real,
+		"hailcast_opt":            Integer,
+		"iccg_method":             Integer,
+		"icloud":                  Integer,
+		"ifsnow":                  Integer,
+		"isfflx":                  Integer,
+		"lightning_dt":            Real,
+		"lightning_option":        Integer,
+		"lightning_start_seconds": Real,
+		"maxens":                  Integer,
+		"maxens2":                 Integer,
+		"maxens3":                 Integer,
+		"maxiens":                 Integer,
+		"mp_physics":              Integer,
+		"num_land_cat":            Integer,
+		"num_soil_layers":         Integer,
+		"prec_acc_dt":             Real,
+		"ra_lw_physics":           Integer,
+		"ra_sw_physics":           Integer,
+		"radt":                    Real,
+		"sf_sfclay_physics":       Integer,
+		"sf_surface_physics":      Integer,
+		"sf_urban_physics":        Integer,
+		"sst_update":              Integer,
+		"surface_input_source":    Integer,
+		"topo_wind":               Integer,
+		"windfarm_ij":             Integer,
+		"windfarm_opt":            Integer,
+	},
+	"stoch": {
+		"gridpt_stddev_sppt": Real,
+		"iseed_sppt":         Integer,
+		"lengthscale_sppt":   Real,
+		"nens":               Integer,
+		"sppt":               Integer,
+		"stddev_cutoff_sppt": Real,
+		"timescale_sppt":     Real,
+	},
+	"time_control": {
+		"adjust_output_times":     Logical,
+		"auxhist23_interval":      Integer,
+		"auxinput4_inname":        String,
+		"auxinput4_interval":      Integer,
+		"debug_level":             Integer,
+		"end_day":                 Integer,
+		"end_hour":                Integer,
+		"end_minute":              Integer,
+		"end_month":               Integer,
+		"end_second":              Integer,
+		"end_year":                Integer,
+		"frames_per_auxhist23":    Integer,
+		"frames_per_outfile":      Integer,
+		"history_interval":        Integer,
+		"ignore_iofields_warning": Logical,
+		"input_from_file":         Logical,
+		"input_outname":           String,
+		"inputout_begin_h":        Integer,
+		"inputout_end_h":          Integer,
+		"inputout_end_m":          Integer,
+		"inputout_interval":       Integer,
+		"interval_seconds":        Integer,
+		"io_form_auxhist23":       Integer,
+		"io_form_auxinput4":       Integer,
+		"io_form_boundary":        Integer,
+		"io_form_history":         Integer,
+		"io_form_input":           Integer,
+		"io_form_restart":         Integer,
+		"iofields_filename":       String,
+		"nwp_diagnostics":         Integer,
+		"restart":                 Logical,
+		"restart_interval":        Integer,
+		"run_days":                Integer,
+		"run_hours":               Integer,
+		"run_minutes":             Integer,
+		"run_seconds":             Integer,
+		"start_day":               Integer,
+		"start_hour":              Integer,
+		"start_minute":            Integer,
+		"start_month":             Integer,
+		"start_second":            Integer,
+		"start_year":              Integer,
+		"write_input":             Logical,
+	},
+}
+
+// WRFDASchema is the schema of `namelist.input`
+// when used by da_wrfvar.exe.
+var WRFDASchema = Schema{
+	"bdy_control": {},
+	"domains": {
+		"dx":     Real,
+		"dy":     Real,
+		"e_sn":   Integer,
+		"e_vert": Integer,
+		"e_we":   Integer,
+	},
+	"dynamics": {},
+	"fdda":     {},
+	"grib2":    {},
+	"namelist_quilt": {
+		"nio_groups":          Integer,
+		"nio_tasks_per_group": Integer,
+	},
+	"physics": {
+		"bl_pbl_physics":          Integer,
+		"bldt":                    Real,
+		"cellcount_method":        Integer,
+		"cldtop_adjustment":       Real,
+		"cu_physics":              Integer,
+		"cudt":                    Real,
+		"do_radar_ref":            Integer,
+		"ensdim":                  Integer,
+		"flashrate_factor":        Real,
+		"iccg_method":             Integer,
+		"icloud":                  Integer,
+		"ifsnow":                  Integer,
+		"isfflx":                  Integer,
+		"lightning_dt":            Real,
+		"lightning_option":        Integer,
+		"lightning_start_seconds": Real,
+		"maxens":                  Integer,
+		"maxens2":                 Integer,
+		"maxens3":                 Integer,
+		"maxiens":                 Integer,
+		"mp_physics":              Integer,
+		"num_land_cat":            Integer,
+		"num_soil_layers":         Integer,
+		"ra_lw_physics":           Integer,
+		"ra_sw_physics":           Integer,
+		"radt":                    Real,
+		"sf_sfclay_physics":       Integer,
+		"sf_surface_physics":      Integer,
+		"sf_urban_physics":        Integer,
+		"sst_update":              Integer,
+		"surface_input_source":    Integer,
+	},
+	"time_control": {
+		"end_day":      Integer,
+		"end_hour":     Integer,
+		"end_minute":   Integer,
+		"end_month":    Integer,
+		"end_second":   Integer,
+		"end_year":     Integer,
+		"run_days":     Integer,
+		"run_hours":    Integer,
+		"run_minutes":  Integer,
+		"run_seconds":  Integer,
+		"start_day":    Integer,
+		"start_hour":   Integer,
+		"start_minute": Integer,
+		"start_month":  Integer,
+		"start_second": Integer,
+		"start_year":   Integer,
+	},
+	"wrfvar1": {
+		"print_detail_grad": Logical,
+		"var4d":             Logical,
+	},
+	"wrfvar10": {
+		"test_gradient":   Logical,
+		"test_transforms": Logical,
+	},
+	"wrfvar11": {},
+	"wrfvar12": {},
+	"wrfvar13": {},
+	"wrfvar14": {},
+	"wrfvar15": {},
+	"wrfvar16": {},
+	"wrfvar17": {},
+	"wrfvar18": {
+		"analysis_date": String,
+	},
+	"wrfvar19": {},
+	"wrfvar2": {
+		"calc_w_increment": Logical,
+	},
+	"wrfvar20": {},
+	"wrfvar21": {
+		"time_window_min": String,
+	},
+	"wrfvar22": {
+		"time_window_max": String,
+	},
+	"wrfvar3": {
+		"ob_format": Integer,
+	},
+	"wrfvar4": {
+		"use_radar_rf":  Logical,
+		"use_radar_rhv": Logical,
+		"use_radar_rqv": Logical,
+		"use_radar_rv":  Logical,
+		"use_radarobs":  Logical,
+		"use_synopobs":  Logical,
+	},
+	"wrfvar5": {},
+	"wrfvar6": {
+		"eps":         Real,
+		"max_ext_its": Integer,
+		"ntmax":       Integer,
+	},
+	"wrfvar7": {
+		"cloud_cv_options": Integer,
+		"cv_options":       Integer,
+	},
+	"wrfvar8": {},
+	"wrfvar9": {},
+}
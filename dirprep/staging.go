@@ -0,0 +1,86 @@
+package dirprep
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// newStaging creates an empty staging directory for a
+// render to dstdir. The staging directory is next to
+// dstdir, so that it can be renamed to it.
+func newStaging(dstdir string) (string, error) {
+	parent, name := filepath.Split(filepath.Clean(dstdir))
+	if parent == "" {
+		parent = "."
+	}
+	if err := os.MkdirAll(parent, 0777); err != nil {
+		return "", fmt.Errorf("cannot create parent of target directory %s: %w", dstdir, err)
+	}
+	staging, err := os.MkdirTemp(parent, "."+name+".staging-")
+	if err != nil {
+		return "", fmt.Errorf("cannot create staging directory for %s: %w", dstdir, err)
+	}
+	return staging, nil
+}
+
+// replaceDir renames the directory staging to dstdir.
+// When dstdir exists, it's first moved out of the way,
+// and removed after the rename. If the rename fails,
+// dstdir is moved back.
+func replaceDir(staging, dstdir string) error {
+	_, err := os.Lstat(dstdir)
+	if errors.Is(err, os.ErrNotExist) {
+		if err := os.Rename(staging, dstdir); err != nil {
+			return fmt.Errorf("cannot rename staging directory to %s: %w", dstdir, err)
+		}
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("cannot stat target directory %s: %w", dstdir, err)
+	}
+
+	// dstdir is moved in the new directory old,
+	// that is then removed with it
+	parent, name := filepath.Split(filepath.Clean(dstdir))
+	if parent == "" {
+		parent = "."
+	}
+	old, err := os.MkdirTemp(parent, "."+name+".old-")
+	if err != nil {
+		return fmt.Errorf("cannot create directory for previous content of %s: %w", dstdir, err)
+	}
+	if err := os.Rename(dstdir, filepath.Join(old, name)); err != nil {
+		return errors.Join(
+			fmt.Errorf("cannot move previous content of %s: %w", dstdir, err),
+			os.Remove(old),
+		)
+	}
+	if err := os.Rename(staging, dstdir); err != nil {
+		return errors.Join(
+			fmt.Errorf("cannot rename staging directory to %s: %w", dstdir, err),
+			os.Rename(filepath.Join(old, name), dstdir),
+			os.Remove(old),
+		)
+	}
+	if err := removeDir(old); err != nil {
+		return fmt.Errorf("cannot remove previous content of %s: %w", dstdir, err)
+	}
+	return nil
+}
+
+// removeDir removes dir and all its content, making
+// its directories writable first, so that read-only
+// directories are removed too.
+func removeDir(dir string) error {
+	// errors are reported by os.RemoveAll
+	_ = filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err == nil && d.IsDir() {
+			_ = os.Chmod(path, 0700)
+		}
+		return nil
+	})
+	return os.RemoveAll(dir)
+}
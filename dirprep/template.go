@@ -0,0 +1,291 @@
+package dirprep
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Lookup returns the value of the variable
+// key, and whether it is defined.
+type Lookup func(key string) (value string, ok bool)
+
+// mappingLookup returns a Lookup that reads the variables
+// from mapping, and considers all of them defined.
+func mappingLookup(mapping func(key string) string) Lookup {
+	return func(key string) (string, bool) {
+		return mapping(key), true
+	}
+}
+
+// maxIncludeDepth is the maximum number of nested
+// includes, so that a file including itself fails
+// instead of rendering forever.
+const maxIncludeDepth = 16
+
+// Pos is the position in a template of an error.
+// Line is 0 for errors in the path of a file.
+type Pos struct {
+	File string
+	Line int
+}
+
+func (p Pos) String() string {
+	switch {
+	case p.Line == 0:
+		return p.File
+	case p.File == "":
+		return fmt.Sprintf("line %d", p.Line)
+	}
+	return fmt.Sprintf("%s:%d", p.File, p.Line)
+}
+
+// locate sets the position of the error, unless it's already set
+// by a nested include, that is closer to the cause of the error.
+// The line is kept when it's already known, so that parsers can
+// set it without knowing the file they are reading.
+func (p *Pos) locate(file string, line int) {
+	if p.File == "" {
+		p.File = file
+		if p.Line == 0 {
+			p.Line = line
+		}
+	}
+}
+
+// locate sets the position of err, when
+// err is an error of the template language.
+func locate(err error, file string, line int) {
+	var located interface{ locate(file string, line int) }
+	if errors.As(err, &located) {
+		located.locate(file, line)
+	}
+}
+
+// UndefinedVarError is the error returned when a template
+// refers to variables that are not defined.
+type UndefinedVarError struct {
+	Pos
+	// Vars contains the names of the variables not defined.
+	Vars []string
+}
+
+func (e *UndefinedVarError) Error() string {
+	return fmt.Sprintf("%s: undefined variable $%s", e.Pos, strings.Join(e.Vars, ", $"))
+}
+
+// RequiredVarError is the error returned when a template
+// requires, with `${VAR:?message}`, a variable that is not
+// defined or is empty.
+type RequiredVarError struct {
+	Pos
+	Var     string
+	Message string
+}
+
+func (e *RequiredVarError) Error() string {
+	return fmt.Sprintf("%s: $%s: %s", e.Pos, e.Var, e.Message)
+}
+
+// SyntaxError is the error returned when a directive
+// of a template, or a namelist, is not valid.
+type SyntaxError struct {
+	Pos
+	Msg string
+}
+
+func (e *SyntaxError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Pos, e.Msg)
+}
+
+// section is a conditional section
+// of a template, started by `@if`.
+type section struct {
+	// parent tells whether the
+	// enclosing section is rendered.
+	parent bool
+	cond   bool
+	inElse bool
+}
+
+// rendered returns whether the lines of s are rendered.
+func (s section) rendered() bool {
+	return s.parent && s.cond != s.inElse
+}
+
+// render reads the template from r line by line,
+// and writes the result to w, expanding the variables
+// with lookup and running the directives of the
+// template. file is the path of the template,
+// and includes are resolved against its directory.
+//
+// When report is not nil, errors of the template
+// language are passed to it, and rendering goes on
+// with the next line, so that all errors are found.
+func render(r io.Reader, w io.Writer, lookup Lookup, file string, depth int, report func(err error)) error {
+	var sections []section
+	rendered := func() bool {
+		return len(sections) == 0 || sections[len(sections)-1].rendered()
+	}
+	fail := func(err error, line int) error {
+		locate(err, file, line)
+		if report == nil {
+			return err
+		}
+		report(err)
+		return nil
+	}
+
+	// lines are read with a bufio.Reader, rather than a
+	// bufio.Scanner, so that their length is not limited
+	br := bufio.NewReader(r)
+	line := 0
+	for eof := false; !eof; {
+		text, readErr := br.ReadString('\n')
+		if errors.Is(readErr, io.EOF) {
+			eof = true
+			if text == "" {
+				break
+			}
+		} else if readErr != nil {
+			return fmt.Errorf("CopyExpanding: cannot read from source file: %w", readErr)
+		}
+		line++
+		text = strings.TrimSuffix(strings.TrimSuffix(text, "\n"), "\r")
+
+		directive, arg, isDirective := parseDirective(text)
+		if !isDirective {
+			if !rendered() {
+				continue
+			}
+			l, err := expandEnv(text, lookup)
+			if err != nil {
+				if err := fail(err, line); err != nil {
+					return err
+				}
+				continue
+			}
+			if _, err := w.Write([]byte(l + "\n")); err != nil {
+				return fmt.Errorf("CopyExpanding: cannot write to target file: %w", err)
+			}
+			continue
+		}
+
+		var err error
+		switch directive {
+		case "@if":
+			var cond bool
+			cond, err = evalCond(arg, lookup)
+			sections = append(sections, section{parent: rendered(), cond: cond})
+		case "@else":
+			if len(sections) == 0 || sections[len(sections)-1].inElse {
+				err = &SyntaxError{Msg: "@else without @if"}
+				break
+			}
+			sections[len(sections)-1].inElse = true
+		case "@end":
+			if len(sections) == 0 {
+				err = &SyntaxError{Msg: "@end without @if"}
+				break
+			}
+			sections = sections[:len(sections)-1]
+		case "@include":
+			if rendered() {
+				err = include(arg, w, lookup, file, depth, report)
+			}
+		}
+		if err != nil {
+			if err := fail(err, line); err != nil {
+				return err
+			}
+		}
+	}
+
+	if len(sections) > 0 {
+		return fail(&SyntaxError{Msg: "@if without @end"}, line)
+	}
+	return nil
+}
+
+// parseDirective returns the directive on line, and its
+// argument. Lines starting with `@` are directives only when
+// followed by one of `if`, `else`, `end` or `include`, so that
+// other lines starting with `@` are rendered unchanged.
+func parseDirective(line string) (directive, arg string, ok bool) {
+	line = strings.TrimSpace(line)
+	directive, arg, _ = strings.Cut(line, " ")
+	switch directive {
+	case "@if", "@else", "@end", "@include":
+		return directive, strings.TrimSpace(arg), true
+	}
+	return "", "", false
+}
+
+// evalCond returns the value of the condition of an `@if`:
+//
+//   - `VAR` is true when VAR is defined and not empty;
+//   - `!VAR` is true when VAR is not defined or is empty;
+//   - `VAR == value` and `VAR != value` compare the value
+//     of VAR, empty when it's not defined, with value.
+func evalCond(cond string, lookup Lookup) (bool, error) {
+	for _, op := range []string{"==", "!="} {
+		if name, value, found := strings.Cut(cond, op); found {
+			name = strings.TrimSpace(name)
+			if !isName(name) {
+				return false, &SyntaxError{Msg: fmt.Sprintf("@if: invalid variable name `%s`", name)}
+			}
+			val, _ := lookup(name)
+			return (val == strings.TrimSpace(value)) == (op == "=="), nil
+		}
+	}
+
+	name, negated := strings.CutPrefix(cond, "!")
+	name = strings.TrimSpace(name)
+	if !isName(name) {
+		return false, &SyntaxError{Msg: fmt.Sprintf("@if: invalid variable name `%s`", name)}
+	}
+	val, ok := lookup(name)
+	return (ok && val != "") != negated, nil
+}
+
+// isName reports whether s is a valid variable name.
+func isName(s string) bool {
+	if s == "" {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		if !isAlphaNum(s[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// include renders to w the fragment at path, that can refer to
+// variables and is resolved against the directory of file.
+func include(path string, w io.Writer, lookup Lookup, file string, depth int, report func(err error)) error {
+	if path == "" {
+		return &SyntaxError{Msg: "@include: missing file path"}
+	}
+	if depth >= maxIncludeDepth {
+		return &SyntaxError{Msg: fmt.Sprintf("@include: more than %d nested includes", maxIncludeDepth)}
+	}
+	path, err := expandEnv(path, lookup)
+	if err != nil {
+		return err
+	}
+	if !filepath.IsAbs(path) && file != "" {
+		path = filepath.Join(filepath.Dir(file), path)
+	}
+
+	r, err := os.Open(path)
+	if err != nil {
+		return &SyntaxError{Msg: fmt.Sprintf("@include: %s", err)}
+	}
+	defer r.Close()
+	return render(r, w, lookup, path, depth+1, report)
+}
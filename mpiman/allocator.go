@@ -0,0 +1,469 @@
+package mpiman
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Slots contains the cores of
+// a node allocated to a job.
+type Slots struct {
+	Node  string
+	Cores []int
+}
+
+// Allocation contains the cores allocated to
+// a job by an Allocator, grouped by node.
+type Allocation []Slots
+
+// Nodes returns the nodes used by the allocation.
+func (alloc Allocation) Nodes() SlurmNodesList {
+	res := make(SlurmNodesList, 0, len(alloc))
+	for _, slots := range alloc {
+		res = append(res, slots.Node)
+	}
+	return res
+}
+
+// Procs returns the number of cores in the allocation,
+// which is the number of MPI processes it can run.
+func (alloc Allocation) Procs() int {
+	procs := 0
+	for _, slots := range alloc {
+		procs += len(slots.Cores)
+	}
+	return procs
+}
+
+// Hosts returns the nodes of the allocation,
+// each one followed by the number of its cores
+// allocated, e.g. `n1:128,n2:128,n3:105`
+func (alloc Allocation) Hosts() string {
+	hosts := make([]string, 0, len(alloc))
+	for _, slots := range alloc {
+		hosts = append(hosts, fmt.Sprintf("%s:%d", slots.Node, len(slots.Cores)))
+	}
+	return strings.Join(hosts, ",")
+}
+
+// String returns the `-host` option that makes mpirun
+// start the processes on the cores of the allocation.
+func (alloc Allocation) String() string {
+	if len(alloc) == 0 {
+		return ""
+	}
+	return "-host " + alloc.Hosts()
+}
+
+// Rankfile returns the content of an Open MPI rankfile
+// that binds every MPI process to a core of the allocation.
+func (alloc Allocation) Rankfile() string {
+	var res strings.Builder
+	rank := 0
+	for _, slots := range alloc {
+		for _, core := range slots.Cores {
+			fmt.Fprintf(&res, "rank %d=%s slot=%d\n", rank, slots.Node, core)
+			rank++
+		}
+	}
+	return res.String()
+}
+
+// Merge returns an allocation containing
+// the cores of both alloc and other.
+func (alloc Allocation) Merge(other Allocation) Allocation {
+	cores := map[string][]int{}
+	for _, slots := range append(append(Allocation{}, alloc...), other...) {
+		cores[slots.Node] = append(cores[slots.Node], slots.Cores...)
+	}
+	res := make(Allocation, 0, len(cores))
+	for node, nodeCores := range cores {
+		sort.Ints(nodeCores)
+		res = append(res, Slots{Node: node, Cores: nodeCores})
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].Node < res[j].Node
+	})
+	return res
+}
+
+// Allocator assigns the cores of a set of nodes to jobs,
+// keeping track of the cores of every node that are in use,
+// so that more jobs can share the same node.
+type Allocator struct {
+	lock  sync.Mutex
+	nodes []string
+	// busy contains, for every node, whether each one of its cores is in use.
+	busy map[string][]bool
+	free map[string]int
+	// waiting contains the requests waiting for
+	// free cores, in the order they will be granted.
+	waiting []*Request
+	// failures contains the number of consecutive
+	// failures reported for every node.
+	failures map[string]int
+	// quarantined contains the reason of the
+	// quarantine of every node quarantined.
+	quarantined map[string]string
+
+	// MaxFailures is the number of consecutive failures
+	// reported for a node after which the node is quarantined.
+	// When 0, nodes are never quarantined. It must be set
+	// before the Allocator is used.
+	MaxFailures int
+}
+
+// NewAllocator returns an Allocator that assigns the cores
+// of the free nodes in nodes, each one having coresPerNode cores.
+func NewAllocator(nodes SlurmNodes, coresPerNode int) *Allocator {
+	a := &Allocator{
+		busy:        map[string][]bool{},
+		free:        map[string]int{},
+		failures:    map[string]int{},
+		quarantined: map[string]string{},
+	}
+	if coresPerNode <= 0 {
+		return a
+	}
+
+	nodes.Lock.Lock()
+	defer nodes.Lock.Unlock()
+	for node, free := range nodes.Nodes {
+		if !free {
+			continue
+		}
+		a.nodes = append(a.nodes, node)
+		a.busy[node] = make([]bool, coresPerNode)
+		a.free[node] = coresPerNode
+	}
+	sort.Strings(a.nodes)
+	return a
+}
+
+// Empty reports whether a has no nodes,
+// and so it cannot allocate any core.
+func (a *Allocator) Empty() bool {
+	return len(a.nodes) == 0
+}
+
+// Capacity returns the number of cores of all
+// nodes, excluding the ones quarantined.
+func (a *Allocator) Capacity() int {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	return a.capacity()
+}
+
+func (a *Allocator) capacity() int {
+	capacity := 0
+	for _, node := range a.nodes {
+		if _, quarantined := a.quarantined[node]; !quarantined {
+			capacity += len(a.busy[node])
+		}
+	}
+	return capacity
+}
+
+// FreeCores returns the number of cores not in
+// use, excluding the ones of quarantined nodes.
+func (a *Allocator) FreeCores() int {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	return a.freeCores()
+}
+
+func (a *Allocator) freeCores() int {
+	free := 0
+	for _, node := range a.nodes {
+		if _, quarantined := a.quarantined[node]; !quarantined {
+			free += a.free[node]
+		}
+	}
+	return free
+}
+
+// Allocate reserves procs cores, returning them, or returns
+// false if the free cores are not enough. It fails also when
+// requests are waiting, so as not to overtake them.
+//
+// Jobs are packed on the least number of nodes: the job
+// takes whole free nodes while it needs more cores than
+// any node has free, and then the remaining cores from the
+// node that has the fewest free cores enough to contain
+// them, so that partially used nodes are filled first.
+func (a *Allocator) Allocate(procs int) (Allocation, bool) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	if len(a.waiting) > 0 {
+		return nil, false
+	}
+	return a.allocate(procs)
+}
+
+// ErrCapacityExceeded is returned by Request.Wait when the cores
+// requested are more than the ones of all nodes, also when nodes
+// quarantined while the request was waiting make them not enough.
+var ErrCapacityExceeded = errors.New("requested cores exceed the capacity of the nodes")
+
+// Request is a request of cores queued by an Allocator,
+// waiting for them to be free.
+type Request struct {
+	a        *Allocator
+	procs    int
+	priority int
+	err      error
+	granted  chan Allocation
+}
+
+// Request queues a request of procs cores, that will be
+// granted when they are free, and returns it. Use Wait
+// to wait for the cores to be granted.
+//
+// Requests are granted in order of priority, higher first,
+// and then in the order they were queued. A request that
+// cannot be granted yet blocks all the ones that follow it,
+// so that large jobs are not starved by smaller ones.
+func (a *Allocator) Request(procs, priority int) *Request {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	req := &Request{a: a, procs: procs, priority: priority, granted: make(chan Allocation, 1)}
+	if procs > a.capacity() {
+		a.reject(req)
+		return req
+	}
+	if procs <= 0 {
+		req.granted <- nil
+		return req
+	}
+
+	pos := sort.Search(len(a.waiting), func(i int) bool {
+		return a.waiting[i].priority < priority
+	})
+	a.waiting = append(a.waiting[:pos], append([]*Request{req}, a.waiting[pos:]...)...)
+	a.grant()
+	return req
+}
+
+// Wait waits for the cores of req to be granted and returns
+// them. It returns the error of ctx if it's done before, and
+// ErrCapacityExceeded if req is for more cores than the ones
+// of all nodes. When Wait fails, req is removed from the queue.
+func (req *Request) Wait(ctx context.Context) (Allocation, error) {
+	select {
+	case alloc, ok := <-req.granted:
+		if !ok {
+			return nil, req.err
+		}
+		return alloc, nil
+	case <-ctx.Done():
+	}
+
+	a := req.a
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	for i, other := range a.waiting {
+		if other == req {
+			a.waiting = append(a.waiting[:i], a.waiting[i+1:]...)
+			break
+		}
+	}
+	select {
+	case alloc := <-req.granted:
+		// the cores were granted while ctx was done,
+		// or alloc is nil if req was rejected
+		a.dispose(alloc)
+	default:
+	}
+	// the requests that followed could fit now
+	a.grant()
+	return nil, ctx.Err()
+}
+
+// Acquire reserves procs cores as Allocate does, waiting for
+// them to be released by Dispose when they are not free. It's
+// a shortcut for a Request followed by its Wait.
+func (a *Allocator) Acquire(ctx context.Context, procs, priority int) (Allocation, error) {
+	return a.Request(procs, priority).Wait(ctx)
+}
+
+// reject makes req fail because it
+// exceeds the capacity of the nodes.
+func (a *Allocator) reject(req *Request) {
+	req.err = fmt.Errorf("%w: %d cores requested, %d available", ErrCapacityExceeded, req.procs, a.capacity())
+	close(req.granted)
+}
+
+// grant allocates their cores to the first requests
+// waiting, until one of them does not fit. Requests
+// exceeding the capacity of the nodes are rejected.
+func (a *Allocator) grant() {
+	for len(a.waiting) > 0 {
+		req := a.waiting[0]
+		if req.procs > a.capacity() {
+			a.waiting = a.waiting[1:]
+			a.reject(req)
+			continue
+		}
+		alloc, ok := a.allocate(req.procs)
+		if !ok {
+			return
+		}
+		a.waiting = a.waiting[1:]
+		req.granted <- alloc
+	}
+}
+
+func (a *Allocator) allocate(procs int) (Allocation, bool) {
+	if procs <= 0 || procs > a.freeCores() {
+		return nil, false
+	}
+
+	var res Allocation
+	for procs > 0 {
+		node := a.bestFit(procs)
+		taken := min(procs, a.free[node])
+		slots := Slots{Node: node}
+		busy := a.busy[node]
+		for core := range busy {
+			if len(slots.Cores) == taken {
+				break
+			}
+			if !busy[core] {
+				busy[core] = true
+				slots.Cores = append(slots.Cores, core)
+			}
+		}
+		a.free[node] -= taken
+		procs -= taken
+		res = append(res, slots)
+	}
+
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].Node < res[j].Node
+	})
+	return res, true
+}
+
+// bestFit returns the node with the fewest free cores
+// that can contain procs processes or, if none of
+// them can, the node with the most free cores.
+func (a *Allocator) bestFit(procs int) string {
+	best := ""
+	largest := ""
+	for _, node := range a.nodes {
+		if _, quarantined := a.quarantined[node]; quarantined {
+			continue
+		}
+		free := a.free[node]
+		if free >= procs && (best == "" || free < a.free[best]) {
+			best = node
+		}
+		if free > 0 && (largest == "" || free > a.free[largest]) {
+			largest = node
+		}
+	}
+	if best != "" {
+		return best
+	}
+	return largest
+}
+
+// Dispose releases the cores of alloc, that must have
+// been returned by Allocate, Acquire or Request.Wait,
+// granting them to the requests that are waiting.
+func (a *Allocator) Dispose(alloc Allocation) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	a.dispose(alloc)
+	a.grant()
+}
+
+func (a *Allocator) dispose(alloc Allocation) {
+	for _, slots := range alloc {
+		busy := a.busy[slots.Node]
+		for _, core := range slots.Cores {
+			if busy[core] {
+				busy[core] = false
+				a.free[slots.Node]++
+			}
+		}
+	}
+}
+
+// ReportFailure records a failure of the job that ran on alloc
+// for every one of its nodes. It quarantines the nodes that
+// reached MaxFailures consecutive failures, recording reason
+// as the reason of their quarantine, and returns them.
+//
+// The cores of quarantined nodes are not allocated anymore,
+// and waiting requests that exceed the remaining capacity
+// fail.
+func (a *Allocator) ReportFailure(alloc Allocation, reason string) (quarantined SlurmNodesList) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	for _, slots := range alloc {
+		if _, ok := a.quarantined[slots.Node]; ok {
+			continue
+		}
+		a.failures[slots.Node]++
+		if a.MaxFailures > 0 && a.failures[slots.Node] >= a.MaxFailures {
+			a.quarantined[slots.Node] = reason
+			quarantined = append(quarantined, slots.Node)
+		}
+	}
+	if len(quarantined) > 0 {
+		a.grant()
+	}
+	return quarantined
+}
+
+// ReportSuccess records that the job that ran on alloc
+// completed, resetting the count of failures of its nodes.
+func (a *Allocator) ReportSuccess(alloc Allocation) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	for _, slots := range alloc {
+		delete(a.failures, slots.Node)
+	}
+}
+
+// Quarantined returns the nodes quarantined,
+// together with the reason of their quarantine.
+func (a *Allocator) Quarantined() map[string]string {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	res := make(map[string]string, len(a.quarantined))
+	for node, reason := range a.quarantined {
+		res[node] = reason
+	}
+	return res
+}
+
+// Healthy returns the part of alloc on nodes that are
+// not quarantined, and the number of cores of alloc
+// on quarantined nodes.
+func (a *Allocator) Healthy(alloc Allocation) (healthy Allocation, lost int) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	for _, slots := range alloc {
+		if _, quarantined := a.quarantined[slots.Node]; quarantined {
+			lost += len(slots.Cores)
+			continue
+		}
+		healthy = append(healthy, slots)
+	}
+	return healthy, lost
+}
@@ -0,0 +1,192 @@
+package mpiman
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// NodeSource discovers the nodes allocated
+// to the job by a batch scheduler.
+type NodeSource interface {
+	// Available reports whether the environment of
+	// the process describes the nodes of the source.
+	Available() bool
+	// Nodes returns the hostnames of the nodes
+	// allocated, in order and without duplicates.
+	Nodes() (SlurmNodesList, error)
+	// String describes where nodes are read
+	// from, to be used in messages.
+	String() string
+}
+
+// Slurm reads the nodes from $SLURM_NODELIST,
+// using the syntax described in ParseHostlist.
+type Slurm struct{}
+
+func (Slurm) Available() bool {
+	_, ok := os.LookupEnv("SLURM_NODELIST")
+	return ok
+}
+
+func (Slurm) Nodes() (SlurmNodesList, error) {
+	return ParseHostlist(os.Getenv("SLURM_NODELIST"))
+}
+
+func (Slurm) String() string {
+	return "$SLURM_NODELIST"
+}
+
+// PBS reads the nodes from the file named by $PBS_NODEFILE,
+// as written by PBS and Torque: one hostname per line,
+// repeated for every slot allocated on the node.
+type PBS struct{}
+
+func (PBS) Available() bool {
+	_, ok := os.LookupEnv("PBS_NODEFILE")
+	return ok
+}
+
+func (PBS) Nodes() (SlurmNodesList, error) {
+	return Hostfile{Path: os.Getenv("PBS_NODEFILE")}.Nodes()
+}
+
+func (PBS) String() string {
+	return "$PBS_NODEFILE"
+}
+
+// LSF reads the nodes from $LSB_MCPU_HOSTS, containing pairs
+// of hostname and number of slots, or, when it's not set,
+// from $LSB_HOSTS, containing a hostname for every slot.
+type LSF struct{}
+
+func (LSF) Available() bool {
+	_, mcpu := os.LookupEnv("LSB_MCPU_HOSTS")
+	_, hosts := os.LookupEnv("LSB_HOSTS")
+	return mcpu || hosts
+}
+
+func (LSF) Nodes() (SlurmNodesList, error) {
+	if mcpu, ok := os.LookupEnv("LSB_MCPU_HOSTS"); ok {
+		fields := strings.Fields(mcpu)
+		if len(fields)%2 != 0 {
+			return nil, fmt.Errorf("cannot parse $LSB_MCPU_HOSTS: hostname `%s` without slots count", fields[len(fields)-1])
+		}
+		var hosts []string
+		for i := 0; i < len(fields); i += 2 {
+			if _, err := strconv.Atoi(fields[i+1]); err != nil {
+				return nil, fmt.Errorf("cannot parse $LSB_MCPU_HOSTS: wrong slots count `%s` for %s", fields[i+1], fields[i])
+			}
+			hosts = append(hosts, fields[i])
+		}
+		return uniqueNodes(hosts)
+	}
+	return uniqueNodes(strings.Fields(os.Getenv("LSB_HOSTS")))
+}
+
+func (LSF) String() string {
+	return "$LSB_MCPU_HOSTS or $LSB_HOSTS"
+}
+
+// Hostfile reads the nodes from the file at Path, in the
+// format used by Open MPI hostfiles: a hostname at the start
+// of every line, optionally followed by other options, such
+// as `slots=48`. Empty lines and comments starting with
+// `#` are ignored.
+type Hostfile struct {
+	Path string
+}
+
+func (h Hostfile) Available() bool {
+	return h.Path != ""
+}
+
+func (h Hostfile) Nodes() (SlurmNodesList, error) {
+	f, err := os.Open(h.Path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var hosts []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line, _, _ := strings.Cut(scanner.Text(), "#")
+		if fields := strings.Fields(line); len(fields) > 0 {
+			hosts = append(hosts, fields[0])
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	nodes, err := uniqueNodes(hosts)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", h.Path, err)
+	}
+	return nodes, nil
+}
+
+func (h Hostfile) String() string {
+	return "hostfile " + h.Path
+}
+
+// Localhost runs everything on the local host,
+// e.g. on developer workstations.
+type Localhost struct{}
+
+func (Localhost) Available() bool {
+	return true
+}
+
+func (Localhost) Nodes() (SlurmNodesList, error) {
+	return SlurmNodesList{"localhost"}, nil
+}
+
+func (Localhost) String() string {
+	return "localhost"
+}
+
+// DetectNodeSource returns the first source, among the ones of
+// Slurm, PBS and LSF, which is available in the environment of
+// the process, or nil when there isn't any.
+func DetectNodeSource() NodeSource {
+	for _, source := range []NodeSource{Slurm{}, PBS{}, LSF{}} {
+		if source.Available() {
+			return source
+		}
+	}
+	return nil
+}
+
+// DiscoverNodes returns a SlurmNodes containing all
+// the nodes of source. All nodes are free.
+func DiscoverNodes(source NodeSource) (SlurmNodes, error) {
+	list, err := source.Nodes()
+	if err != nil {
+		return SlurmNodes{}, err
+	}
+	res := NewSlurmNodes()
+	for _, host := range list {
+		res.Nodes[host] = true
+	}
+	return res, nil
+}
+
+// uniqueNodes returns hosts, in order and without
+// duplicates. It fails when hosts is empty.
+func uniqueNodes(hosts []string) (SlurmNodesList, error) {
+	var res SlurmNodesList
+	seen := map[string]bool{}
+	for _, host := range hosts {
+		if !seen[host] {
+			seen[host] = true
+			res = append(res, host)
+		}
+	}
+	if len(res) == 0 {
+		return nil, fmt.Errorf("empty hosts list")
+	}
+	return res, nil
+}
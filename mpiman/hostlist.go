@@ -0,0 +1,280 @@
+package mpiman
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ParseError is the error returned when a
+// hostlist expression is not valid. Pos is
+// the position in Src of the invalid text.
+type ParseError struct {
+	Pos int
+	Src string
+	Msg string
+}
+
+func (e ParseError) Error() string {
+	return e.Msg
+}
+
+var _ error = ParseError{}
+
+// ParseSlurmNodes returns a SlurmNodes containing all
+// the hosts of the hostlist expression hosts, as
+// described in ParseHostlist. All nodes are free.
+func ParseSlurmNodes(hosts string) (SlurmNodes, error) {
+	list, err := ParseHostlist(hosts)
+	if err != nil {
+		return SlurmNodes{}, err
+	}
+	res := NewSlurmNodes()
+	for _, host := range list {
+		res.Nodes[host] = true
+	}
+	return res, nil
+}
+
+// ParseHostlist expands the Slurm hostlist expression hosts
+// (as found in $SLURM_NODELIST) into the hostnames it contains,
+// in the order they appear and without duplicates.
+//
+// The expression is a comma separated list of hostnames. Every
+// hostname can contain any number of groups, enclosed in square
+// brackets, each one containing a comma separated list of numeric
+// ranges (`1-4`), numbers or names. A hostname is expanded in
+// every combination of the elements of its groups:
+// `rack[1-2]-node[01-02]-ib` expands to `rack1-node01-ib`,
+// `rack1-node02-ib`, `rack2-node01-ib` and `rack2-node02-ib`.
+// Numbers in a range are padded with zeros to the length
+// of the start of the range, when it starts with a zero.
+func ParseHostlist(hosts string) (SlurmNodesList, error) {
+	fail := func(pos int, format string, args ...any) (SlurmNodesList, error) {
+		return nil, ParseError{Pos: pos, Src: hosts, Msg: fmt.Sprintf(format, args...)}
+	}
+
+	var res SlurmNodesList
+	seen := map[string]bool{}
+	// names contains the expansion of the hostname parsed
+	// so far, and text the characters following the last group.
+	names := []string{""}
+	var text strings.Builder
+	appendText := func() {
+		for i := range names {
+			names[i] += text.String()
+		}
+		text.Reset()
+	}
+	endHost := func() {
+		appendText()
+		for _, name := range names {
+			if name != "" && !seen[name] {
+				seen[name] = true
+				res = append(res, name)
+			}
+		}
+		names = []string{""}
+	}
+
+	for pos := 0; pos < len(hosts); pos++ {
+		switch c := hosts[pos]; c {
+		case ',':
+			endHost()
+		case ']':
+			return fail(pos, "unexpected `]` outside of a group")
+		case '[':
+			end := strings.IndexAny(hosts[pos+1:], "[]")
+			if end == -1 || hosts[pos+1+end] == '[' {
+				return fail(pos, "group not closed")
+			}
+			end += pos + 1
+			elements, err := parseGroup(hosts, pos+1, end)
+			if err != nil {
+				return nil, err
+			}
+
+			appendText()
+			var expanded []string
+			for _, name := range names {
+				for _, element := range elements {
+					expanded = append(expanded, name+element)
+				}
+			}
+			names = expanded
+			pos = end
+		default:
+			text.WriteByte(c)
+		}
+	}
+	endHost()
+
+	if len(res) == 0 {
+		return fail(0, "empty hosts list")
+	}
+	return res, nil
+}
+
+// parseGroup returns the elements of the group
+// contained in src between positions start and end.
+func parseGroup(src string, start, end int) ([]string, error) {
+	fail := func(pos int, msg string) ([]string, error) {
+		return nil, ParseError{Pos: pos, Src: src, Msg: msg}
+	}
+
+	if start == end {
+		return fail(start, "empty group")
+	}
+
+	var res []string
+	pos := start
+	for _, element := range strings.Split(src[start:end], ",") {
+		elementPos := pos
+		pos += len(element) + 1
+
+		if element == "" {
+			return fail(elementPos, "empty element in group")
+		}
+		rangeStart, rangeEnd, isRange := strings.Cut(element, "-")
+		if !isRange {
+			res = append(res, element)
+			continue
+		}
+
+		if rangeStart == "" {
+			return fail(elementPos, "range start cannot be empty")
+		}
+		if rangeEnd == "" {
+			return fail(elementPos+len(rangeStart)+1, "range end cannot be empty")
+		}
+		first, err := strconv.ParseUint(rangeStart, 10, 64)
+		if err != nil {
+			return fail(elementPos, "range start is not a number")
+		}
+		last, err := strconv.ParseUint(rangeEnd, 10, 64)
+		if err != nil {
+			return fail(elementPos+len(rangeStart)+1, "range end is not a number")
+		}
+		if last < first {
+			return fail(elementPos, "range end is lower than range start")
+		}
+
+		width := 0
+		if rangeStart[0] == '0' {
+			width = len(rangeStart)
+		}
+		for n := first; n <= last; n++ {
+			res = append(res, fmt.Sprintf("%0*d", width, n))
+		}
+	}
+	return res, nil
+}
+
+// hostNumber is a hostname split around its last number.
+type hostNumber struct {
+	prefix string
+	digits string
+	suffix string
+	value  uint64
+}
+
+// splitHost splits host around its last sequence of
+// digits. ok is false when host contains no number.
+func splitHost(host string) (h hostNumber, ok bool) {
+	end := strings.LastIndexAny(host, "0123456789") + 1
+	if end == 0 {
+		return hostNumber{}, false
+	}
+	start := end
+	for start > 0 && host[start-1] >= '0' && host[start-1] <= '9' {
+		start--
+	}
+	value, err := strconv.ParseUint(host[start:end], 10, 64)
+	if err != nil {
+		return hostNumber{}, false
+	}
+	return hostNumber{
+		prefix: host[:start],
+		digits: host[start:end],
+		suffix: host[end:],
+		value:  value,
+	}, true
+}
+
+// Compress returns a hostlist expression, in the syntax
+// accepted by ParseHostlist and by Slurm, containing all
+// the hosts in lst. Hosts that differ only by their last
+// number are grouped, using ranges for consecutive numbers:
+// `node01`, `node02`, `node03` and `node07` are compressed
+// to `node[01-03,07]`.
+func (lst SlurmNodesList) Compress() string {
+	type groupKey struct{ prefix, suffix string }
+	groups := map[groupKey][]hostNumber{}
+	var plain []string
+	for _, host := range lst {
+		h, ok := splitHost(host)
+		if !ok {
+			plain = append(plain, host)
+			continue
+		}
+		key := groupKey{h.prefix, h.suffix}
+		groups[key] = append(groups[key], h)
+	}
+
+	keys := make([]groupKey, 0, len(groups))
+	for key := range groups {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].prefix != keys[j].prefix {
+			return keys[i].prefix < keys[j].prefix
+		}
+		return keys[i].suffix < keys[j].suffix
+	})
+
+	sort.Strings(plain)
+	res := plain
+	for _, key := range keys {
+		hosts := groups[key]
+		sort.Slice(hosts, func(i, j int) bool {
+			if hosts[i].value != hosts[j].value {
+				return hosts[i].value < hosts[j].value
+			}
+			if len(hosts[i].digits) != len(hosts[j].digits) {
+				return len(hosts[i].digits) < len(hosts[j].digits)
+			}
+			return hosts[i].digits < hosts[j].digits
+		})
+
+		if len(hosts) == 1 {
+			res = append(res, key.prefix+hosts[0].digits+key.suffix)
+			continue
+		}
+
+		var ranges []string
+		for i := 0; i < len(hosts); {
+			first := hosts[i]
+			width := 0
+			if first.digits[0] == '0' {
+				width = len(first.digits)
+			}
+			// extends the range while numbers are consecutive,
+			// and formatted with the same padding.
+			j := i + 1
+			for j < len(hosts) &&
+				hosts[j].value == hosts[j-1].value+1 &&
+				fmt.Sprintf("%0*d", width, hosts[j].value) == hosts[j].digits {
+				j++
+			}
+			if j-i == 1 {
+				ranges = append(ranges, first.digits)
+			} else {
+				ranges = append(ranges, first.digits+"-"+hosts[j-1].digits)
+			}
+			i = j
+		}
+		res = append(res, fmt.Sprintf("%s[%s]%s", key.prefix, strings.Join(ranges, ","), key.suffix))
+	}
+	return strings.Join(res, ",")
+}
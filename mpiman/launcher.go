@@ -0,0 +1,136 @@
+package mpiman
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Launcher builds the command lines that
+// start the processes of MPI executables.
+type Launcher interface {
+	// Command returns the command line that runs exe with
+	// procs processes on the cores of alloc, or on the whole
+	// allocation when alloc is empty.
+	Command(exe string, procs int, alloc Allocation) string
+	// Files returns the content of the files, indexed by
+	// name, that the command line returned by Command
+	// refers to. They must be written in the directory
+	// where the command runs.
+	Files(alloc Allocation) map[string]string
+}
+
+// rankfileName and machinefileName are the names of the
+// files listing the cores used by the MPI processes.
+const (
+	rankfileName    = "rankfile"
+	machinefileName = "machinefile"
+)
+
+// command joins the non empty parts of a command line.
+func command(parts ...string) string {
+	var res []string
+	for _, part := range parts {
+		if part != "" {
+			res = append(res, part)
+		}
+	}
+	return strings.Join(res, " ")
+}
+
+// OpenMPI launches executables using
+// the mpirun command of Open MPI.
+type OpenMPI struct {
+	// Mpirun is the command used to launch
+	// executables, `mpirun` when empty.
+	Mpirun string
+	// Options contains additional options for Mpirun.
+	Options string
+	// Rankfile, when true, makes mpirun place the
+	// processes using a rankfile, instead of `-host`.
+	Rankfile bool
+}
+
+func (l OpenMPI) Command(exe string, procs int, alloc Allocation) string {
+	mpirun := l.Mpirun
+	if mpirun == "" {
+		mpirun = "mpirun"
+	}
+	hosts := alloc.String()
+	if l.Rankfile && len(alloc) > 0 {
+		hosts = "--rankfile " + rankfileName
+	}
+	return command(mpirun, l.Options, hosts, fmt.Sprintf("-n %d", procs), exe)
+}
+
+func (l OpenMPI) Files(alloc Allocation) map[string]string {
+	if !l.Rankfile || len(alloc) == 0 {
+		return nil
+	}
+	return map[string]string{rankfileName: alloc.Rankfile()}
+}
+
+// IntelMPI launches executables using the mpirun
+// command of Intel MPI, or of other MPI libraries
+// using the Hydra process manager.
+type IntelMPI struct {
+	// Mpirun is the command used to launch
+	// executables, `mpirun` when empty.
+	Mpirun string
+	// Options contains additional options for Mpirun.
+	Options string
+}
+
+func (l IntelMPI) Command(exe string, procs int, alloc Allocation) string {
+	mpirun := l.Mpirun
+	if mpirun == "" {
+		mpirun = "mpirun"
+	}
+	hosts := ""
+	if len(alloc) > 0 {
+		hosts = "-machinefile " + machinefileName
+	}
+	return command(mpirun, l.Options, hosts, fmt.Sprintf("-n %d", procs), exe)
+}
+
+func (l IntelMPI) Files(alloc Allocation) map[string]string {
+	if len(alloc) == 0 {
+		return nil
+	}
+	var machinefile strings.Builder
+	for _, slots := range alloc {
+		fmt.Fprintf(&machinefile, "%s:%d\n", slots.Node, len(slots.Cores))
+	}
+	return map[string]string{machinefileName: machinefile.String()}
+}
+
+// Srun launches executables as Slurm job steps, using srun.
+// Slurm chooses how many processes run on every node.
+type Srun struct {
+	// Options contains additional options for srun.
+	Options string
+}
+
+func (l Srun) Command(exe string, procs int, alloc Allocation) string {
+	nodes := ""
+	if len(alloc) > 0 {
+		nodes = fmt.Sprintf("--nodes=%d --nodelist=%s", len(alloc), alloc.Nodes().Compress())
+	}
+	return command("srun", l.Options, nodes, fmt.Sprintf("--ntasks=%d", procs), exe)
+}
+
+func (l Srun) Files(alloc Allocation) map[string]string {
+	return nil
+}
+
+// Local runs executables directly, as a single process
+// on the local host, without MPI. It can be used to run
+// small domains, e.g. in tests.
+type Local struct{}
+
+func (l Local) Command(exe string, procs int, alloc Allocation) string {
+	return exe
+}
+
+func (l Local) Files(alloc Allocation) map[string]string {
+	return nil
+}
@@ -1,36 +1,234 @@
 package mpiman_test
 
 import (
+	"context"
+	"os"
+	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/meteocima/ensemble-runner/mpiman"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestMpiManager(t *testing.T) {
 
-	t.Run("FindFreeNodes", func(t *testing.T) {
-		nodes := mpiman.NewSlurmNodes()
-		nodes.Nodes["a"] = true
-		nodes.Nodes["b"] = false
-		nodes.Nodes["c"] = true
+	t.Run("Partition", func(t *testing.T) {
+		nodes, err := mpiman.ParseSlurmNodes("n[1-5]")
+		assert.NoError(t, err)
+		nodes.Nodes["n2"] = false
+
+		pools := nodes.Partition(2)
+		assert.Len(t, pools, 2)
+		assert.Equal(t, mpiman.SlurmNodesList{"n1", "n2", "n3"}, pools[0].All())
+		assert.Equal(t, mpiman.SlurmNodesList{"n4", "n5"}, pools[1].All())
+		assert.False(t, pools[0].Nodes["n2"])
+
+		// pools are independent
+		pools[1].Nodes["n4"] = false
+		assert.True(t, nodes.Nodes["n4"])
+
+		assert.Len(t, nodes.Partition(3)[2].All(), 1)
+		assert.Empty(t, mpiman.NewSlurmNodes().Partition(2)[1].All())
+	})
+
+	t.Run("Allocator", func(t *testing.T) {
+		nodes, err := mpiman.ParseSlurmNodes("n[1-5]")
+		require.NoError(t, err)
+		nodes.Nodes["n5"] = false
+		cores := mpiman.NewAllocator(nodes, 128)
+		assert.Equal(t, 512, cores.FreeCores())
+
+		wrf, ok := cores.Allocate(361)
+		require.True(t, ok)
+		assert.Equal(t, "-host n1:128,n2:128,n3:105", wrf.String())
+		assert.Equal(t, 361, wrf.Procs())
+		assert.Equal(t, 151, cores.FreeCores())
+
+		// partially used nodes are filled first
+		da, ok := cores.Allocate(20)
+		require.True(t, ok)
+		assert.Equal(t, "n3:20", da.Hosts())
+		assert.Equal(t, 105, da[0].Cores[0])
+		real, ok := cores.Allocate(30)
+		require.True(t, ok)
+		assert.Equal(t, "n4:30", real.Hosts())
+
+		_, ok = cores.Allocate(102)
+		assert.False(t, ok)
+		assert.Equal(t, 101, cores.FreeCores())
+
+		cores.Dispose(wrf)
+		assert.Equal(t, 462, cores.FreeCores())
+		all, ok := cores.Allocate(462)
+		require.True(t, ok)
+		assert.Equal(t, mpiman.SlurmNodesList{"n1", "n2", "n3", "n4"}, all.Nodes())
+		assert.True(t, nodes.Nodes["n1"], "allocator must not change nodes")
+
+		assert.False(t, cores.Empty())
+		assert.True(t, mpiman.NewAllocator(mpiman.NewSlurmNodes(), 128).Empty())
+	})
+
+	t.Run("Request", func(t *testing.T) {
+		nodes, err := mpiman.ParseSlurmNodes("n[1-2]")
+		require.NoError(t, err)
+		cores := mpiman.NewAllocator(nodes, 4)
+		ctx := context.Background()
+
+		running, err := cores.Acquire(ctx, 6, 0)
+		require.NoError(t, err)
+		member := cores.Request(4, -1)
+		control := cores.Request(4, 0)
+		da := cores.Request(2, 0)
+
+		// da would fit in the free cores, but it cannot overtake control
+		_, ok := cores.Allocate(1)
+		assert.False(t, ok)
+
+		cores.Dispose(running)
+		alloc, err := control.Wait(ctx)
+		require.NoError(t, err)
+		assert.Equal(t, "n1:4", alloc.Hosts())
+		alloc, err = da.Wait(ctx)
+		require.NoError(t, err)
+		assert.Equal(t, "n2:2", alloc.Hosts())
 
-		freeNodes, ok := nodes.FindFreeNodes(2)
+		timeout, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+		defer cancel()
+		_, err = member.Wait(timeout)
+		assert.ErrorIs(t, err, context.DeadlineExceeded)
+		// requests that timed out are not granted anymore
+		_, ok = cores.Allocate(2)
 		assert.True(t, ok)
-		assert.Equal(t, mpiman.SlurmNodesList{"a", "c"}, freeNodes)
-		for _, n := range nodes.Nodes {
-			assert.False(t, n)
+
+		_, err = cores.Acquire(ctx, 9, 0)
+		assert.ErrorIs(t, err, mpiman.ErrCapacityExceeded)
+	})
+
+	t.Run("Quarantine", func(t *testing.T) {
+		nodes, err := mpiman.ParseSlurmNodes("n[1-3]")
+		require.NoError(t, err)
+		cores := mpiman.NewAllocator(nodes, 4)
+		cores.MaxFailures = 2
+
+		alloc, ok := cores.Allocate(6)
+		require.True(t, ok)
+		waiting := cores.Request(8, 0)
+
+		// only consecutive failures count
+		assert.Empty(t, cores.ReportFailure(alloc, "exit status 1"))
+		cores.ReportSuccess(alloc)
+		assert.Empty(t, cores.ReportFailure(alloc, "exit status 1"))
+		quarantined := cores.ReportFailure(alloc, "exit status 2")
+		assert.Equal(t, mpiman.SlurmNodesList{"n1", "n2"}, quarantined)
+		assert.Equal(t, map[string]string{"n1": "exit status 2", "n2": "exit status 2"}, cores.Quarantined())
+		assert.Equal(t, 4, cores.Capacity())
+		assert.False(t, cores.Empty(), "quarantined nodes are still nodes of the allocator")
+
+		_, err = waiting.Wait(context.Background())
+		assert.ErrorIs(t, err, mpiman.ErrCapacityExceeded)
+
+		healthy, lost := cores.Healthy(alloc)
+		assert.Empty(t, healthy)
+		assert.Equal(t, 6, lost)
+		replacement, ok := cores.Allocate(4)
+		require.True(t, ok)
+		assert.Equal(t, "n3:4", replacement.Hosts())
+
+		cores.Dispose(alloc)
+		assert.Equal(t, 0, cores.FreeCores())
+	})
+
+	t.Run("Merge", func(t *testing.T) {
+		alloc := mpiman.Allocation{{Node: "n2", Cores: []int{0, 1}}}
+		merged := alloc.Merge(mpiman.Allocation{{Node: "n1", Cores: []int{3}}, {Node: "n2", Cores: []int{2}}})
+		assert.Equal(t, "n1:1,n2:3", merged.Hosts())
+		assert.Equal(t, []int{0, 1, 2}, merged[1].Cores)
+	})
+
+	t.Run("Rankfile", func(t *testing.T) {
+		alloc := mpiman.Allocation{
+			{Node: "n1", Cores: []int{2, 3}},
+			{Node: "n2", Cores: []int{0}},
+		}
+		assert.Equal(t, "rank 0=n1 slot=2\nrank 1=n1 slot=3\nrank 2=n2 slot=0\n", alloc.Rankfile())
+		assert.Equal(t, "", mpiman.Allocation(nil).String())
+	})
+
+	t.Run("Launchers", func(t *testing.T) {
+		alloc := mpiman.Allocation{
+			{Node: "n1", Cores: []int{0, 1}},
+			{Node: "n2", Cores: []int{0}},
 		}
 
-		freeNodes2, ok2 := nodes.FindFreeNodes(1)
-		assert.False(t, ok2)
-		assert.Nil(t, freeNodes2)
+		openmpi := mpiman.OpenMPI{Options: "--bind-to core"}
+		assert.Equal(t, "mpirun --bind-to core -host n1:2,n2:1 -n 3 ./wrf.exe", openmpi.Command("./wrf.exe", 3, alloc))
+		assert.Equal(t, "mpirun --bind-to core -n 3 ./wrf.exe", openmpi.Command("./wrf.exe", 3, nil))
+		assert.Empty(t, openmpi.Files(alloc))
 
-		nodes.Dispose(freeNodes)
-		freeNodes, ok = nodes.FindFreeNodes(1)
-		assert.True(t, ok)
-		assert.Equal(t, mpiman.SlurmNodesList{"a"}, freeNodes)
+		openmpi.Rankfile = true
+		assert.Equal(t, "mpirun --bind-to core --rankfile rankfile -n 3 ./wrf.exe", openmpi.Command("./wrf.exe", 3, alloc))
+		assert.Equal(t, map[string]string{"rankfile": alloc.Rankfile()}, openmpi.Files(alloc))
 
+		intel := mpiman.IntelMPI{Mpirun: "mpiexec.hydra"}
+		assert.Equal(t, "mpiexec.hydra -machinefile machinefile -n 3 ./wrf.exe", intel.Command("./wrf.exe", 3, alloc))
+		assert.Equal(t, map[string]string{"machinefile": "n1:2\nn2:1\n"}, intel.Files(alloc))
+
+		srun := mpiman.Srun{Options: "--cpu-bind=cores"}
+		assert.Equal(t, "srun --cpu-bind=cores --nodes=2 --nodelist=n[1-2] --ntasks=3 ./wrf.exe", srun.Command("./wrf.exe", 3, alloc))
+		assert.Equal(t, "srun --ntasks=3 ./wrf.exe", mpiman.Srun{}.Command("./wrf.exe", 3, nil))
+
+		assert.Equal(t, "./wrf.exe", mpiman.Local{}.Command("./wrf.exe", 3, alloc))
+	})
+
+	t.Run("NodeSources", func(t *testing.T) {
+		dir := t.TempDir()
+		hostfile := filepath.Join(dir, "hostfile")
+		require.NoError(t, os.WriteFile(hostfile, []byte("# nodes\nwn02 slots=48\n\nwn01 slots=48 # login\n"), 0644))
+		nodefile := filepath.Join(dir, "nodefile")
+		require.NoError(t, os.WriteFile(nodefile, []byte("cn5\ncn5\ncn3\ncn3\n"), 0644))
+
+		t.Setenv("SLURM_NODELIST", "n[1-2]")
+		t.Setenv("PBS_NODEFILE", nodefile)
+		t.Setenv("LSB_MCPU_HOSTS", "h2 4 h1 4")
+		t.Setenv("LSB_HOSTS", "h3 h3")
+
+		for _, tc := range []struct {
+			source mpiman.NodeSource
+			nodes  mpiman.SlurmNodesList
+		}{
+			{mpiman.Slurm{}, mpiman.SlurmNodesList{"n1", "n2"}},
+			{mpiman.PBS{}, mpiman.SlurmNodesList{"cn5", "cn3"}},
+			{mpiman.LSF{}, mpiman.SlurmNodesList{"h2", "h1"}},
+			{mpiman.Hostfile{Path: hostfile}, mpiman.SlurmNodesList{"wn02", "wn01"}},
+			{mpiman.Localhost{}, mpiman.SlurmNodesList{"localhost"}},
+		} {
+			assert.True(t, tc.source.Available(), tc.source.String())
+			nodes, err := tc.source.Nodes()
+			assert.NoError(t, err)
+			assert.Equal(t, tc.nodes, nodes, tc.source.String())
+		}
+		assert.Equal(t, mpiman.Slurm{}, mpiman.DetectNodeSource())
+
+		os.Unsetenv("SLURM_NODELIST")
+		os.Unsetenv("PBS_NODEFILE")
+		assert.Equal(t, mpiman.LSF{}, mpiman.DetectNodeSource())
+
+		os.Unsetenv("LSB_MCPU_HOSTS")
+		nodes, err := mpiman.DiscoverNodes(mpiman.LSF{})
+		assert.NoError(t, err)
+		assert.Equal(t, mpiman.SlurmNodesList{"h3"}, nodes.All())
+
+		os.Unsetenv("LSB_HOSTS")
+		assert.Nil(t, mpiman.DetectNodeSource())
+
+		t.Setenv("LSB_MCPU_HOSTS", "h1 4 h2")
+		_, err = mpiman.LSF{}.Nodes()
+		assert.EqualError(t, err, "cannot parse $LSB_MCPU_HOSTS: hostname `h2` without slots count")
+
+		_, err = mpiman.Hostfile{Path: filepath.Join(dir, "missing")}.Nodes()
+		assert.Error(t, err)
 	})
 
 	t.Run("ParseSlurmHosts", func(t *testing.T) {
@@ -96,4 +294,61 @@ func TestMpiManager(t *testing.T) {
 		_, err = mpiman.ParseSlurmNodes("")
 		assert.EqualError(t, err, "empty hosts list")
 	})
+
+	t.Run("ParseHostlist", func(t *testing.T) {
+		hosts, err := mpiman.ParseHostlist("n[1-2,5,7-8,x,10]")
+		assert.NoError(t, err)
+		assert.Equal(t, mpiman.SlurmNodesList{"n1", "n2", "n5", "n7", "n8", "nx", "n10"}, hosts)
+
+		hosts, err = mpiman.ParseHostlist("rack[1-2]-node[01-02]")
+		assert.NoError(t, err)
+		assert.Equal(t, mpiman.SlurmNodesList{"rack1-node01", "rack1-node02", "rack2-node01", "rack2-node02"}, hosts)
+
+		hosts, err = mpiman.ParseHostlist("node[1-3]-ib,login-01,node2-ib")
+		assert.NoError(t, err)
+		assert.Equal(t, mpiman.SlurmNodesList{"node1-ib", "node2-ib", "node3-ib", "login-01"}, hosts)
+
+		_, err = mpiman.ParseHostlist("n[1-2")
+		assert.Equal(t, mpiman.ParseError{Pos: 1, Src: "n[1-2", Msg: "group not closed"}, err)
+
+		_, err = mpiman.ParseHostlist("n[1-[2]]")
+		assert.EqualError(t, err, "group not closed")
+
+		_, err = mpiman.ParseHostlist("n1-2]")
+		assert.Equal(t, mpiman.ParseError{Pos: 4, Src: "n1-2]", Msg: "unexpected `]` outside of a group"}, err)
+
+		_, err = mpiman.ParseHostlist("n[1,,2]")
+		assert.Equal(t, mpiman.ParseError{Pos: 4, Src: "n[1,,2]", Msg: "empty element in group"}, err)
+
+		_, err = mpiman.ParseHostlist("n[1,4-2]")
+		assert.Equal(t, mpiman.ParseError{Pos: 4, Src: "n[1,4-2]", Msg: "range end is lower than range start"}, err)
+
+		_, err = mpiman.ParseHostlist(",,")
+		assert.EqualError(t, err, "empty hosts list")
+	})
+
+	t.Run("Compress", func(t *testing.T) {
+		assert.Equal(t, "node[01-03,07]", mpiman.SlurmNodesList{"node07", "node02", "node01", "node03"}.Compress())
+		assert.Equal(t, "login,n[9-11]", mpiman.SlurmNodesList{"n9", "n10", "login", "n11"}.Compress())
+		assert.Equal(t, "n[1,01-02]", mpiman.SlurmNodesList{"n1", "n01", "n02"}.Compress())
+		assert.Equal(t, "n3,n1-ib", mpiman.SlurmNodesList{"n1-ib", "n3"}.Compress())
+
+		for _, expr := range []string{
+			"rack[1-2]-node[01-04]",
+			"node[1-3]-ib,login-01,node2-ib",
+			"h[1-4,a,b,06-8]",
+			"n[0001-0100],n[98-120]",
+		} {
+			hosts, err := mpiman.ParseHostlist(expr)
+			require.NoError(t, err)
+			compressed, err := mpiman.ParseHostlist(hosts.Compress())
+			require.NoError(t, err)
+			assert.ElementsMatch(t, hosts, compressed, expr)
+		}
+
+		assert.Equal(t, "rack1-node[01-04],rack2-node[01-04]", mpiman.SlurmNodesList{
+			"rack1-node01", "rack1-node02", "rack1-node03", "rack1-node04",
+			"rack2-node01", "rack2-node02", "rack2-node03", "rack2-node04",
+		}.Compress())
+	})
 }
@@ -0,0 +1,74 @@
+// Package prepvars computes the variables used by templates
+// to describe the period simulated by a run.
+package prepvars
+
+import (
+	"fmt"
+	"math"
+	"time"
+)
+
+var IsoFormat = "2006-01-02_15:00:00"
+var ShortDtFormat = "2006-01-02-15"
+var WindowFormat = "2006-01-02_15:04:05"
+
+// DefaultWindow is the width of the assimilation
+// window used when it's not specified.
+const DefaultWindow = 2 * time.Hour
+
+// Vars returns the variables, indexed by name, for a run
+// from start to end. window is the width of the assimilation
+// window, centered at start: when it's not positive,
+// DefaultWindow is used.
+func Vars(start, end time.Time, window time.Duration) map[string]string {
+	if window <= 0 {
+		window = DefaultWindow
+	}
+	hours := int(math.Round(end.Sub(start).Hours()))
+	vars := map[string]string{
+		"RUN_HOURS":   fmt.Sprintf("%02d", hours),
+		"START_DAY":   fmt.Sprintf("%02d", start.Day()),
+		"START_MONTH": fmt.Sprintf("%02d", start.Month()),
+		"START_YEAR":  fmt.Sprintf("%04d", start.Year()),
+		"START_HOUR":  fmt.Sprintf("%02d", start.Hour()),
+		"ANL_DATE":    start.Format(IsoFormat),
+
+		"WIN_MIN": start.Add(-window / 2).Format(WindowFormat),
+		"WIN_MAX": start.Add(window / 2).Format(WindowFormat),
+
+		"END_DAY":   fmt.Sprintf("%02d", end.Day()),
+		"END_MONTH": fmt.Sprintf("%02d", end.Month()),
+		"END_YEAR":  fmt.Sprintf("%04d", end.Year()),
+		"END_HOUR":  fmt.Sprintf("%02d", end.Hour()),
+	}
+
+	metgridLevels := 34
+	if start.Before(time.Date(2019, time.June, 12, 12, 0, 0, 0, time.UTC)) {
+		metgridLevels = 32
+	}
+	if start.Before(time.Date(2016, time.May, 11, 12, 0, 0, 0, time.UTC)) {
+		metgridLevels = 27
+	}
+	vars["METGRID_LEVELS"] = fmt.Sprintf("%d", metgridLevels)
+
+	if hours > 24 {
+		vars["METGRID_CONSTANTS"] = "constants_name = 'TAVGSFC',"
+	} else {
+		vars["METGRID_CONSTANTS"] = ""
+	}
+
+	// we use an approximation
+	// to calculate season
+	switch start.Month() {
+	case 12, 1, 2:
+		vars["SEASON"] = "winter"
+	case 3, 4, 5:
+		vars["SEASON"] = "spring"
+	case 6, 7, 8:
+		vars["SEASON"] = "summer"
+	case 9, 10, 11:
+		vars["SEASON"] = "fall"
+	}
+
+	return vars
+}
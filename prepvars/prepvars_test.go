@@ -0,0 +1,31 @@
+package prepvars_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/meteocima/ensemble-runner/prepvars"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestVars(t *testing.T) {
+	start := time.Date(2020, time.July, 1, 6, 0, 0, 0, time.UTC)
+	vars := prepvars.Vars(start, start.Add(48*time.Hour), time.Hour)
+
+	assert.Equal(t, "48", vars["RUN_HOURS"])
+	assert.Equal(t, "2020", vars["START_YEAR"])
+	assert.Equal(t, "03", vars["END_DAY"])
+	assert.Equal(t, "06", vars["END_HOUR"])
+	assert.Equal(t, "2020-07-01_06:00:00", vars["ANL_DATE"])
+	assert.Equal(t, "2020-07-01_05:30:00", vars["WIN_MIN"])
+	assert.Equal(t, "2020-07-01_06:30:00", vars["WIN_MAX"])
+	assert.Equal(t, "34", vars["METGRID_LEVELS"])
+	assert.Equal(t, "constants_name = 'TAVGSFC',", vars["METGRID_CONSTANTS"])
+	assert.Equal(t, "summer", vars["SEASON"])
+
+	t.Run("DefaultWindow", func(t *testing.T) {
+		vars := prepvars.Vars(start, start.Add(6*time.Hour), 0)
+		assert.Equal(t, "2020-07-01_05:00:00", vars["WIN_MIN"])
+		assert.Equal(t, "", vars["METGRID_CONSTANTS"])
+	})
+}
@@ -0,0 +1,200 @@
+package server
+
+import (
+	"bufio"
+	"math"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"regexp"
+	"time"
+
+	"github.com/gobwas/glob"
+)
+
+// FailureClass tells whether a
+// failed command is worth retrying.
+type FailureClass int
+
+const (
+	// Transient failures, such as MPI launch errors, node
+	// failures or I/O errors, can succeed when retried.
+	Transient FailureClass = iota
+	// Permanent failures, such as a CFL violation or a
+	// missing input file, happen again when retried.
+	Permanent
+)
+
+func (fc FailureClass) String() string {
+	if fc == Permanent {
+		return "permanent"
+	}
+	return "transient"
+}
+
+// Failure describes a failed attempt to run a command.
+type Failure struct {
+	Cmd string
+	// Dir is the directory where the command ran.
+	Dir string
+	// Logs, when not empty, is a glob matching the names of
+	// the log files of the command, in Dir, and Started is
+	// the time the attempt started, when not zero.
+	Logs    string
+	Started time.Time
+	// ExitCode is the exit status of the command, or -1 when
+	// it was killed by a signal or it could not be started.
+	ExitCode int
+	Err      error
+}
+
+// Classifier returns the class of failure f,
+// together with a description of its cause.
+type Classifier func(f Failure) (class FailureClass, cause string)
+
+// RetryPolicy describes how ExecRetryOn
+// retries the commands that fail.
+type RetryPolicy struct {
+	// Attempts is the maximum number of times
+	// the command is run, including the first one.
+	Attempts int
+	// Backoff is the delay before the first retry, doubled for
+	// every following one, up to MaxBackoff when it's not zero.
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+	// Jitter is the fraction, between 0 and 1, of every delay
+	// that is randomized, so that commands failed together
+	// are not retried all at the same time.
+	Jitter float64
+	// Classify, when not nil, classifies every failure:
+	// permanent failures are not retried.
+	Classify Classifier
+}
+
+// DefaultRetryPolicy returns the policy used by ExecRetry:
+// 5 attempts, with a delay starting from 1 second and up to
+// 1 minute. All failures are retried.
+func DefaultRetryPolicy() RetryPolicy {
+	return RetryPolicy{
+		Attempts:   5,
+		Backoff:    time.Second,
+		MaxBackoff: time.Minute,
+		Jitter:     0.1,
+	}
+}
+
+// Delay returns the time to wait before the
+// retry number retry, starting from 1.
+func (p RetryPolicy) Delay(retry int) time.Duration {
+	delay := float64(p.Backoff) * math.Pow(2, float64(retry-1))
+	if p.MaxBackoff > 0 {
+		delay = min(delay, float64(p.MaxBackoff))
+	}
+	delay *= 1 + p.Jitter*(2*rand.Float64()-1)
+	return time.Duration(delay)
+}
+
+// classify returns the class of f according to p.
+func (p RetryPolicy) classify(f Failure) (FailureClass, string) {
+	if p.Classify == nil {
+		return Transient, ""
+	}
+	return p.Classify(f)
+}
+
+// LogRule classifies the failures of the commands whose
+// log files contain a line matching Pattern.
+type LogRule struct {
+	Class FailureClass
+	// Cause describes the failures matched by the rule.
+	Cause string
+	// Files is a glob matching the names of the
+	// log files, in the directory of the command.
+	Files   string
+	Pattern *regexp.Regexp
+}
+
+// ClassifyLogs returns a Classifier that tries every rule in
+// order: the first one matching the log files of the failure
+// decides its class. Only the log files matching the Logs glob
+// of the failure, and modified after the attempt started, are
+// read, so that logs of other commands, or of previous attempts,
+// are not taken for the ones of the failure. Failures that match
+// no rule are permanent when the command could not be executed
+// or it was not found (exit codes 126 and 127), and transient
+// otherwise.
+func ClassifyLogs(rules ...LogRule) Classifier {
+	globs := make([]glob.Glob, len(rules))
+	for n, rule := range rules {
+		globs[n] = glob.MustCompile(rule.Files)
+	}
+
+	return func(f Failure) (FailureClass, string) {
+		files := failureLogs(f)
+		for n, rule := range rules {
+			for _, file := range files {
+				if globs[n].Match(file) && fileContains(filepath.Join(f.Dir, file), rule.Pattern) {
+					return rule.Class, rule.Cause + " in " + file
+				}
+			}
+		}
+
+		switch f.ExitCode {
+		case 126:
+			return Permanent, "command cannot be executed"
+		case 127:
+			return Permanent, "command not found"
+		}
+		return Transient, ""
+	}
+}
+
+// failureLogs returns the names of the log files of f,
+// in f.Dir, written by the attempt that failed.
+func failureLogs(f Failure) []string {
+	entries, err := os.ReadDir(f.Dir)
+	if err != nil {
+		return nil
+	}
+	var logs glob.Glob
+	if f.Logs != "" {
+		logs = glob.MustCompile(f.Logs)
+	}
+	// modification times can be truncated
+	// to the second by the file system
+	started := f.Started.Truncate(time.Second)
+
+	var files []string
+	for _, entry := range entries {
+		if logs != nil && !logs.Match(entry.Name()) {
+			continue
+		}
+		if !f.Started.IsZero() {
+			info, err := entry.Info()
+			if err != nil || info.ModTime().Before(started) {
+				continue
+			}
+		}
+		files = append(files, entry.Name())
+	}
+	return files
+}
+
+// fileContains returns whether a line
+// of the file at path matches pattern.
+func fileContains(path string, pattern *regexp.Regexp) bool {
+	f, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 1024*1024)
+	for scanner.Scan() {
+		if pattern.Match(scanner.Bytes()) {
+			return true
+		}
+	}
+	return false
+}
@@ -1,6 +1,8 @@
 package server
 
 import (
+	"context"
+	stderrors "errors"
 	"fmt"
 	"io"
 	"io/fs"
@@ -9,12 +11,15 @@ import (
 	pt "path"
 	"path/filepath"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/gobwas/glob"
+	"github.com/meteocima/ensemble-runner/dirprep"
 	"github.com/meteocima/ensemble-runner/errors"
 	"github.com/meteocima/ensemble-runner/folders"
 	"github.com/meteocima/ensemble-runner/log"
+	"github.com/meteocima/ensemble-runner/prepvars"
 )
 
 func MkdirAll(dir string, mod fs.FileMode) {
@@ -33,66 +38,133 @@ func CopyFile(workdir, src, dst string) {
 	errors.Check(os.WriteFile(dst, bytesRead, 0664))
 }
 
-func ExecRetry(cmd, cwd, logto, logsToSave string, envVars ...string) {
-	var err error
+// ExecRetry runs cmd as Exec does, retrying it as described by
+// DefaultRetryPolicy when it fails, unless ctx is done. logsToSave
+// is a glob matching the log files, in cwd, to save with the number
+// of the attempt before a retry overwrites them.
+func ExecRetry(ctx context.Context, cmd, cwd, logto, logsToSave string, envVars ...string) {
+	ExecRetryWith(ctx, cmd, cwd, logto, logsToSave, nil, envVars...)
+}
+
+// ExecRetryWith works like ExecRetry, but calls beforeRetry
+// (when not nil) before every new attempt to run cmd, passing it
+// the number of the retry. beforeRetry can be used to prepare
+// cwd so that the command continues the work done by the
+// previous attempts instead of starting from scratch.
+func ExecRetryWith(ctx context.Context, cmd, cwd, logto, logsToSave string, beforeRetry func(retry int), envVars ...string) {
+	ExecRetryOn(ctx, DefaultRetryPolicy(), func(attempt int) string { return cmd }, cwd, logto, logsToSave, nil, beforeRetry, envVars...)
+}
+
+// ExecRetryOn works like ExecRetryWith, but retries the command
+// as described by policy, and the command to run is returned by
+// cmd, called before every attempt with its number, starting
+// from 0. When not nil, failed is called with the error of every
+// attempt that fails, also the last one and the permanent ones,
+// but not when the command is stopped because ctx is done.
+// Failures are classified reading the log files matching
+// logsToSave written by the attempt, or all the files
+// written by it when logsToSave is empty.
+func ExecRetryOn(ctx context.Context, policy RetryPolicy, cmd func(attempt int) string, cwd, logto, logsToSave string, failed func(err error), beforeRetry func(retry int), envVars ...string) {
 	var g glob.Glob
 	if logsToSave != "" {
 		g = glob.MustCompile(logsToSave)
 	}
 
-	logfn := log.Warning
-	retryS := ""
-	for i := 0; i < 5; i++ {
+	attempts := max(1, policy.Attempts)
+	for i := 0; ; i++ {
+		attemptCmd := cmd(i)
+		started := time.Now()
+		err := tryExec(ctx, attemptCmd, cwd, logto, envVars...)
+		if err == nil {
+			return
+		}
+		if ctx.Err() != nil {
+			// the command was stopped: retrying is useless
+			log.Warning("Command `%s` stopped: %s", attemptCmd, ctx.Err())
+			errors.Check(err)
+		}
+
+		if failed != nil {
+			failed(err)
+		}
 
-		if i == 4 {
-			logfn = log.Error
-			retryS = ""
-		} else {
-			retryS = fmt.Sprintf(" Retry n.%d in 1 minute...", i+1)
+		failure := Failure{Cmd: attemptCmd, Dir: cwd, Logs: logsToSave, Started: started, ExitCode: -1, Err: err}
+		var exitErr *exec.ExitError
+		if stderrors.As(err, &exitErr) {
+			failure.ExitCode = exitErr.ExitCode()
 		}
-		err = tryExec(cmd, cwd, logto, envVars...)
-		if err == nil {
-			break
-		}
-		logfn("Command `%s` has failed: %s.%s\n", cmd, err.Error(), retryS)
-
-		if logsToSave != "" {
-			var files []fs.DirEntry
-			files, err = os.ReadDir(cwd)
-			if err != nil {
-				logfn("Cannot save logs for previous attempt: %s", err.Error())
-			} else {
-				for _, f := range files {
-					if !g.Match(f.Name()) {
-						continue
-					}
-					var input []byte
-					input, err = os.ReadFile(pt.Join(cwd, f.Name()))
-					if err != nil {
-						logfn("Cannot read original log file %s: %s", f.Name(), err.Error())
-						continue
-					}
-
-					destinationFile := fmt.Sprintf("%s.%d", f.Name(), i)
-					err = os.WriteFile(pt.Join(cwd, destinationFile), input, 0644)
-					if err != nil {
-						logfn("Cannot save log file %s to %s: %s", f.Name(), destinationFile, err.Error())
-					}
-
-				}
-			}
+		class, cause := policy.classify(failure)
+		if class == Permanent {
+			log.Error("Command `%s` has failed permanently (%s): %s.\n", attemptCmd, cause, err.Error())
+			errors.FailF("permanent failure (%s): %w", cause, err)
+		}
+		if i == attempts-1 {
+			log.Error("Command `%s` has failed: %s.\n", attemptCmd, err.Error())
+			errors.Check(err)
 		}
 
-		time.Sleep(1 * time.Second)
+		delay := policy.Delay(i + 1)
+		if cause != "" {
+			cause = " (" + cause + ")"
+		}
+		log.Warning("Command `%s` has failed%s: %s. Retry n.%d in %s...\n", attemptCmd, cause, err.Error(), i+1, delay.Round(time.Second))
+		if g != nil {
+			saveLogs(cwd, g, i)
+		}
+
+		select {
+		case <-ctx.Done():
+			errors.FailF("command `%s` not retried: %w", attemptCmd, ctx.Err())
+		case <-time.After(delay):
+		}
+
+		if beforeRetry != nil {
+			beforeRetry(i + 1)
+		}
+	}
+}
+
+// saveLogs saves a copy of the log files in cwd matching
+// g, adding to their name the number of the attempt.
+func saveLogs(cwd string, g glob.Glob, attempt int) {
+	files, err := os.ReadDir(cwd)
+	if err != nil {
+		log.Warning("Cannot save logs for previous attempt: %s", err.Error())
+		return
+	}
+	for _, f := range files {
+		if !g.Match(f.Name()) {
+			continue
+		}
+		input, err := os.ReadFile(pt.Join(cwd, f.Name()))
+		if err != nil {
+			log.Warning("Cannot read original log file %s: %s", f.Name(), err.Error())
+			continue
+		}
+
+		destinationFile := fmt.Sprintf("%s.%d", f.Name(), attempt)
+		if err := os.WriteFile(pt.Join(cwd, destinationFile), input, 0644); err != nil {
+			log.Warning("Cannot save log file %s to %s: %s", f.Name(), destinationFile, err.Error())
+		}
 	}
-	errors.Check(err)
 }
 
-func Exec(cmd, cwd, logto string, envVars ...string) {
-	errors.Check(tryExec(cmd, cwd, logto, envVars...))
+// Exec runs cmd using bash in cwd, writing its output to the file
+// logto in cwd, when not empty. envVars contains pairs of name and
+// value of environment variables to add to the ones of the process.
+//
+// The command runs in its own process group: when ctx is done, all
+// the processes of the group are sent SIGTERM, and then SIGKILL
+// if they are still running after KillDelay.
+func Exec(ctx context.Context, cmd, cwd, logto string, envVars ...string) {
+	errors.Check(tryExec(ctx, cmd, cwd, logto, envVars...))
 }
 
-func tryExec(cmd, cwd, logto string, envVars ...string) error {
+// KillDelay is the time processes of a command are given to
+// terminate after SIGTERM, before they are killed with SIGKILL.
+var KillDelay = 30 * time.Second
+
+func tryExec(ctx context.Context, cmd, cwd, logto string, envVars ...string) error {
 	var log *os.File
 	if logto != "" {
 
@@ -108,9 +180,20 @@ func tryExec(cmd, cwd, logto string, envVars ...string) error {
 		cwd = errors.CheckResult(filepath.Abs(cwd))
 	}
 
-	c := exec.Command("bash", "-c", cmd)
+	c := exec.CommandContext(ctx, "bash", "-c", cmd)
 	c.Dir = cwd
 	c.Stdout = log
+	c.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	// kill is stopped when the command completes, so that
+	// the process group id is not reused by then.
+	var kill *time.Timer
+	c.Cancel = func() error {
+		pgid := c.Process.Pid
+		kill = time.AfterFunc(KillDelay, func() {
+			syscall.Kill(-pgid, syscall.SIGKILL)
+		})
+		return syscall.Kill(-pgid, syscall.SIGTERM)
+	}
 
 	if len(envVars) > 0 {
 		env := os.Environ()
@@ -129,11 +212,12 @@ func tryExec(cmd, cwd, logto string, envVars ...string) error {
 	}
 
 	var stderrChuncks []string
+	stderrRead := make(chan struct{})
 	go func() {
+		defer close(stderrRead)
 		var buf [1024]byte
-		var n int
 		for {
-			n, err = stderrPipe.Read(buf[:])
+			n, err := stderrPipe.Read(buf[:])
 
 			if err == io.EOF {
 				err = nil
@@ -152,7 +236,26 @@ func tryExec(cmd, cwd, logto string, envVars ...string) error {
 		}
 	}()
 
-	if err = c.Run(); err != nil {
+	// stderr must be read completely before waiting for the
+	// command, because Wait closes the pipe.
+	if err = c.Start(); err == nil {
+		<-stderrRead
+		err = c.Wait()
+	}
+	if kill != nil {
+		kill.Stop()
+	}
+	if err != nil && ctx.Err() != nil {
+		return fmt.Errorf(
+			"command stopped:\n"+
+				"    => cmd: %s\n"+
+				"    => wdir: %s\n"+
+				"    => err: %w\n"+
+				"    ==",
+			cmd, cwd, ctx.Err(),
+		)
+	}
+	if err != nil {
 		return fmt.Errorf(
 			"command failed:\n"+
 				"    => cmd: %s\n"+
@@ -166,23 +269,46 @@ func tryExec(cmd, cwd, logto string, envVars ...string) error {
 	return nil
 }
 
-func RenderTemplate(targetDir, name string, startDate time.Time, durationHours int) {
+// RenderTemplate renders the template directory `name` into targetDir,
+// for a run starting at startDate and lasting durationHours, with an
+// assimilation window of width window, replacing targetDir only
+// when rendering succeeds and the namelists rendered are valid.
+//
+// Templates can use the variables returned by TemplateVars.
+// Rendering fails if a template refers to any other variable,
+// or if the namelists rendered are not valid.
+func RenderTemplate(targetDir, name string, startDate time.Time, durationHours int, window time.Duration, envVars ...string) {
 	defer errors.OnFailuresWrap("cannot render template directory `%s` to `%s`: %w", name, targetDir)
-	Exec(fmt.Sprintf(`
-export START_DATE=%s 
-export END_DATE=%s
-export FORECAST_DURATION=%d
-eval $(prepvars)
-rm -rf %s
-dirprep --strict %s/%s %s`,
-		startDate.Format("2006-01-02-15"),
-		startDate.Add(time.Duration(durationHours)*time.Hour).Format("2006-01-02-15"),
-		durationHours,
-		targetDir,
-		folders.TemplatesDir,
-		name,
-		targetDir,
-	), folders.Rootdir, "")
+	vars := TemplateVars(startDate, durationHours, window, envVars...)
+	errors.Check(dirprep.RenderDirChecked(filepath.Join(folders.TemplatesDir, name), targetDir, vars, dirprep.CheckNamelists))
+}
+
+// TemplateVars returns the variables available to templates, indexed
+// by name, for a run starting at startDate and lasting durationHours,
+// with an assimilation window of width window. They are the
+// environment variables of the process, the ones in envVars, which
+// contains pairs of name and value, and the ones describing the
+// run: START_DATE, END_DATE, FORECAST_DURATION and the ones
+// returned by prepvars.Vars.
+func TemplateVars(startDate time.Time, durationHours int, window time.Duration, envVars ...string) map[string]string {
+	vars := map[string]string{}
+	for _, env := range os.Environ() {
+		if name, val, ok := strings.Cut(env, "="); ok {
+			vars[name] = val
+		}
+	}
+	for i := 1; i < len(envVars); i += 2 {
+		vars[envVars[i-1]] = envVars[i]
+	}
+
+	endDate := startDate.Add(time.Duration(durationHours) * time.Hour)
+	vars["START_DATE"] = startDate.Format(prepvars.ShortDtFormat)
+	vars["END_DATE"] = endDate.Format(prepvars.ShortDtFormat)
+	vars["FORECAST_DURATION"] = fmt.Sprintf("%d", durationHours)
+	for name, val := range prepvars.Vars(startDate, endDate, window) {
+		vars[name] = val
+	}
+	return vars
 }
 
 func DirExists(directory string) bool {
@@ -0,0 +1,147 @@
+package server_test
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/meteocima/ensemble-runner/errors"
+	"github.com/meteocima/ensemble-runner/server"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// execRetry runs server.ExecRetry, returning its failure.
+func execRetry(ctx context.Context, cmd, cwd string) (err error) {
+	defer errors.OnFailuresSet(&err)
+	server.ExecRetry(ctx, cmd, cwd, "cmd.log", "cmd.log")
+	return nil
+}
+
+// childRunning returns whether the process whose
+// pid was written in file by the command is running.
+func childRunning(t *testing.T, file string) bool {
+	content, err := os.ReadFile(file)
+	require.NoError(t, err)
+	pid, err := strconv.Atoi(strings.TrimSpace(string(content)))
+	require.NoError(t, err)
+	return syscall.Kill(pid, 0) == nil
+}
+
+func TestExec(t *testing.T) {
+	server.KillDelay = 200 * time.Millisecond
+
+	t.Run("Succeeds", func(t *testing.T) {
+		dir := t.TempDir()
+		assert.NoError(t, execRetry(context.Background(), "echo done", dir))
+		log, err := os.ReadFile(filepath.Join(dir, "cmd.log"))
+		require.NoError(t, err)
+		assert.Equal(t, "done\n", string(log))
+	})
+
+	t.Run("StopsProcessGroup", func(t *testing.T) {
+		dir := t.TempDir()
+		ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+		defer cancel()
+
+		started := time.Now()
+		err := execRetry(ctx, "sleep 30 & echo $! > child.pid; wait", dir)
+		assert.ErrorIs(t, err, context.DeadlineExceeded)
+		assert.Less(t, time.Since(started), 5*time.Second)
+		assert.Eventually(t, func() bool {
+			return !childRunning(t, filepath.Join(dir, "child.pid"))
+		}, 2*time.Second, 50*time.Millisecond)
+	})
+
+	t.Run("KillsProcessesIgnoringSIGTERM", func(t *testing.T) {
+		dir := t.TempDir()
+		ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+		defer cancel()
+
+		err := execRetry(ctx, "trap '' TERM; sleep 30 & echo $! > child.pid; wait", dir)
+		assert.ErrorIs(t, err, context.DeadlineExceeded)
+		// the group is killed KillDelay after SIGTERM
+		assert.Eventually(t, func() bool {
+			return !childRunning(t, filepath.Join(dir, "child.pid"))
+		}, 2*time.Second, 50*time.Millisecond)
+	})
+}
+
+func TestExecRetry(t *testing.T) {
+	// attempts returns the number of times cmd was run in dir
+	attempts := func(t *testing.T, dir string) int {
+		content, err := os.ReadFile(filepath.Join(dir, "attempts"))
+		require.NoError(t, err)
+		return len(content)
+	}
+	execPolicy := func(policy server.RetryPolicy, cmd, dir string) (err error) {
+		defer errors.OnFailuresSet(&err)
+		server.ExecRetryOn(context.Background(), policy, func(int) string { return cmd }, dir, "cmd.log", "", nil, nil)
+		return nil
+	}
+	classify := server.ClassifyLogs(server.LogRule{
+		Class:   server.Permanent,
+		Cause:   "CFL violation",
+		Files:   "*.log",
+		Pattern: regexp.MustCompile(`points exceeded cfl`),
+	})
+	policy := server.RetryPolicy{Attempts: 3, Backoff: time.Millisecond, Classify: classify}
+
+	t.Run("RetriesTransientFailures", func(t *testing.T) {
+		dir := t.TempDir()
+		err := execPolicy(policy, "echo -n . >> attempts; exit 1", dir)
+		assert.Error(t, err)
+		assert.Equal(t, 3, attempts(t, dir))
+	})
+
+	t.Run("StopsOnPermanentFailures", func(t *testing.T) {
+		dir := t.TempDir()
+		err := execPolicy(policy, "echo -n . >> attempts; echo '2 points exceeded cfl=2'; exit 1", dir)
+		assert.ErrorContains(t, err, "permanent failure (CFL violation in cmd.log)")
+		assert.Equal(t, 1, attempts(t, dir))
+	})
+
+	t.Run("CommandNotFoundIsPermanent", func(t *testing.T) {
+		dir := t.TempDir()
+		err := execPolicy(policy, "echo -n . >> attempts; ./missing.exe", dir)
+		assert.ErrorContains(t, err, "permanent failure (command not found)")
+		assert.Equal(t, 1, attempts(t, dir))
+	})
+
+	t.Run("ReportsEveryFailure", func(t *testing.T) {
+		for cmd, expected := range map[string]int{
+			"exit 1":                                 3,
+			"echo '2 points exceeded cfl=2'; exit 1": 1,
+		} {
+			dir := t.TempDir()
+			failures := 0
+			err := func() (err error) {
+				defer errors.OnFailuresSet(&err)
+				server.ExecRetryOn(context.Background(), policy, func(int) string { return cmd }, dir, "cmd.log", "", func(error) { failures++ }, nil)
+				return nil
+			}()
+			assert.Error(t, err)
+			assert.Equal(t, expected, failures, cmd)
+		}
+	})
+
+	t.Run("Delay", func(t *testing.T) {
+		policy := server.RetryPolicy{Backoff: time.Second, MaxBackoff: 5 * time.Second}
+		assert.Equal(t, time.Second, policy.Delay(1))
+		assert.Equal(t, 4*time.Second, policy.Delay(3))
+		assert.Equal(t, 5*time.Second, policy.Delay(4))
+
+		policy.Jitter = 0.5
+		for range 10 {
+			delay := policy.Delay(2)
+			assert.GreaterOrEqual(t, delay, time.Second)
+			assert.LessOrEqual(t, delay, 3*time.Second)
+		}
+	})
+}
@@ -0,0 +1,210 @@
+package simulation
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/meteocima/ensemble-runner/arguments"
+	"github.com/meteocima/ensemble-runner/conf"
+	"github.com/meteocima/ensemble-runner/errors"
+	"github.com/meteocima/ensemble-runner/folders"
+	"github.com/meteocima/ensemble-runner/log"
+	"github.com/meteocima/ensemble-runner/mpiman"
+)
+
+// DateRun is a date to simulate, together
+// with the configuration to use for it.
+type DateRun struct {
+	arguments.Run
+	Conf *conf.Config
+}
+
+// DateResult contains the outcome of
+// the simulation of a single date.
+type DateResult struct {
+	Run arguments.Run
+	// Nodes contains the nodes of the pool
+	// the simulation of the date ran on.
+	Nodes mpiman.SlurmNodesList
+	// Elapsed is the time spent running the simulation.
+	Elapsed time.Duration
+	// MembersFailed is the number of members
+	// of the forecast that failed to run.
+	MembersFailed int
+	// Err is the failure that stopped
+	// the simulation, or nil if it completed.
+	Err error
+}
+
+// RunForecastsFromInputs runs the simulation of every date
+// read from `arguments.txt`, as described in RunDates, and
+// logs a summary of the results. It fails when the simulation
+// of one or more dates fails.
+//
+// The configuration of every date, which can be changed by
+// the options in `arguments.txt`, is checked before any
+// date is run. Simulations are stopped when ctx is done.
+func RunForecastsFromInputs(ctx context.Context, cfg *conf.Config, opts Options) {
+	nodes := discoverNodes(cfg, opts)
+
+	argfilePath := filepath.Join(folders.WPSOutputsRootDir(), "arguments.txt")
+	args := errors.CheckResult(arguments.ReadFile(argfilePath))
+	var runs []DateRun
+	checked := map[*conf.Config]bool{}
+	for _, run := range args.Runs {
+		runCfg, err := cfg.ForRun(run)
+		if err != nil {
+			errors.FailF("%s:%d: %w", argfilePath, run.Line, err)
+		}
+		if !checked[runCfg] {
+			checked[runCfg] = true
+			if err := checkEnvironment(runCfg, opts); err != nil {
+				errors.FailF("%s:%d: %w", argfilePath, run.Line, err)
+			}
+		}
+		runs = append(runs, DateRun{Run: run, Conf: runCfg})
+	}
+
+	if err := CheckDates(cfg.DateParallelism, runs); err != nil {
+		errors.FailF("%s: %w", argfilePath, err)
+	}
+
+	results := RunDates(ctx, cfg.DateParallelism, opts, runs, nodes, (*Simulation).run)
+	if opts.Plan {
+		return
+	}
+
+	var summary strings.Builder
+	PrintSummary(&summary, results)
+	log.Info("Summary of the simulations:")
+	for _, line := range strings.Split(strings.TrimSuffix(summary.String(), "\n"), "\n") {
+		log.Info("  %s", line)
+	}
+
+	failed := 0
+	for _, res := range results {
+		if res.Err != nil {
+			failed++
+		}
+	}
+	if failed > 0 {
+		errors.FailF("simulation failed for %d of %d dates", failed, len(results))
+	}
+}
+
+// CheckDates returns an error when runs contains dates that
+// could run concurrently, with parallelism greater than 1, on
+// the same day: they would share the inputs directory of the
+// day, overwriting each other's initial and boundary conditions.
+func CheckDates(parallelism int, runs []DateRun) error {
+	if parallelism <= 1 {
+		return nil
+	}
+	days := map[string]arguments.Run{}
+	for _, run := range runs {
+		dir := folders.WPSOutputsDir(run.Start)
+		if prev, ok := days[dir]; ok {
+			return fmt.Errorf(
+				"line %d: %s is on the same day of %s, at line %d, and they would both use %s: they cannot run with DateParallelism %d",
+				run.Line, run.Start.Format(ShortDtFormat), prev.Start.Format(ShortDtFormat), prev.Line, dir, parallelism,
+			)
+		}
+		days[dir] = run.Run
+	}
+	return nil
+}
+
+// RunDates runs the simulation of every date in runs, calling
+// simulate, and returns their results in the same order of runs.
+//
+// Up to parallelism dates run concurrently. nodes is split
+// in as many disjoint pools, and every date runs using only the
+// nodes of its pool. A failure of the simulation of a date does
+// not stop the other ones.
+//
+// When only the plan of the simulations is requested, dates
+// are planned one after another, each with the pool it
+// would run on.
+func RunDates(ctx context.Context, parallelism int, opts Options, runs []DateRun, nodes mpiman.SlurmNodes, simulate func(sim *Simulation) (membersFailed int)) []DateResult {
+	parallelism = max(1, min(parallelism, len(runs)))
+	pools := nodes.Partition(parallelism)
+	results := make([]DateResult, len(runs))
+
+	if opts.Plan {
+		for n, run := range runs {
+			results[n] = runDate(ctx, opts, run, pools[n%parallelism], simulate)
+		}
+		return results
+	}
+
+	queue := make(chan int)
+	var wg sync.WaitGroup
+	for _, pool := range pools {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for n := range queue {
+				results[n] = runDate(ctx, opts, runs[n], pool, simulate)
+			}
+		}()
+	}
+	for n := range runs {
+		queue <- n
+	}
+	close(queue)
+	wg.Wait()
+
+	return results
+}
+
+// runDate runs the simulation of run on the
+// nodes of pool, recovering from its failures.
+func runDate(ctx context.Context, opts Options, run DateRun, pool mpiman.SlurmNodes, simulate func(sim *Simulation) int) (res DateResult) {
+	res.Run = run.Run
+	res.Nodes = pool.All()
+	started := time.Now()
+	defer func() {
+		res.Elapsed = time.Since(started)
+		if res.Err != nil {
+			log.Error("Simulation from %s failed: %s", run.Start.Format(ShortDtFormat), res.Err)
+		}
+	}()
+	defer errors.OnFailuresSet(&res.Err)
+
+	if !opts.Plan {
+		log.Info("Simulation from %s runs on nodes %s", run.Start.Format(ShortDtFormat), res.Nodes.Compress())
+	}
+	sim := new(ctx, run.Conf, run.Start, run.Duration, pool, opts)
+	res.MembersFailed = simulate(&sim)
+	return res
+}
+
+// PrintSummary writes to w a table with
+// the outcome of the simulation of every date.
+func PrintSummary(w io.Writer, results []DateResult) {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "DATE\tHOURS\tNODES\tELAPSED\tRESULT")
+	for _, res := range results {
+		result := "succeeded"
+		if res.Err != nil {
+			msg, _, _ := strings.Cut(res.Err.Error(), "\n")
+			result = "failed: " + msg
+		} else if res.MembersFailed > 0 {
+			result = fmt.Sprintf("succeeded, %d members failed", res.MembersFailed)
+		}
+		fmt.Fprintf(tw, "%s\t%.0f\t%d\t%s\t%s\n",
+			res.Run.Start.Format(ShortDtFormat),
+			res.Run.Duration.Hours(),
+			len(res.Nodes),
+			res.Elapsed.Round(time.Second),
+			result,
+		)
+	}
+	tw.Flush()
+}
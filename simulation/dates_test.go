@@ -0,0 +1,103 @@
+package simulation_test
+
+import (
+	"bytes"
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/meteocima/ensemble-runner/arguments"
+	"github.com/meteocima/ensemble-runner/conf"
+	"github.com/meteocima/ensemble-runner/errors"
+	"github.com/meteocima/ensemble-runner/folders"
+	"github.com/meteocima/ensemble-runner/mpiman"
+	"github.com/meteocima/ensemble-runner/simulation"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRunDates(t *testing.T) {
+	folders.WorkDir = "/rootdir/workdir"
+	cfg := &conf.Config{}
+	day := func(d int) simulation.DateRun {
+		return simulation.DateRun{
+			Run: arguments.Run{
+				Start:    time.Date(2020, 11, d, 0, 0, 0, 0, time.UTC),
+				Duration: 24 * time.Hour,
+			},
+			Conf: cfg,
+		}
+	}
+	runs := []simulation.DateRun{day(25), day(26), day(27), day(28)}
+
+	nodes, err := mpiman.ParseSlurmNodes("n[1-5]")
+	require.NoError(t, err)
+
+	var mu sync.Mutex
+	running := map[string]bool{}
+	workdirs := map[string]bool{}
+	results := simulation.RunDates(context.Background(), 2, simulation.Options{}, runs, nodes, func(sim *simulation.Simulation) int {
+		mu.Lock()
+		for _, node := range sim.Nodes.All() {
+			assert.False(t, running[node], "node %s used by two dates at the same time", node)
+			running[node] = true
+		}
+		workdirs[sim.Workdir] = true
+		assert.Same(t, cfg, sim.Conf)
+		mu.Unlock()
+
+		time.Sleep(10 * time.Millisecond)
+
+		mu.Lock()
+		for _, node := range sim.Nodes.All() {
+			running[node] = false
+		}
+		mu.Unlock()
+
+		switch sim.Start.Day() {
+		case 26:
+			errors.FailF("real failed")
+		case 27:
+			return 2
+		}
+		return 0
+	})
+
+	require.Len(t, results, 4)
+	assert.Len(t, workdirs, 4)
+	for n, res := range results {
+		assert.Equal(t, runs[n].Run, res.Run)
+		assert.Contains(t, []mpiman.SlurmNodesList{{"n1", "n2", "n3"}, {"n4", "n5"}}, res.Nodes)
+	}
+	assert.NoError(t, results[0].Err)
+	assert.EqualError(t, results[1].Err, "real failed")
+	assert.Equal(t, 2, results[2].MembersFailed)
+	assert.NoError(t, results[3].Err)
+
+	var buf bytes.Buffer
+	simulation.PrintSummary(&buf, results)
+	lines := bytes.Split(bytes.TrimSpace(buf.Bytes()), []byte("\n"))
+	require.Len(t, lines, 5)
+	assert.Regexp(t, `^DATE +HOURS +NODES +ELAPSED +RESULT$`, string(lines[0]))
+	assert.Regexp(t, `^2020-11-25-00 +24 +[23] +\S+ +succeeded$`, string(lines[1]))
+	assert.Regexp(t, `^2020-11-26-00 +24 +[23] +\S+ +failed: real failed$`, string(lines[2]))
+	assert.Regexp(t, `^2020-11-27-00 +24 +[23] +\S+ +succeeded, 2 members failed$`, string(lines[3]))
+}
+
+func TestCheckDates(t *testing.T) {
+	folders.Rootdir = "/rootdir"
+	at := func(line, day, hour int) simulation.DateRun {
+		return simulation.DateRun{Run: arguments.Run{
+			Start:    time.Date(2020, 11, day, hour, 0, 0, 0, time.UTC),
+			Duration: 12 * time.Hour,
+			Line:     line,
+		}}
+	}
+	runs := []simulation.DateRun{at(1, 25, 0), at(2, 26, 0), at(3, 25, 12)}
+
+	assert.NoError(t, simulation.CheckDates(1, runs))
+	assert.NoError(t, simulation.CheckDates(2, runs[:2]))
+	assert.EqualError(t, simulation.CheckDates(2, runs),
+		"line 3: 2020-11-25-12 is on the same day of 2020-11-25-00, at line 1, and they would both use /rootdir/inputs/20201125: they cannot run with DateParallelism 2")
+}
@@ -0,0 +1,85 @@
+package simulation
+
+import (
+	"regexp"
+
+	"github.com/meteocima/ensemble-runner/conf"
+	"github.com/meteocima/ensemble-runner/server"
+)
+
+// logFiles is a glob matching the log files written by
+// the WPS, WRF and WRFDA processes and by their launchers.
+// Only the ones of the failed process, written by the
+// failed attempt, are read: see server.ClassifyLogs.
+const logFiles = "{*.log,*.log.????,rsl.error.????}"
+
+// failureRules classify the failures of the processes of the
+// simulation. Transient failures come first, since a failure
+// of the infrastructure can make a process report errors that
+// would otherwise be permanent.
+var failureRules = []server.LogRule{
+	{
+		Class:   server.Transient,
+		Cause:   "MPI launch error",
+		Files:   logFiles,
+		Pattern: regexp.MustCompile(`(?i)(ORTE was unable to|ORTE has lost communication|mpirun was unable to|HYDU_\w+|PMIX ERROR|unable to launch|failed to start daemon)`),
+	},
+	{
+		Class:   server.Transient,
+		Cause:   "node failure",
+		Files:   logFiles,
+		Pattern: regexp.MustCompile(`(?i)(node failure|ssh: connect to host|no route to host|connection (refused|reset|timed out)|lost connection)`),
+	},
+	{
+		Class:   server.Transient,
+		Cause:   "I/O error",
+		Files:   logFiles,
+		Pattern: regexp.MustCompile(`(?i)(input/output error|stale file handle|transport endpoint is not connected)`),
+	},
+	{
+		Class:   server.Permanent,
+		Cause:   "CFL violation",
+		Files:   logFiles,
+		Pattern: regexp.MustCompile(`(?i)points exceeded cfl`),
+	},
+	{
+		Class:   server.Permanent,
+		Cause:   "missing input file",
+		Files:   logFiles,
+		Pattern: regexp.MustCompile(`(?i)(error opening \S+ for reading|could not open (input )?file \S+|(input|met_em|wrfinput|wrfbdy)\S* file \S+ (does not exist|not found))`),
+	},
+}
+
+// ClassifyFailure classifies the failures of the processes
+// of the simulation, looking for known errors in their logs.
+var ClassifyFailure = server.ClassifyLogs(failureRules...)
+
+// RetryPolicy returns the policy used to retry the process
+// `name` (one of conf.Processes) when it fails: the values
+// omitted by the configuration of its retries are the ones
+// of server.DefaultRetryPolicy, and failures are classified
+// by ClassifyFailure.
+func RetryPolicy(cfg *conf.Config, name string) server.RetryPolicy {
+	rc := cfg.Retry(name)
+	policy := server.DefaultRetryPolicy()
+	if rc.Attempts != nil {
+		policy.Attempts = *rc.Attempts
+	}
+	if rc.Backoff != nil {
+		policy.Backoff = *rc.Backoff
+	}
+	if rc.MaxBackoff != nil {
+		policy.MaxBackoff = *rc.MaxBackoff
+	}
+	if rc.Jitter != nil {
+		policy.Jitter = *rc.Jitter
+	}
+	policy.Classify = ClassifyFailure
+	return policy
+}
+
+// retryPolicy returns the policy used to retry the process
+// `name` (one of conf.Processes) when it fails.
+func (s *Simulation) retryPolicy(name string) server.RetryPolicy {
+	return RetryPolicy(s.Conf, name)
+}
@@ -0,0 +1,118 @@
+package simulation_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/meteocima/ensemble-runner/conf"
+	"github.com/meteocima/ensemble-runner/server"
+	"github.com/meteocima/ensemble-runner/simulation"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestClassifyFailure(t *testing.T) {
+	classify := func(t *testing.T, exitCode int, files map[string]string) (server.FailureClass, string) {
+		dir := t.TempDir()
+		for name, content := range files {
+			require.NoError(t, os.WriteFile(filepath.Join(dir, name), []byte(content), 0644))
+		}
+		return simulation.ClassifyFailure(server.Failure{Cmd: "mpirun ./wrf.exe", Dir: dir, ExitCode: exitCode})
+	}
+
+	t.Run("CFL", func(t *testing.T) {
+		class, cause := classify(t, 1, map[string]string{
+			"rsl.error.0000":   "Timing for main: time 2020-12-25_00:01:00 on domain 1\n",
+			"rsl.error.0003":   "d01 2020-12-25_00:02:00 5 points exceeded cfl=2 in domain d01\n",
+			"rsl.error.0003.0": "ORTE was unable to reliably start one or more daemons\n",
+		})
+		assert.Equal(t, server.Permanent, class)
+		assert.Equal(t, "CFL violation in rsl.error.0003", cause)
+	})
+
+	t.Run("MissingInput", func(t *testing.T) {
+		class, cause := classify(t, 1, map[string]string{
+			"rsl.error.0000": "---- ERROR: error opening wrfinput_d01 for reading ierr=  -1021\n",
+		})
+		assert.Equal(t, server.Permanent, class)
+		assert.Equal(t, "missing input file in rsl.error.0000", cause)
+	})
+
+	t.Run("NodeFailure", func(t *testing.T) {
+		class, cause := classify(t, 1, map[string]string{
+			"wrf.detail.log": "ssh: connect to host n12 port 22: Connection timed out\nerror opening wrfinput_d01\n",
+		})
+		assert.Equal(t, server.Transient, class)
+		assert.Equal(t, "node failure in wrf.detail.log", cause)
+	})
+
+	t.Run("OnlyLogsOfTheAttempt", func(t *testing.T) {
+		dir := t.TempDir()
+		write := func(name, content string, modified time.Time) {
+			path := filepath.Join(dir, name)
+			require.NoError(t, os.WriteFile(path, []byte(content), 0644))
+			require.NoError(t, os.Chtimes(path, modified, modified))
+		}
+		started := time.Now()
+		// logs of other processes in the same directory, and of previous runs
+		write("ungrib.log", "Could not open file GRIBFILE.AAA\n", started.Add(time.Second))
+		write("rsl.error.0000", "---- ERROR: error opening wrfinput_d01 for reading\n", started.Add(-time.Hour))
+		write("rsl.error.0001", "Timing for main\n", started.Add(time.Second))
+
+		class, cause := simulation.ClassifyFailure(server.Failure{
+			Cmd:      "mpirun ./real.exe",
+			Dir:      dir,
+			Logs:     "{real.detail.log,rsl.out.????,rsl.error.????}",
+			Started:  started,
+			ExitCode: 1,
+		})
+		assert.Equal(t, server.Transient, class)
+		assert.Empty(t, cause)
+	})
+
+	t.Run("NoSuchFileIsTransient", func(t *testing.T) {
+		class, _ := classify(t, 1, map[string]string{
+			"wrf.detail.log": "cat: /shared/scratch/tmp.1: No such file or directory\n",
+		})
+		assert.Equal(t, server.Transient, class)
+	})
+
+	t.Run("Unknown", func(t *testing.T) {
+		class, _ := classify(t, 139, map[string]string{"wrf.detail.log": "Segmentation fault\n"})
+		assert.Equal(t, server.Transient, class)
+		class, cause := classify(t, 127, nil)
+		assert.Equal(t, server.Permanent, class)
+		assert.Equal(t, "command not found", cause)
+	})
+}
+
+func TestRetryPolicy(t *testing.T) {
+	ptr := func(v time.Duration) *time.Duration { return &v }
+	attempts, jitter := 3, 0.0
+	cfg := &conf.Config{Retries: map[string]conf.RetryConfig{
+		"default": {Attempts: &attempts},
+		"wrf":     {Backoff: ptr(time.Minute)},
+		"real":    {Backoff: ptr(0), MaxBackoff: ptr(0), Jitter: &jitter},
+	}}
+	wrf := simulation.RetryPolicy(cfg, "wrf")
+	assert.Equal(t, 3, wrf.Attempts)
+	assert.Equal(t, time.Minute, wrf.Backoff)
+	assert.Equal(t, server.DefaultRetryPolicy().MaxBackoff, wrf.MaxBackoff)
+	assert.Equal(t, server.DefaultRetryPolicy().Jitter, wrf.Jitter)
+	assert.NotNil(t, wrf.Classify)
+
+	metgrid := simulation.RetryPolicy(cfg, "metgrid")
+	assert.Equal(t, 3, metgrid.Attempts)
+	assert.Equal(t, server.DefaultRetryPolicy().Backoff, metgrid.Backoff)
+
+	t.Run("ExplicitZeros", func(t *testing.T) {
+		real := simulation.RetryPolicy(cfg, "real")
+		assert.Equal(t, 3, real.Attempts)
+		assert.Zero(t, real.Backoff)
+		assert.Zero(t, real.MaxBackoff)
+		assert.Zero(t, real.Jitter)
+		assert.Zero(t, real.Delay(3))
+	})
+}
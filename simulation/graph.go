@@ -0,0 +1,514 @@
+package simulation
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/meteocima/ensemble-runner/errors"
+	"github.com/meteocima/ensemble-runner/log"
+	"github.com/meteocima/ensemble-runner/mpiman"
+)
+
+// StepKind identifies the kind of action
+// performed by a Step of the workflow.
+type StepKind int
+
+const (
+	// RenderStep renders a template directory.
+	RenderStep StepKind = iota
+	// MkdirStep creates a directory.
+	MkdirStep
+	// CopyStep copies a single file.
+	CopyStep
+	// ProcessStep runs one of the WPS, WRF or WRFDA executables.
+	ProcessStep
+	// ForecastStep runs wrf.exe for the control forecast
+	// or for one of the ensemble members.
+	ForecastStep
+)
+
+var stepKindNames = []string{
+	"render",
+	"mkdir",
+	"copy",
+	"process",
+	"forecast",
+}
+
+func (sk StepKind) String() string {
+	if sk < 0 || int(sk) >= len(stepKindNames) {
+		return "unknown"
+	}
+	return stepKindNames[sk]
+}
+
+// Step is a single action of the simulation workflow.
+//
+// A step declares the files it reads (Inputs), the files
+// or directories it writes (Outputs) and the directory
+// where it works. The Graph uses these declarations to
+// compute the dependencies between steps.
+type Step struct {
+	ID      string
+	Kind    StepKind
+	Workdir string
+	Inputs  []string
+	Outputs []string
+	// Procs is the number of MPI processes used
+	// by the step, or 0 if the step does not use MPI.
+	Procs int
+	// Priority orders the steps waiting for cores:
+	// the ones with higher priority are given cores first.
+	Priority int
+	// Run performs the action of the step, on the cores
+	// allocated to it. The allocation is empty when the
+	// step does not use MPI or when no nodes are allocated,
+	// as when only the plan is printed. Run fails using
+	// the errors package.
+	Run func(alloc mpiman.Allocation)
+	// Describe, when not nil, returns a human readable
+	// description of the action performed by Run on alloc.
+	Describe func(alloc mpiman.Allocation) string
+
+	deps []int
+}
+
+// Graph is a directed acyclic graph of the steps
+// needed to complete a simulation.
+//
+// Steps must be added in an order in which they could
+// run sequentially: a step depends on the last step that
+// wrote each one of its inputs or its workdir (or one of
+// their parent directories), on the last step that wrote
+// each one of its outputs or a file inside them, and on
+// every step that read one of its outputs, or a file
+// inside them, after that last write.
+type Graph struct {
+	Steps []*Step
+	// Journal, when not nil, is used to record every
+	// step completed, and to skip the steps already
+	// completed by a previous run.
+	Journal *Journal
+	// AllocationTimeout, when not zero, is the maximum
+	// time a step waits for the cores it needs.
+	AllocationTimeout time.Duration
+
+	ids     map[string]bool
+	writers map[string]int
+	readers map[string][]int
+}
+
+// Add appends step to the graph, calculating
+// its dependencies on the steps already added.
+func (g *Graph) Add(step *Step) {
+	if g.ids == nil {
+		g.ids = map[string]bool{}
+		g.writers = map[string]int{}
+		g.readers = map[string][]int{}
+	}
+	if g.ids[step.ID] {
+		errors.FailF("duplicated step `%s` in simulation graph", step.ID)
+	}
+	g.ids[step.ID] = true
+
+	idx := len(g.Steps)
+	deps := map[int]bool{}
+
+	if w, ok := g.writer(step.Workdir); ok {
+		deps[w] = true
+	}
+	for _, in := range step.Inputs {
+		if w, ok := g.writer(in); ok {
+			deps[w] = true
+		}
+	}
+	for _, out := range step.Outputs {
+		if w, ok := g.writer(out); ok {
+			deps[w] = true
+		}
+		for path, w := range g.writers {
+			if isWithin(path, out) {
+				deps[w] = true
+			}
+		}
+		for path, readers := range g.readers {
+			if isWithin(path, out) {
+				for _, r := range readers {
+					deps[r] = true
+				}
+			}
+		}
+	}
+
+	for _, in := range step.Inputs {
+		g.readers[in] = append(g.readers[in], idx)
+	}
+	for _, out := range step.Outputs {
+		g.writers[out] = idx
+		for path := range g.readers {
+			if isWithin(path, out) {
+				delete(g.readers, path)
+			}
+		}
+	}
+
+	step.deps = step.deps[:0]
+	for i := 0; i < idx; i++ {
+		if deps[i] {
+			step.deps = append(step.deps, i)
+		}
+	}
+	g.Steps = append(g.Steps, step)
+}
+
+// writer returns the index of the last step that wrote
+// path or one of its parent directories.
+func (g *Graph) writer(path string) (int, bool) {
+	if path == "" {
+		return 0, false
+	}
+	last, found := 0, false
+	for {
+		if w, ok := g.writers[path]; ok && (!found || w > last) {
+			last, found = w, true
+		}
+		parent := filepath.Dir(path)
+		if parent == path {
+			return last, found
+		}
+		path = parent
+	}
+}
+
+// isWithin reports whether path is dir
+// or a file or directory inside it.
+func isWithin(path, dir string) bool {
+	return path == dir || strings.HasPrefix(path, dir+string(filepath.Separator))
+}
+
+// Step returns the step with the given ID, or nil
+// if the graph does not contain such a step.
+func (g *Graph) Step(id string) *Step {
+	for _, step := range g.Steps {
+		if step.ID == id {
+			return step
+		}
+	}
+	return nil
+}
+
+// Deps returns the steps that must be completed
+// before step can run.
+func (g *Graph) Deps(step *Step) []*Step {
+	res := make([]*Step, len(step.deps))
+	for i, d := range step.deps {
+		res[i] = g.Steps[d]
+	}
+	return res
+}
+
+// finalOutputs returns the outputs of the step at idx
+// that are not overwritten by any step that follows it.
+func (g *Graph) finalOutputs(idx int) []string {
+	var res []string
+	for _, out := range g.Steps[idx].Outputs {
+		if g.writers[out] == idx {
+			res = append(res, out)
+		}
+	}
+	return res
+}
+
+// StepFailure is the error returned
+// for every step that fails to run.
+type StepFailure struct {
+	Step *Step
+	Err  error
+}
+
+func (f StepFailure) Error() string {
+	return fmt.Sprintf("step `%s` failed: %s", f.Step.ID, f.Err)
+}
+
+func (f StepFailure) Unwrap() error {
+	return f.Err
+}
+
+type stepState int
+
+const (
+	stepPending stepState = iota
+	stepRunning
+	stepDone
+	stepFailed
+	stepSkipped
+)
+
+type stepResult struct {
+	idx   int
+	err   error
+	alloc mpiman.Allocation
+}
+
+// Run executes all steps of the graph, running concurrently
+// every step whose dependencies are completed.
+//
+// At most `parallelism` MPI steps run at the same time. Each
+// MPI step is given its own cores allocated from `cores`: steps
+// are packed on the nodes as described in
+// mpiman.Allocator.Allocate, so that more steps can share
+// a node. When `cores` has no nodes, MPI steps run without
+// an allocation. A step that cannot fit in the free cores
+// waits, for at most AllocationTimeout when it's not zero,
+// until the running steps release theirs: waiting steps are
+// given cores in order of Priority, and then in the order
+// they were started. A step that needs more cores than the
+// ones of the nodes not quarantined fails with
+// mpiman.ErrCapacityExceeded, and it's never run on the
+// nodes quarantined.
+//
+// When a step fails, the steps that depend on it are skipped,
+// while independent steps continue to run. Run returns the
+// failures of all steps that failed.
+//
+// When ctx is done, the steps waiting for cores and the ones
+// started afterwards fail without running.
+//
+// If the graph has a Journal, the steps recorded in it whose
+// outputs are still intact and whose dependencies are all
+// completed are not run again.
+func (g *Graph) Run(ctx context.Context, parallelism int, cores *mpiman.Allocator) []StepFailure {
+	results := make(chan stepResult)
+	return g.schedule(parallelism,
+		func(idx int) {
+			// cores are requested in the order steps are
+			// started, and waited for by the step itself
+			var req *mpiman.Request
+			if procs := neededCores(g.Steps[idx], cores); procs > 0 {
+				req = cores.Request(procs, g.Steps[idx].Priority)
+			}
+			go g.runStep(ctx, idx, cores, req, results)
+		},
+		func() stepResult {
+			res := <-results
+			if res.err == nil && g.Journal != nil {
+				if err := g.Journal.Record(g.Steps[res.idx]); err != nil {
+					log.Warning("%s", err)
+				}
+			}
+			return res
+		},
+		nil,
+	)
+}
+
+// PlannedStep is a step of the graph
+// as it would be run by Graph.Run.
+type PlannedStep struct {
+	*Step
+	// Allocation contains the cores that would be allocated to the step.
+	Allocation mpiman.Allocation
+	// Completed is true if the step was already completed
+	// by a previous run and it would not be run again.
+	Completed bool
+}
+
+// Plan returns the steps of the graph in the order Run would
+// start them, together with the cores allocated to them,
+// without running any of them. It assumes that every step
+// succeeds and that running steps complete in the same order
+// they are started.
+//
+// The cores are not used by the plan: they are
+// all free again when Plan returns.
+func (g *Graph) Plan(parallelism int, cores *mpiman.Allocator) []PlannedStep {
+	var plan []PlannedStep
+	// running contains the steps started and not yet completed,
+	// in the order they were started, done the ones completed
+	// to release their cores to a step started after them.
+	var running, done []stepResult
+	g.schedule(parallelism,
+		func(idx int) {
+			step := g.Steps[idx]
+			procs := neededCores(step, cores)
+			var alloc mpiman.Allocation
+			for procs > 0 && procs <= cores.Capacity() {
+				var ok bool
+				if alloc, ok = cores.Allocate(procs); ok || len(running) == 0 {
+					break
+				}
+				cores.Dispose(running[0].alloc)
+				done = append(done, running[0])
+				running = running[1:]
+			}
+
+			plan = append(plan, PlannedStep{Step: step, Allocation: alloc})
+			running = append(running, stepResult{idx: idx, alloc: alloc})
+		},
+		func() stepResult {
+			if len(done) > 0 {
+				res := done[0]
+				done = done[1:]
+				return res
+			}
+			res := running[0]
+			running = running[1:]
+			cores.Dispose(res.alloc)
+			return res
+		},
+		func(idx int) {
+			plan = append(plan, PlannedStep{Step: g.Steps[idx], Completed: true})
+		},
+	)
+	return plan
+}
+
+// neededCores returns the number of cores to allocate for step,
+// or 0 if cores are not allocated to it because it does not use
+// MPI or cores has no nodes. The cores returned can be more than
+// the capacity of cores: the request for them is then rejected.
+func neededCores(step *Step, cores *mpiman.Allocator) int {
+	if cores.Empty() {
+		return 0
+	}
+	return step.Procs
+}
+
+// schedule implements the scheduling algorithm described in Run.
+// start is called to start the step at idx, wait to wait the completion
+// of one of the running steps. When not nil, completed is called
+// for every step that was already completed by a previous run.
+func (g *Graph) schedule(
+	parallelism int,
+	start func(idx int),
+	wait func() stepResult,
+	completed func(idx int),
+) []StepFailure {
+	state := make([]stepState, len(g.Steps))
+	var failures []StepFailure
+	running := 0
+	runningProcs := 0
+
+	if g.Journal != nil {
+		for idx, step := range g.Steps {
+			if ready, _ := g.ready(step, state); ready && g.Journal.Completed(step, g.finalOutputs(idx)) {
+				log.Debug("Step `%s` already completed.", step.ID)
+				state[idx] = stepDone
+				if completed != nil {
+					completed(idx)
+				}
+			}
+		}
+	}
+
+	// steps ready at the same time are started in order of priority
+	order := make([]int, len(g.Steps))
+	for idx := range order {
+		order[idx] = idx
+	}
+	sort.SliceStable(order, func(i, j int) bool {
+		return g.Steps[order[i]].Priority > g.Steps[order[j]].Priority
+	})
+
+	for {
+		for _, idx := range order {
+			step := g.Steps[idx]
+			if state[idx] != stepPending {
+				continue
+			}
+			ready, skip := g.ready(step, state)
+			if skip {
+				log.Warning("Skipping step `%s`: a step it depends on has failed.", step.ID)
+				state[idx] = stepSkipped
+				continue
+			}
+			if !ready {
+				continue
+			}
+
+			if step.Procs > 0 {
+				if runningProcs >= parallelism {
+					continue
+				}
+				runningProcs++
+			}
+
+			state[idx] = stepRunning
+			running++
+			start(idx)
+		}
+
+		if running == 0 {
+			break
+		}
+
+		res := wait()
+		running--
+		step := g.Steps[res.idx]
+		if step.Procs > 0 {
+			runningProcs--
+		}
+		if res.err != nil {
+			state[res.idx] = stepFailed
+			failures = append(failures, StepFailure{Step: step, Err: res.err})
+		} else {
+			state[res.idx] = stepDone
+		}
+	}
+
+	return failures
+}
+
+// ready reports whether all dependencies of step
+// are completed, or whether the step must be skipped
+// because one of them failed or was skipped.
+func (g *Graph) ready(step *Step, state []stepState) (ready bool, skip bool) {
+	ready = true
+	for _, d := range step.deps {
+		switch state[d] {
+		case stepFailed, stepSkipped:
+			return false, true
+		case stepDone:
+		default:
+			ready = false
+		}
+	}
+	return ready, false
+}
+
+// runStep runs the step at idx, on the cores
+// granted to req when it's not nil.
+func (g *Graph) runStep(ctx context.Context, idx int, cores *mpiman.Allocator, req *mpiman.Request, results chan<- stepResult) {
+	var err error
+	defer func() {
+		results <- stepResult{idx: idx, err: err}
+	}()
+	defer errors.OnFailuresSet(&err)
+
+	step := g.Steps[idx]
+	var alloc mpiman.Allocation
+	if req != nil {
+		waitCtx := ctx
+		if g.AllocationTimeout > 0 {
+			var cancel context.CancelFunc
+			waitCtx, cancel = context.WithTimeout(ctx, g.AllocationTimeout)
+			defer cancel()
+		}
+		granted, err := req.Wait(waitCtx)
+		if err != nil {
+			errors.FailF("cannot allocate cores for %d processes: %w", step.Procs, err)
+		}
+		defer cores.Dispose(granted)
+		log.Info("Step `%s` allocated on %s: %d cores still free.", step.ID, granted.Hosts(), cores.FreeCores())
+		alloc = granted
+	}
+
+	if err := ctx.Err(); err != nil {
+		errors.FailF("step not run: %w", err)
+	}
+	step.Run(alloc)
+}
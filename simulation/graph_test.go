@@ -0,0 +1,472 @@
+package simulation_test
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/meteocima/ensemble-runner/conf"
+	"github.com/meteocima/ensemble-runner/errors"
+	"github.com/meteocima/ensemble-runner/folders"
+	"github.com/meteocima/ensemble-runner/mpiman"
+	"github.com/meteocima/ensemble-runner/simulation"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestSimulation(cfg conf.Config) simulation.Simulation {
+	folders.Rootdir = "/rootdir"
+	folders.WorkDir = "/rootdir/workdir"
+	start := time.Date(2020, 12, 25, 0, 0, 0, 0, time.UTC)
+	return simulation.Simulation{
+		Start:    start,
+		Duration: 48 * time.Hour,
+		Workdir:  simulation.Workdir(start),
+		Nodes:    mpiman.NewSlurmNodes(),
+		Conf:     &cfg,
+	}
+}
+
+func depIDs(g *simulation.Graph, id string) []string {
+	var res []string
+	for _, dep := range g.Deps(g.Step(id)) {
+		res = append(res, dep.ID)
+	}
+	sort.Strings(res)
+	return res
+}
+
+func TestGraph(t *testing.T) {
+	sim := newTestSimulation(conf.Config{
+		RunWPS:                 true,
+		AssimilateObservations: true,
+		Domains:                conf.LegacyDomains(false),
+		AssimilateFirstCycle:   true,
+		AssimilationCycles:     conf.DefaultAssimilationCycles(),
+		EnsembleMembers:        2,
+	})
+	g := sim.Graph()
+
+	t.Run("WPS", func(t *testing.T) {
+		assert.Equal(t, []string{"render wps"}, depIDs(g, "geogrid"))
+		assert.Equal(t, []string{"link_grib", "render wps"}, depIDs(g, "ungrib"))
+		assert.Equal(t, []string{"avg_tsfc", "geogrid", "render wps", "ungrib"}, depIDs(g, "metgrid"))
+	})
+
+	t.Run("RealRunsInSequence", func(t *testing.T) {
+		assert.Contains(t, depIDs(g, "real 2020-12-24-21"), "real 2020-12-24-18")
+		assert.Contains(t, depIDs(g, "real 2020-12-25-00"), "real 2020-12-24-21")
+		// real cannot overwrite wrfbdy_d01 before it is copied in inputs dir.
+		assert.Contains(t, depIDs(g, "real 2020-12-24-21"), "copy wps/wrfbdy_d01 ../../inputs/20201225/wrfbdy_d01_da01")
+	})
+
+	t.Run("DomainsAreIndependent", func(t *testing.T) {
+		for _, id := range []string{"da_wrfvar 2020-12-24-21 d01", "da_wrfvar 2020-12-24-21 d02", "da_wrfvar 2020-12-24-21 d03"} {
+			for _, dep := range depIDs(g, id) {
+				assert.NotContains(t, dep, "da_wrfvar")
+			}
+		}
+		assert.Equal(t, []string{
+			"copy wrf18/wrfvar_input_d02 da21_d02/fg",
+			"render da21_d02",
+		}, depIDs(g, "da_wrfvar 2020-12-24-21 d02"))
+	})
+
+	t.Run("WrfStepWaitsAllDomains", func(t *testing.T) {
+		assert.Equal(t, []string{
+			"copy da18_d01/wrfbdy_d01 wrf18/wrfbdy_d01",
+			"copy da18_d01/wrfvar_output wrf18/wrfinput_d01",
+			"copy da18_d02/wrfvar_output wrf18/wrfinput_d02",
+			"copy da18_d03/wrfvar_output wrf18/wrfinput_d03",
+			"render wrf18",
+		}, depIDs(g, "wrf 2020-12-24-18"))
+	})
+
+	t.Run("Members", func(t *testing.T) {
+		assert.Equal(t, []string{
+			"copy wrf00/wrfbdy_d01 wrf00.ens2/wrfbdy_d01",
+			"copy wrf00/wrfinput_d01 wrf00.ens2/wrfinput_d01",
+			"copy wrf00/wrfinput_d02 wrf00.ens2/wrfinput_d02",
+			"copy wrf00/wrfinput_d03 wrf00.ens2/wrfinput_d03",
+			"render wrf00.ens2",
+		}, depIDs(g, "wrf ens2"))
+		assert.Equal(t, simulation.ForecastStep, g.Step("wrf control").Kind)
+		assert.Equal(t, []string{"/rootdir/workdir/2020-12-25-00/wrf00.ens2"}, g.Step("wrf ens2").Outputs)
+	})
+
+	t.Run("ControlAfterCopiesToMembers", func(t *testing.T) {
+		deps := depIDs(g, "wrf control")
+		for ensnum := 1; ensnum <= 2; ensnum++ {
+			assert.Contains(t, deps, fmt.Sprintf("copy wrf00/wrfbdy_d01 wrf00.ens%d/wrfbdy_d01", ensnum))
+			assert.Contains(t, deps, fmt.Sprintf("copy wrf00/wrfinput_d03 wrf00.ens%d/wrfinput_d03", ensnum))
+		}
+	})
+}
+
+func TestGraphDomains(t *testing.T) {
+	sim := newTestSimulation(conf.Config{
+		RunWPS:                 true,
+		AssimilateObservations: true,
+		AssimilateFirstCycle:   false,
+		AssimilationCycles:     conf.DefaultAssimilationCycles(),
+		Domains: []conf.Domain{
+			{Assimilate: false},
+			{Assimilate: true},
+		},
+	})
+	g := sim.Graph()
+
+	assert.Nil(t, g.Step("da_wrfvar 2020-12-24-18 d02"))
+	assert.Nil(t, g.Step("da_wrfvar 2020-12-24-21 d01"))
+	assert.Nil(t, g.Step("copy ../../inputs/20201225/wrfinput_d03 wrf18/wrfinput_d03"))
+	assert.Equal(t, []string{
+		"/rootdir/workdir/2020-12-25-00/wps/wrfbdy_d01",
+		"/rootdir/workdir/2020-12-25-00/wps/wrfinput_d01",
+		"/rootdir/workdir/2020-12-25-00/wps/wrfinput_d02",
+	}, g.Step("real 2020-12-25-00").Outputs)
+
+	assert.Equal(t, []string{
+		"copy ../../inputs/20201225/wrfbdy_d01_da02 wrf21/wrfbdy_d01",
+		"copy da21_d02/wrfvar_output wrf21/wrfinput_d02",
+		"copy wrf18/wrfvar_input_d01 wrf21/wrfinput_d01",
+		"render wrf21",
+	}, depIDs(g, "wrf 2020-12-24-21"))
+}
+
+func TestGraphCycles(t *testing.T) {
+	sim := newTestSimulation(conf.Config{
+		RunWPS:                 true,
+		AssimilateObservations: true,
+		AssimilateFirstCycle:   true,
+		Domains:                conf.LegacyDomains(true),
+		AssimilationCycles: conf.AssimilationCycles{
+			Count:    4,
+			Interval: time.Hour,
+			Window:   time.Hour,
+		},
+	})
+	g := sim.Graph()
+
+	for _, id := range []string{
+		"real 2020-12-24-21",
+		"real 2020-12-24-22",
+		"real 2020-12-24-23",
+		"real 2020-12-25-00",
+		"da_wrfvar 2020-12-24-21 d03",
+		"da_wrfvar 2020-12-25-00 d03",
+		"wrf 2020-12-24-23",
+		"copy wps/wrfbdy_d01 ../../inputs/20201225/wrfbdy_d01_da04",
+	} {
+		assert.NotNil(t, g.Step(id), id)
+	}
+	assert.Nil(t, g.Step("wrf 2020-12-25-00"))
+	assert.Nil(t, g.Step("real 2020-12-24-18"))
+
+	assert.Equal(t, []string{
+		"copy wrf22/wrfvar_input_d03 da23_d03/fg",
+		"render da23_d03",
+	}, depIDs(g, "da_wrfvar 2020-12-24-23 d03"))
+	assert.Equal(t, []string{
+		"copy ../../inputs/20201225/wrfbdy_d01_da04 wrf00/wrfbdy_d01",
+		"copy da00_d03/wrfvar_output wrf00/wrfinput_d03",
+		"copy wrf00/namelist.input wps/namelist.input",
+		"copy wrf23/wrfvar_input_d01 wrf00/wrfinput_d01",
+		"copy wrf23/wrfvar_input_d02 wrf00/wrfinput_d02",
+		"render wrf00",
+	}, depIDs(g, "wrf control"))
+}
+
+func TestPrintPlan(t *testing.T) {
+	sim := newTestSimulation(conf.Config{
+		Domains:             conf.LegacyDomains(false),
+		EnsembleParallelism: 1,
+		WrfProcCount:        256,
+		MpiOptions:          "--bind-to core",
+	})
+	var buf bytes.Buffer
+	sim.PrintPlan(&buf)
+	plan := buf.String()
+
+	assert.Contains(t, plan, "render template `wrf-forecast` from 2020-12-25-00 for 48 hours in $WORKDIR/wrf00")
+	assert.Contains(t, plan, "copy /rootdir/inputs/20201225/wrfbdy_d01 to $WORKDIR/wrf00/wrfbdy_d01")
+	assert.Contains(t, plan, "[forecast] wrf control\n     run `mpirun --bind-to core -n 256 ./wrf.exe` in $WORKDIR/wrf00\n")
+	assert.Contains(t, plan, "-> $WORKDIR/wrf00/wrfinput_d03")
+	assert.Contains(t, plan, "procs: 256, nodes: not allocated\n     -> $WORKDIR/wrf00\n")
+
+	t.Run("NotEnoughCores", func(t *testing.T) {
+		sim := newTestSimulation(conf.Config{
+			Domains:             conf.LegacyDomains(false),
+			EnsembleParallelism: 1,
+			WrfProcCount:        256,
+			CoresPerNode:        112,
+		})
+		var err error
+		sim.Nodes, err = mpiman.ParseSlurmNodes("n[1-2]")
+		require.NoError(t, err)
+		var buf bytes.Buffer
+		sim.PrintPlan(&buf)
+		assert.Contains(t, buf.String(), "procs: 256, nodes: none, the nodes have only 224 cores\n")
+	})
+}
+
+func TestSimulationsWithDifferentConfigs(t *testing.T) {
+	plan := func(cfg conf.Config) string {
+		sim := newTestSimulation(cfg)
+		var buf bytes.Buffer
+		sim.PrintPlan(&buf)
+		return buf.String()
+	}
+
+	small := plan(conf.Config{
+		Domains:             conf.LegacyDomains(false),
+		EnsembleParallelism: 1,
+		WrfProcCount:        16,
+	})
+	large := plan(conf.Config{
+		Domains:             []conf.Domain{{}, {}},
+		EnsembleParallelism: 1,
+		WrfProcCount:        256,
+		EnsembleMembers:     1,
+	})
+
+	assert.Contains(t, small, "run `mpirun -n 16 ./wrf.exe`")
+	assert.Contains(t, small, "-> $WORKDIR/wrf00/wrfinput_d03")
+	assert.NotContains(t, small, "wrf ens1")
+	assert.Contains(t, large, "run `mpirun -n 256 ./wrf.exe`")
+	assert.NotContains(t, large, "wrfinput_d03")
+	assert.Contains(t, large, "wrf ens1")
+}
+
+func TestGraphWithoutAssimilation(t *testing.T) {
+	sim := newTestSimulation(conf.Config{
+		Domains: conf.LegacyDomains(false),
+	})
+	g := sim.Graph()
+
+	for _, step := range g.Steps {
+		assert.NotEqual(t, simulation.ProcessStep, step.Kind, step.ID)
+	}
+	assert.Equal(t, []string{
+		"copy ../../inputs/20201225/wrfbdy_d01 wrf00/wrfbdy_d01",
+		"copy ../../inputs/20201225/wrfinput_d01 wrf00/wrfinput_d01",
+		"copy ../../inputs/20201225/wrfinput_d02 wrf00/wrfinput_d02",
+		"copy ../../inputs/20201225/wrfinput_d03 wrf00/wrfinput_d03",
+		"render wrf00",
+	}, depIDs(g, "wrf control"))
+}
+
+func TestGraphRun(t *testing.T) {
+	newGraph := func(run func(id string, alloc mpiman.Allocation)) *simulation.Graph {
+		var g simulation.Graph
+		step := func(id string, procs int, inputs, outputs []string) {
+			g.Add(&simulation.Step{
+				ID:      id,
+				Kind:    simulation.ProcessStep,
+				Inputs:  inputs,
+				Outputs: outputs,
+				Procs:   procs,
+				Run: func(alloc mpiman.Allocation) {
+					run(id, alloc)
+				},
+			})
+		}
+		step("a", 0, nil, []string{"/w/a"})
+		step("b1", 4, []string{"/w/a"}, []string{"/w/b1"})
+		step("b2", 4, []string{"/w/a"}, []string{"/w/b2"})
+		step("c", 0, []string{"/w/b1", "/w/b2"}, []string{"/w/c"})
+		return &g
+	}
+
+	t.Run("RunsDependenciesFirst", func(t *testing.T) {
+		var mu sync.Mutex
+		var order []string
+		allCores := map[string]bool{}
+		// b1 and b2 hold their cores until both are running
+		var bothRunning sync.WaitGroup
+		bothRunning.Add(2)
+		g := newGraph(func(id string, alloc mpiman.Allocation) {
+			mu.Lock()
+			order = append(order, id)
+			for _, slots := range alloc {
+				for _, core := range slots.Cores {
+					c := fmt.Sprintf("%s/%d", slots.Node, core)
+					assert.False(t, allCores[c], "core %s given to two steps", c)
+					allCores[c] = true
+				}
+			}
+			mu.Unlock()
+			if len(alloc) > 0 {
+				bothRunning.Done()
+				bothRunning.Wait()
+			}
+		})
+		nodes, err := mpiman.ParseSlurmNodes("n[1-4]")
+		require.NoError(t, err)
+
+		failures := g.Run(context.Background(), 2, mpiman.NewAllocator(nodes, 2))
+		assert.Empty(t, failures)
+		require.Len(t, order, 4)
+		assert.Equal(t, "a", order[0])
+		assert.ElementsMatch(t, []string{"b1", "b2"}, order[1:3])
+		assert.Equal(t, "c", order[3])
+		assert.Len(t, allCores, 8)
+	})
+
+	t.Run("FailsWhenNodesAreNotEnough", func(t *testing.T) {
+		g := newGraph(func(id string, alloc mpiman.Allocation) {
+			if id == "b1" || id == "b2" {
+				t.Errorf("step %s run without enough cores", id)
+			}
+		})
+		nodes, err := mpiman.ParseSlurmNodes("n1")
+		require.NoError(t, err)
+
+		failures := g.Run(context.Background(), 2, mpiman.NewAllocator(nodes, 2))
+		require.Len(t, failures, 2)
+		for _, f := range failures {
+			assert.ErrorIs(t, f, mpiman.ErrCapacityExceeded)
+		}
+	})
+
+	t.Run("FailsWhenAllNodesAreQuarantined", func(t *testing.T) {
+		g := newGraph(func(id string, alloc mpiman.Allocation) {
+			if id == "b1" || id == "b2" {
+				t.Errorf("step %s run on quarantined nodes", id)
+			}
+		})
+		nodes, err := mpiman.ParseSlurmNodes("n1")
+		require.NoError(t, err)
+		cores := mpiman.NewAllocator(nodes, 4)
+		cores.MaxFailures = 1
+		alloc, ok := cores.Allocate(4)
+		require.True(t, ok)
+		cores.ReportFailure(alloc, "exit status 1")
+		cores.Dispose(alloc)
+
+		failures := g.Run(context.Background(), 2, cores)
+		require.Len(t, failures, 2)
+		for _, f := range failures {
+			assert.ErrorIs(t, f, mpiman.ErrCapacityExceeded)
+		}
+	})
+
+	t.Run("Plan", func(t *testing.T) {
+		g := newGraph(func(id string, alloc mpiman.Allocation) {
+			t.Errorf("step %s run while planning", id)
+		})
+		nodes, err := mpiman.ParseSlurmNodes("n[1-6]")
+		require.NoError(t, err)
+
+		var ids []string
+		var hosts []string
+		cores := mpiman.NewAllocator(nodes, 2)
+		for _, step := range g.Plan(2, cores) {
+			ids = append(ids, step.ID)
+			hosts = append(hosts, step.Allocation.Hosts())
+		}
+		assert.Equal(t, []string{"a", "b1", "b2", "c"}, ids)
+		assert.Equal(t, []string{"", "n1:2,n2:2", "n3:2,n4:2", ""}, hosts)
+		assert.Equal(t, 12, cores.FreeCores(), "cores not disposed after plan")
+		assert.Len(t, nodes.All(), 6)
+	})
+
+	t.Run("HigherPriorityFirst", func(t *testing.T) {
+		var g simulation.Graph
+		var mu sync.Mutex
+		var ran []string
+		for _, step := range []struct {
+			id       string
+			priority int
+		}{{"member", -1}, {"control", 0}} {
+			g.Add(&simulation.Step{
+				ID:       step.id,
+				Kind:     simulation.ForecastStep,
+				Outputs:  []string{"/w/" + step.id},
+				Procs:    4,
+				Priority: step.priority,
+				Run: func(alloc mpiman.Allocation) {
+					mu.Lock()
+					defer mu.Unlock()
+					ran = append(ran, step.id)
+				},
+			})
+		}
+		nodes, err := mpiman.ParseSlurmNodes("n1")
+		require.NoError(t, err)
+
+		failures := g.Run(context.Background(), 2, mpiman.NewAllocator(nodes, 4))
+		assert.Empty(t, failures)
+		assert.Equal(t, []string{"control", "member"}, ran)
+	})
+
+	t.Run("AllocationTimeout", func(t *testing.T) {
+		var g simulation.Graph
+		release := make(chan struct{})
+		for _, id := range []string{"first", "second"} {
+			g.Add(&simulation.Step{
+				ID:      id,
+				Kind:    simulation.ForecastStep,
+				Outputs: []string{"/w/" + id},
+				Procs:   4,
+				Run: func(alloc mpiman.Allocation) {
+					if id == "first" {
+						<-release
+					}
+				},
+			})
+		}
+		g.AllocationTimeout = 10 * time.Millisecond
+		nodes, err := mpiman.ParseSlurmNodes("n1")
+		require.NoError(t, err)
+
+		go func() {
+			time.Sleep(100 * time.Millisecond)
+			close(release)
+		}()
+		failures := g.Run(context.Background(), 2, mpiman.NewAllocator(nodes, 4))
+		require.Len(t, failures, 1)
+		assert.Equal(t, "second", failures[0].Step.ID)
+		assert.ErrorContains(t, failures[0], "cannot allocate cores for 4 processes: context deadline exceeded")
+	})
+
+	t.Run("SkipsDependentsOfFailedSteps", func(t *testing.T) {
+		var mu sync.Mutex
+		var ran []string
+		g := newGraph(func(id string, alloc mpiman.Allocation) {
+			mu.Lock()
+			ran = append(ran, id)
+			mu.Unlock()
+			if id == "b1" {
+				errors.FailF("b1 failed")
+			}
+		})
+
+		failures := g.Run(context.Background(), 1, mpiman.NewAllocator(mpiman.NewSlurmNodes(), 0))
+		require.Len(t, failures, 1)
+		assert.Equal(t, "b1", failures[0].Step.ID)
+		assert.EqualError(t, failures[0], "step `b1` failed: b1 failed")
+		assert.ElementsMatch(t, []string{"a", "b1", "b2"}, ran)
+	})
+
+	t.Run("StopsWhenCancelled", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		var ran []string
+		g := newGraph(func(id string, alloc mpiman.Allocation) {
+			ran = append(ran, id)
+			cancel()
+		})
+
+		failures := g.Run(ctx, 1, mpiman.NewAllocator(mpiman.NewSlurmNodes(), 0))
+		// b1 and b2 fail, c is skipped
+		require.Len(t, failures, 2)
+		for _, f := range failures {
+			assert.ErrorIs(t, f, context.Canceled)
+			assert.ErrorContains(t, f, "step not run: context canceled")
+		}
+		assert.Equal(t, []string{"a"}, ran)
+	})
+}
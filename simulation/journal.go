@@ -0,0 +1,143 @@
+package simulation
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+)
+
+// Journal records on file the steps of a simulation
+// that completed successfully, together with the state
+// of their outputs, so that a failed simulation can be
+// resumed from the first step not completed.
+//
+// The journal file contains a JSON object per line,
+// one for every completed step.
+type Journal struct {
+	path    string
+	entries map[string]JournalEntry
+}
+
+// JournalEntry is the record of a completed step.
+type JournalEntry struct {
+	Step      string       `json:"step"`
+	Completed time.Time    `json:"completed"`
+	Outputs   []OutputInfo `json:"outputs"`
+}
+
+// OutputInfo contains the state of an
+// output of a step at the time it completed.
+type OutputInfo struct {
+	Path    string    `json:"path"`
+	Dir     bool      `json:"dir,omitempty"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"modtime"`
+}
+
+// OpenJournal opens the journal stored at path, reading
+// all the entries it already contains. If the file does
+// not exist, an empty journal is returned.
+func OpenJournal(path string) (*Journal, error) {
+	j := &Journal{
+		path:    path,
+		entries: map[string]JournalEntry{},
+	}
+
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return j, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("cannot open journal %s: %w", path, err)
+	}
+	defer f.Close()
+
+	scan := bufio.NewScanner(f)
+	for line := 1; scan.Scan(); line++ {
+		var entry JournalEntry
+		if err := json.Unmarshal(scan.Bytes(), &entry); err != nil {
+			return nil, fmt.Errorf("cannot read journal %s at line %d: %w", path, line, err)
+		}
+		j.entries[entry.Step] = entry
+	}
+	if err := scan.Err(); err != nil {
+		return nil, fmt.Errorf("cannot read journal %s: %w", path, err)
+	}
+	return j, nil
+}
+
+// Record appends to the journal an entry for
+// step, saving the current state of its outputs.
+func (j *Journal) Record(step *Step) error {
+	entry := JournalEntry{
+		Step:      step.ID,
+		Completed: time.Now(),
+	}
+	for _, out := range step.Outputs {
+		info, err := os.Stat(out)
+		if err != nil {
+			return fmt.Errorf("cannot record output of step `%s`: %w", step.ID, err)
+		}
+		entry.Outputs = append(entry.Outputs, OutputInfo{
+			Path:    out,
+			Dir:     info.IsDir(),
+			Size:    info.Size(),
+			ModTime: info.ModTime(),
+		})
+	}
+
+	buf, err := json.Marshal(entry)
+	if err != nil {
+		return fmt.Errorf("cannot record step `%s`: %w", step.ID, err)
+	}
+
+	f, err := os.OpenFile(j.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("cannot open journal %s: %w", j.path, err)
+	}
+	_, err = f.Write(append(buf, '\n'))
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("cannot write journal %s: %w", j.path, err)
+	}
+
+	j.entries[step.ID] = entry
+	return nil
+}
+
+// Completed reports whether step was recorded as completed
+// and whether the outputs in `check` are still present and
+// unchanged since then. Outputs that are directories are only
+// checked for existence, since other steps write into them.
+func (j *Journal) Completed(step *Step, check []string) bool {
+	entry, ok := j.entries[step.ID]
+	if !ok {
+		return false
+	}
+	recorded := map[string]OutputInfo{}
+	for _, out := range entry.Outputs {
+		recorded[out.Path] = out
+	}
+
+	for _, path := range check {
+		out, ok := recorded[path]
+		if !ok {
+			return false
+		}
+		info, err := os.Stat(path)
+		if err != nil || info.IsDir() != out.Dir {
+			return false
+		}
+		if out.Dir {
+			continue
+		}
+		if info.Size() != out.Size || !info.ModTime().Equal(out.ModTime) {
+			return false
+		}
+	}
+	return true
+}
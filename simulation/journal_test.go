@@ -0,0 +1,85 @@
+package simulation_test
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/meteocima/ensemble-runner/errors"
+	"github.com/meteocima/ensemble-runner/mpiman"
+	"github.com/meteocima/ensemble-runner/simulation"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestJournal(t *testing.T) {
+	dir := t.TempDir()
+	journalPath := filepath.Join(dir, "completed_steps.log")
+	file := func(name string) string {
+		return filepath.Join(dir, name)
+	}
+
+	var ran []string
+	var failing string
+	newGraph := func() *simulation.Graph {
+		var g simulation.Graph
+		step := func(id string, inputs []string, output string) {
+			g.Add(&simulation.Step{
+				ID:      id,
+				Kind:    simulation.ProcessStep,
+				Inputs:  inputs,
+				Outputs: []string{output},
+				Run: func(alloc mpiman.Allocation) {
+					ran = append(ran, id)
+					if id == failing {
+						errors.FailF("%s failed", id)
+					}
+					errors.Check(os.WriteFile(output, []byte(id), 0644))
+				},
+			})
+		}
+		step("a", nil, file("a"))
+		step("b", []string{file("a")}, file("b"))
+		step("c", []string{file("b")}, file("c"))
+		return &g
+	}
+
+	run := func() []simulation.StepFailure {
+		ran = nil
+		g := newGraph()
+		var err error
+		g.Journal, err = simulation.OpenJournal(journalPath)
+		require.NoError(t, err)
+		return g.Run(context.Background(), 1, mpiman.NewAllocator(mpiman.NewSlurmNodes(), 0))
+	}
+
+	failing = "c"
+	require.Len(t, run(), 1)
+	assert.Equal(t, []string{"a", "b", "c"}, ran)
+
+	t.Run("SkipsCompletedSteps", func(t *testing.T) {
+		failing = ""
+		assert.Empty(t, run())
+		assert.Equal(t, []string{"c"}, ran)
+
+		assert.Empty(t, run())
+		assert.Empty(t, ran)
+	})
+
+	t.Run("RunsAgainStepsWithChangedOutputs", func(t *testing.T) {
+		require.NoError(t, os.WriteFile(file("b"), []byte("changed b"), 0644))
+		assert.Empty(t, run())
+		assert.Equal(t, []string{"b", "c"}, ran)
+
+		require.NoError(t, os.Remove(file("a")))
+		assert.Empty(t, run())
+		assert.Equal(t, []string{"a", "b", "c"}, ran)
+	})
+
+	t.Run("MalformedJournal", func(t *testing.T) {
+		require.NoError(t, os.WriteFile(journalPath, []byte("{}\nnot json\n"), 0644))
+		_, err := simulation.OpenJournal(journalPath)
+		assert.ErrorContains(t, err, "at line 2")
+	})
+}
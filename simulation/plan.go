@@ -0,0 +1,52 @@
+package simulation
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/meteocima/ensemble-runner/errors"
+)
+
+// PrintPlan writes to w the ordered list of the steps the
+// simulation would run, without running any of them: for
+// every step, the action it performs, the nodes allocated
+// to it and the files it produces.
+//
+// When the simulation is resumed, the steps already
+// completed by a previous run are listed as such.
+func (s *Simulation) PrintPlan(w io.Writer) {
+	g := s.Graph()
+	if s.Opts.Resume {
+		g.Journal = errors.CheckResult(OpenJournal(join(s.Workdir, journalFile)))
+	}
+
+	fmt.Fprintf(w, "Plan of simulation from %s for %.0f hours\n", s.Start.Format(ShortDtFormat), s.Duration.Hours())
+	fmt.Fprintf(w, "$WORKDIR=%s\n\n", s.Workdir)
+
+	cores := s.newAllocator()
+	plan := g.Plan(s.Conf.EnsembleParallelism, cores)
+	for n, step := range plan {
+		fmt.Fprintf(w, "%3d. [%s] %s", n+1, step.Kind, step.ID)
+		if step.Completed {
+			fmt.Fprint(w, " (already completed)")
+		}
+		fmt.Fprintln(w)
+
+		if step.Describe != nil {
+			fmt.Fprintf(w, "     %s\n", step.Describe(step.Allocation))
+		}
+		if step.Procs > 0 {
+			nodes := "not allocated"
+			if len(step.Allocation) > 0 {
+				nodes = step.Allocation.Hosts()
+			} else if !cores.Empty() {
+				nodes = fmt.Sprintf("none, the nodes have only %d cores", cores.Capacity())
+			}
+			fmt.Fprintf(w, "     procs: %d, nodes: %s\n", step.Procs, nodes)
+		}
+		for _, out := range step.Outputs {
+			fmt.Fprintf(w, "     -> %s\n", s.displayPath(out))
+		}
+	}
+	fmt.Fprintln(w)
+}
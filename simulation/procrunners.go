@@ -1,13 +1,14 @@
 package simulation
 
 import (
+	"context"
 	"fmt"
 	"math"
 	"os"
 	"path/filepath"
+	"strings"
 	"time"
 
-	"github.com/meteocima/ensemble-runner/conf"
 	"github.com/meteocima/ensemble-runner/errors"
 	"github.com/meteocima/ensemble-runner/folders"
 	"github.com/meteocima/ensemble-runner/log"
@@ -17,12 +18,171 @@ import (
 	"github.com/parro-it/tailor"
 )
 
-func (s Simulation) RunGeogrid() {
+// mpiCommand returns the command line used to run the MPI
+// executable exe with procCount processes on the cores of
+// alloc, using the launcher configured for exe.
+func (s *Simulation) mpiCommand(exe string, procCount int, alloc mpiman.Allocation) string {
+	return s.Conf.Launcher(exe).Command("./"+exe+".exe", procCount, alloc)
+}
+
+// writeLauncherFiles writes in dir the files that the command
+// line returned by mpiCommand for exe and alloc refers to.
+func (s *Simulation) writeLauncherFiles(exe, dir string, alloc mpiman.Allocation) {
+	for name, content := range s.Conf.Launcher(exe).Files(alloc) {
+		errors.Check(os.WriteFile(join(dir, name), []byte(content), 0644))
+	}
+}
+
+// quarantineFile is the name of the file, in the workdir of the
+// simulation, where quarantined nodes are recorded.
+const quarantineFile = "quarantined_nodes.log"
+
+// processContext returns the context of the process
+// `name` (one of conf.Processes), which is done when
+// the simulation is stopped or when the timeout
+// configured for the process expires.
+func (s *Simulation) processContext(name string) (context.Context, context.CancelFunc) {
+	if timeout := s.Conf.Timeouts[name]; timeout > 0 {
+		return context.WithTimeout(s.ctx, timeout)
+	}
+	return context.WithCancel(s.ctx)
+}
+
+// exec runs in dir cmd, the command of the process `name`, until
+// the context of the process is done, retrying it as described
+// by the retry policy of the process.
+func (s *Simulation) exec(name, cmd, dir, logto, logsToSave string) {
+	ctx, cancel := s.processContext(name)
+	defer cancel()
+	server.ExecRetryOn(ctx, s.retryPolicy(name), func(int) string { return cmd }, dir, logto, logsToSave, nil, nil, s.env()...)
+}
+
+// execMPI works like exec, but the command of the process `name`
+// is returned by cmd, to launch the MPI executable exe on the
+// cores of alloc.
+//
+// Every failed attempt is reported for the nodes of alloc: when
+// some of them are quarantined, the next attempts run on the cores
+// of alloc on the remaining nodes, together with the ones allocated
+// to replace the cores of the quarantined nodes. Replacements are
+// waited for at most AllocationTimeout, when it's not zero, and
+// until the process is stopped.
+func (s *Simulation) execMPI(name, exe string, alloc mpiman.Allocation, cmd func(alloc mpiman.Allocation) string, dir, logto, logsToSave string, beforeRetry func(retry int)) {
+	ctx, cancel := s.processContext(name)
+	defer cancel()
+
+	// cores allocated to replace the ones of quarantined nodes
+	var replacements mpiman.Allocation
+	defer func() {
+		if len(replacements) > 0 {
+			s.cores.Dispose(replacements)
+		}
+	}()
+
+	current := alloc
+	attemptCmd := func(attempt int) string {
+		s.writeLauncherFiles(exe, dir, current)
+		c := cmd(current)
+		log.Debug("Running command: %s", c)
+		return c
+	}
+	// quarantined contains the nodes of current
+	// quarantined after the last failed attempt
+	var quarantined mpiman.SlurmNodesList
+	failed := func(err error) {
+		if len(current) == 0 {
+			return
+		}
+		reason := fmt.Sprintf("%d consecutive failures, last one in %s: %s", s.Conf.QuarantineAfter, s.displayPath(dir), err)
+		quarantined = s.cores.ReportFailure(current, reason)
+		if len(quarantined) > 0 {
+			s.recordQuarantine(quarantined, reason)
+		}
+	}
+	retry := func(retry int) {
+		if len(quarantined) > 0 {
+			current = s.replaceQuarantined(ctx, current, quarantined, &replacements)
+			quarantined = nil
+		}
+		if beforeRetry != nil {
+			beforeRetry(retry)
+		}
+	}
+
+	server.ExecRetryOn(ctx, s.retryPolicy(name), attemptCmd, dir, logto, logsToSave, failed, retry, s.env()...)
+	if len(current) > 0 {
+		s.cores.ReportSuccess(current)
+	}
+}
+
+// replaceQuarantined returns the cores of current on the nodes that
+// are not quarantined, together with new cores that replace the ones
+// on the nodes quarantined, which are added to replacements.
+func (s *Simulation) replaceQuarantined(ctx context.Context, current mpiman.Allocation, quarantined mpiman.SlurmNodesList, replacements *mpiman.Allocation) mpiman.Allocation {
+	if s.Conf.AllocationTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.Conf.AllocationTimeout)
+		defer cancel()
+	}
+	healthy, lost := s.cores.Healthy(current)
+	extra, err := s.cores.Acquire(ctx, lost, math.MaxInt)
+	if err != nil {
+		errors.FailF("cannot replace the cores of quarantined nodes %s: %w", quarantined.Compress(), err)
+	}
+	log.Info("Cores of quarantined nodes replaced by %s: %d cores still free.", extra.Hosts(), s.cores.FreeCores())
+	*replacements = replacements.Merge(extra)
+	return healthy.Merge(extra)
+}
+
+// recordQuarantine writes nodes, quarantined for reason,
+// to the log and to the quarantine file of the simulation.
+func (s *Simulation) recordQuarantine(nodes mpiman.SlurmNodesList, reason string) {
+	var lines strings.Builder
+	for _, node := range nodes {
+		log.Warning("Node %s quarantined: %s", node, reason)
+		fmt.Fprintf(&lines, "%s\t%s\t%s\n", time.Now().Format(time.RFC3339), node, reason)
+	}
+	f, err := os.OpenFile(join(s.Workdir, quarantineFile), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err == nil {
+		_, err = f.WriteString(lines.String())
+		f.Close()
+	}
+	if err != nil {
+		log.Warning("Cannot record quarantined nodes: %s", err)
+	}
+}
+
+func (s *Simulation) geogridCommand(alloc mpiman.Allocation) string {
+	return s.mpiCommand("geogrid", s.Conf.GeogridProcCount, alloc)
+}
+
+func (s *Simulation) metgridCommand(alloc mpiman.Allocation) string {
+	return s.mpiCommand("metgrid", s.Conf.MetgridProcCount, alloc)
+}
+
+func (s *Simulation) realCommand(alloc mpiman.Allocation) string {
+	return s.mpiCommand("real", s.Conf.RealProcCount, alloc)
+}
+
+func (s *Simulation) daCommand(alloc mpiman.Allocation) string {
+	return s.mpiCommand("da_wrfvar", s.Conf.WrfdaProcCount, alloc)
+}
+
+func (s *Simulation) wrfCommand(procCount int, alloc mpiman.Allocation) string {
+	return s.mpiCommand("wrf", procCount, alloc)
+}
+
+func (s *Simulation) linkGribCommand(startTime time.Time) string {
+	remoteGfsPath := join(s.Conf.GfsDir, startTime.Format("2006/01/02/1504"))
+	return "./link_grib.csh " + remoteGfsPath + "/*.grb"
+}
+
+func (s Simulation) RunGeogrid(alloc mpiman.Allocation) {
 	wpsPath := folders.WPSProcWorkdir(s.Workdir)
 	wpsRelDir := errors.CheckResult(filepath.Rel(s.Workdir, wpsPath))
 
 	log.Info("Running geogrid.\t\t\tDIR: $WORKDIR/%s LOGS: %s", wpsRelDir, "geogrid.detail.log geogrid.log.*")
-	server.ExecRetry(fmt.Sprintf("mpiexec %s -n %d ./geogrid.exe", conf.Values.MpiOptions, conf.Values.GeogridProcCount), wpsPath, "geogrid.detail.log", "{geogrid.detail.log,geogrid.log.????}")
+	s.execMPI("geogrid", "geogrid", alloc, s.geogridCommand, wpsPath, "geogrid.detail.log", "{geogrid.detail.log,geogrid.log.????}", nil)
 	logFile := join(wpsPath, "geogrid.log.0000")
 	logf := errors.CheckResult(os.Open(logFile))
 	defer logf.Close()
@@ -50,10 +210,8 @@ func (s Simulation) RunLinkGrib(startTime time.Time) {
 	wpsPath := folders.WPSProcWorkdir(s.Workdir)
 	wpsRelDir := errors.CheckResult(filepath.Rel(s.Workdir, wpsPath))
 
-	remoteGfsPath := join(conf.Values.GfsDir, startTime.Format("2006/01/02/1504"))
 	log.Info("Running link_grib.\t\t\tDIR: $WORKDIR/%s LOGS: %s", wpsRelDir, "link_grib.detail.log")
-	linkCmd := "./link_grib.csh " + remoteGfsPath + "/*.grb"
-	server.ExecRetry(linkCmd, wpsPath, "link_grib.detail.log", "link_grib.detail.log")
+	s.exec("link_grib", s.linkGribCommand(startTime), wpsPath, "link_grib.detail.log", "link_grib.detail.log")
 }
 
 func (s Simulation) RunUngrib() {
@@ -61,7 +219,7 @@ func (s Simulation) RunUngrib() {
 	wpsRelDir := errors.CheckResult(filepath.Rel(s.Workdir, wpsPath))
 
 	log.Info("Running ungrib.\t\t\t\tDIR: $WORKDIR/%s LOGS: %s", wpsRelDir, "ungrib.detail.log ungrib.log")
-	server.ExecRetry("./ungrib.exe", wpsPath, "ungrib.detail.log", "{ungrib.detail.log,ungrib.log}")
+	s.exec("ungrib", "./ungrib.exe", wpsPath, "ungrib.detail.log", "{ungrib.detail.log,ungrib.log}")
 	logFile := join(wpsPath, "ungrib.log")
 	logf := errors.CheckResult(os.Open(logFile))
 	defer logf.Close()
@@ -85,12 +243,12 @@ func (s Simulation) RunUngrib() {
 	}
 }
 
-func (s Simulation) RunMetgrid() {
+func (s Simulation) RunMetgrid(alloc mpiman.Allocation) {
 	wpsPath := folders.WPSProcWorkdir(s.Workdir)
 	wpsRelDir := errors.CheckResult(filepath.Rel(s.Workdir, wpsPath))
 
 	log.Info("Running metgrid.\t\t\tDIR: $WORKDIR/%s LOGS: %s", wpsRelDir, "metgrid.detail.log metgrid.log.*")
-	server.ExecRetry(fmt.Sprintf("mpiexec %s -n %d ./metgrid.exe", conf.Values.MpiOptions, conf.Values.MetgridProcCount), wpsPath, "metgrid.detail.log", "{metgrid.detail.log,metgrid.log.????}")
+	s.execMPI("metgrid", "metgrid", alloc, s.metgridCommand, wpsPath, "metgrid.detail.log", "{metgrid.detail.log,metgrid.log.????}", nil)
 	logFile := join(wpsPath, "metgrid.log.0000")
 	logf := errors.CheckResult(os.Open(logFile))
 	defer logf.Close()
@@ -120,15 +278,15 @@ func (s Simulation) RunAvgtsfc() {
 	wpsRelDir := errors.CheckResult(filepath.Rel(s.Workdir, wpsPath))
 
 	log.Info("Running avg_tsfc.\t\t\tDIR: $WORKDIR/%s LOGS: %s", wpsRelDir, "avg_tsfc.detail.log")
-	server.ExecRetry("./avg_tsfc.exe", wpsPath, "avg_tsfc.detail.log", "avg_tsfc.detail.log")
+	s.exec("avg_tsfc", "./avg_tsfc.exe", wpsPath, "avg_tsfc.detail.log", "avg_tsfc.detail.log")
 }
 
-func (s Simulation) RunReal(startTime time.Time) {
+func (s Simulation) RunReal(startTime time.Time, alloc mpiman.Allocation) {
 	wpsPath := folders.WPSProcWorkdir(s.Workdir)
 	wpsRelDir := errors.CheckResult(filepath.Rel(s.Workdir, wpsPath))
 
 	log.Info("Running real for %02d:00\t\t\tDIR: $WORKDIR/%s LOGS: %s", startTime.Hour(), wpsRelDir, "real.detail.log,rsl.out.* rsl.error.*")
-	server.ExecRetry(fmt.Sprintf("mpiexec %s -n %d ./real.exe", conf.Values.MpiOptions, conf.Values.RealProcCount), wpsPath, "real.detail.log", "{real.detail.log,rsl.out.????,rsl.error.????}")
+	s.execMPI("real", "real", alloc, s.realCommand, wpsPath, "real.detail.log", "{real.detail.log,rsl.out.????,rsl.error.????}", nil)
 
 	logFile := join(wpsPath, "rsl.out.0000")
 	logf := errors.CheckResult(os.Open(logFile))
@@ -154,14 +312,14 @@ func (s Simulation) RunReal(startTime time.Time) {
 
 }
 
-func (s Simulation) RunDa(startTime time.Time, domain int) {
+func (s Simulation) RunDa(startTime time.Time, domain int, alloc mpiman.Allocation) {
 
 	pathDA := folders.DAProcWorkdir(s.Workdir, startTime, domain)
 
 	daRelDir := errors.CheckResult(filepath.Rel(s.Workdir, pathDA))
 	log.Info("Running da_wrfvar for %02d:00 (domain %d)\t\tDIR: $WORKDIR/%s LOGS: %s", startTime.Hour(), domain, daRelDir, "da_wrfvar.detail.log rsl.out.* rsl.error.*")
 
-	server.ExecRetry(fmt.Sprintf("mpirun %s -n %d ./da_wrfvar.exe", conf.Values.MpiOptions, conf.Values.WrfdaProcCount), pathDA, "da_wrfvar.detail.log", "{da_wrfvar.detail.log,rsl.out.????,rsl.error.????}")
+	s.execMPI("da_wrfvar", "da_wrfvar", alloc, s.daCommand, pathDA, "da_wrfvar.detail.log", "{da_wrfvar.detail.log,rsl.out.????,rsl.error.????}", nil)
 
 	logFile := join(pathDA, "rsl.out.0000")
 	logf := errors.CheckResult(os.Open(logFile))
@@ -187,17 +345,23 @@ func (s Simulation) RunDa(startTime time.Time, domain int) {
 
 }
 
-func (s Simulation) RunWrfEnsemble(startTime time.Time, ensnum int) (err error) {
+func (s Simulation) RunWrfEnsemble(startTime time.Time, ensnum int, alloc mpiman.Allocation) (err error) {
 	defer errors.OnFailuresSet(&err)
 
-	return s.runWrf(startTime, ensnum, conf.Values.WrfProcCount)
+	// restart files could have been left by a previous
+	// run that was interrupted (e.g. by the walltime of the
+	// allocation), and then by every failed attempt.
+	s.continueFromRestart(ensnum)
+	return s.runWrf("wrf", startTime, ensnum, s.Conf.WrfProcCount, alloc, func(retry int) {
+		s.continueFromRestart(ensnum)
+	})
 }
 
-func (s Simulation) RunWrfStep(startTime time.Time) {
-	errors.Check(s.runWrf(startTime, 0, conf.Values.WrfStepProcCount))
+func (s Simulation) RunWrfStep(startTime time.Time, alloc mpiman.Allocation) {
+	errors.Check(s.runWrf("wrf_step", startTime, 0, s.Conf.WrfStepProcCount, alloc, nil))
 }
 
-func (s Simulation) runWrf(startTime time.Time, ensnum int, procCount int) (err error) {
+func (s Simulation) runWrf(process string, startTime time.Time, ensnum int, procCount int, alloc mpiman.Allocation, beforeRetry func(retry int)) (err error) {
 	var workdirPath string
 	var descr string
 	defer errors.OnFailuresSet(&err)
@@ -213,24 +377,15 @@ func (s Simulation) runWrf(startTime time.Time, ensnum int, procCount int) (err
 
 	log.Info("Running WRF %s for %02d:00\tDIR: $WORKDIR/%s LOGS: %s", descr, startTime.Hour(), wrfRelDir, "wrf.detail.log rsl.out.* rsl.error.*")
 	//--cpu-set 0-15 --bind-to core
-	var nodes mpiman.SlurmNodesList
-
-	if conf.Values.EnsembleMembers > 0 && conf.Values.EnsembleParallelism > 1 {
-		var ok bool
-		nodes, ok = s.Nodes.FindFreeNodes(int(math.Ceil(float64(procCount) / float64(conf.Values.CoresPerNode))))
-		if !ok {
-			errors.FailF("Not enough free nodes to run WRF")
-		}
-	}
 
 	logFile := join(workdirPath, "rsl.out.0000")
 	endLineFound := make(chan bool)
 	go s.parseProgress(workdirPath, logFile, descr, endLineFound)
 
-	cmd := fmt.Sprintf("mpirun %s %s -n %d ./wrf.exe", conf.Values.MpiOptions, nodes.String(), procCount)
-	log.Debug("Running command: %s", cmd)
-	server.ExecRetry(cmd, workdirPath, "wrf.detail.log", "{wrf.detail.log,rsl.out.????,rsl.error.????}")
-	s.Nodes.Dispose(nodes)
+	cmd := func(alloc mpiman.Allocation) string {
+		return s.wrfCommand(procCount, alloc)
+	}
+	s.execMPI(process, "wrf", alloc, cmd, workdirPath, "wrf.detail.log", "{wrf.detail.log,rsl.out.????,rsl.error.????}", beforeRetry)
 
 	if !<-endLineFound {
 		log.Warning("log file is malformed: completion line not found.")
@@ -0,0 +1,55 @@
+package simulation
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/meteocima/ensemble-runner/conf"
+	"github.com/meteocima/ensemble-runner/mpiman"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExecMPIQuarantine(t *testing.T) {
+	attempts, backoff := 2, time.Duration(0)
+	nodes, err := mpiman.ParseSlurmNodes("n[1-2]")
+	require.NoError(t, err)
+	workdir := t.TempDir()
+	s := Simulation{
+		Workdir: workdir,
+		Nodes:   nodes,
+		Conf: &conf.Config{
+			EnsembleParallelism: 1,
+			CoresPerNode:        2,
+			QuarantineAfter:     1,
+			Retries: map[string]conf.RetryConfig{
+				"real": {Attempts: &attempts, Backoff: &backoff},
+			},
+		},
+		ctx: context.Background(),
+	}
+	s.cores = s.newAllocator()
+	require.Equal(t, 4, s.cores.Capacity(), "cores must be allocated also with EnsembleParallelism 1")
+
+	alloc, ok := s.cores.Allocate(2)
+	require.True(t, ok)
+	require.Equal(t, "n1:2", alloc.Hosts())
+
+	// the process fails on n1 only
+	var hosts []string
+	s.execMPI("real", "real", alloc, func(alloc mpiman.Allocation) string {
+		hosts = append(hosts, alloc.Hosts())
+		if alloc.Hosts() == "n1:2" {
+			return "exit 1"
+		}
+		return "true"
+	}, workdir, "real.detail.log", "real.detail.log", nil)
+
+	assert.Equal(t, []string{"n1:2", "n2:2"}, hosts)
+	assert.Contains(t, s.cores.Quarantined(), "n1")
+	quarantined, err := os.ReadFile(join(workdir, quarantineFile))
+	require.NoError(t, err)
+	assert.Contains(t, string(quarantined), "\tn1\t1 consecutive failures")
+}
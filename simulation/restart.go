@@ -0,0 +1,130 @@
+package simulation
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+
+	"github.com/meteocima/ensemble-runner/errors"
+	"github.com/meteocima/ensemble-runner/folders"
+	"github.com/meteocima/ensemble-runner/log"
+	"github.com/meteocima/ensemble-runner/server"
+	"github.com/meteocima/ensemble-runner/wrfprocs"
+	"golang.org/x/exp/maps"
+)
+
+// restartTimeFormat is the format of the instant
+// in the names of the restart files written by wrf.exe
+const restartTimeFormat = "2006-01-02_15:04:05"
+
+// LatestRestart returns the instant of the newest set of restart
+// files written by wrf.exe in dir that contains a file for every
+// one of the first `domains` domains. Only sets written after start
+// and before end, at the start of an hour, are considered.
+//
+// Since wrf.exe could have been killed while it was writing a
+// restart file, only the files that the logs of wrf.exe in dir,
+// including the ones saved from previous attempts, report as
+// completely written are considered. This requires that wrf.exe
+// runs without I/O quilting, so that files are written by the
+// process whose log is read.
+func LatestRestart(dir string, domains int, start, end time.Time) (time.Time, bool) {
+	logs, err := filepath.Glob(join(dir, "rsl.out.0000*"))
+	errors.Check(err)
+
+	written := map[time.Time]map[int]bool{}
+	for _, logFile := range logs {
+		f, err := os.Open(logFile)
+		if err != nil {
+			continue
+		}
+		restarts, err := wrfprocs.RestartsWritten(f)
+		f.Close()
+		if err != nil {
+			log.Debug("Restart files read from %s up to an error: %s", logFile, err)
+		}
+		for instant, instantDomains := range restarts {
+			if written[instant] == nil {
+				written[instant] = map[int]bool{}
+			}
+			for _, domain := range instantDomains {
+				written[instant][domain] = true
+			}
+		}
+	}
+
+	instants := maps.Keys(written)
+	slices.SortFunc(instants, func(a, b time.Time) int { return b.Compare(a) })
+	for _, instant := range instants {
+		if !instant.After(start) || !instant.Before(end) || instant.Truncate(time.Hour) != instant {
+			continue
+		}
+		if restartSetComplete(dir, domains, instant, written[instant]) {
+			return instant, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// restartSetComplete reports whether the restart files of all the
+// first `domains` domains at instant are in dir, and were written.
+func restartSetComplete(dir string, domains int, instant time.Time, written map[int]bool) bool {
+	for domain := 1; domain <= domains; domain++ {
+		name := fmt.Sprintf("wrfrst_d%02d_%s", domain, instant.Format(restartTimeFormat))
+		if _, err := os.Stat(join(dir, name)); !written[domain] || err != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// forecastWorkdir returns the workdir of the control
+// forecast when ensnum is 0, or of the ensemble member
+// ensnum otherwise.
+func (s Simulation) forecastWorkdir(ensnum int) string {
+	if ensnum == 0 {
+		return folders.WrfControlProcWorkdir(s.Workdir, s.Start)
+	}
+	return folders.WrfEnsembleProcWorkdir(s.Workdir, s.Start, ensnum)
+}
+
+// forecastTemplate returns the name of the template used to
+// render the workdir of the control forecast when ensnum is 0,
+// or of the ensemble member ensnum otherwise, together with
+// the additional variables it needs.
+func (s Simulation) forecastTemplate(ensnum int) (name string, envVars []string) {
+	if ensnum == 0 {
+		return "wrf-forecast", nil
+	}
+	return "wrf-ensmember", []string{"ENSEMBLE_SEED", fmt.Sprintf("%02d", memberSeed(ensnum))}
+}
+
+// continueFromRestart looks in the workdir of the control forecast
+// (ensnum 0) or of the ensemble member ensnum for the newest complete
+// set of restart files. When one is found, the namelist of the forecast
+// is rendered again, so that wrf.exe continues from it instead of
+// starting again from the start of the forecast.
+func (s Simulation) continueFromRestart(ensnum int) {
+	wrfdir := s.forecastWorkdir(ensnum)
+	end := s.Start.Add(s.Duration)
+
+	instant, ok := LatestRestart(wrfdir, len(s.Conf.Domains), s.Start, end)
+	if !ok {
+		return
+	}
+
+	log.Info("  - Continuing WRF from restart files of %s in $WORKDIR/%s", instant.Format(ShortDtFormat), s.relPath(wrfdir))
+
+	// the template is rendered in a temporary directory
+	// because rendering removes the target directory,
+	// which contains the restart files.
+	tmpdir := wrfdir + ".restart"
+	defer server.Rmdir(tmpdir)
+
+	name, envVars := s.forecastTemplate(ensnum)
+	envVars = append(envVars, "RESTART", ".true.")
+	server.RenderTemplate(tmpdir, name, instant, int(end.Sub(instant).Hours()), s.window(), s.env(envVars...)...)
+	server.CopyFile(s.Workdir, join(tmpdir, "namelist.input"), join(wrfdir, "namelist.input"))
+}
@@ -0,0 +1,119 @@
+package simulation_test
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/meteocima/ensemble-runner/simulation"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLatestRestart(t *testing.T) {
+	start := time.Date(2020, 12, 25, 0, 0, 0, 0, time.UTC)
+	end := start.Add(48 * time.Hour)
+
+	// wrfLog returns the lines logged by wrf.exe when it
+	// writes the restart files of domains at instant.
+	wrfLog := func(instant string, domains ...int) string {
+		var lines []string
+		for _, domain := range domains {
+			lines = append(lines,
+				fmt.Sprintf("Timing for main: time %s on domain %3d:    0.51234 elapsed seconds", instant, domain),
+				fmt.Sprintf("Timing for Writing restart for domain %8d:    1.23456 elapsed seconds", domain),
+			)
+		}
+		return strings.Join(lines, "\n") + "\n"
+	}
+
+	newDir := func(t *testing.T, files map[string]string) string {
+		dir := t.TempDir()
+		for name, content := range files {
+			require.NoError(t, os.WriteFile(filepath.Join(dir, name), []byte(content), 0644))
+		}
+		return dir
+	}
+
+	t.Run("NewestCompleteSet", func(t *testing.T) {
+		dir := newDir(t, map[string]string{
+			"rsl.out.0000": wrfLog("2020-12-25_06:00:00", 1, 2, 3) +
+				wrfLog("2020-12-25_12:00:00", 1, 2, 3) +
+				wrfLog("2020-12-25_18:00:00", 1, 2),
+			"wrfrst_d01_2020-12-25_06:00:00": "",
+			"wrfrst_d02_2020-12-25_06:00:00": "",
+			"wrfrst_d03_2020-12-25_06:00:00": "",
+			"wrfrst_d01_2020-12-25_12:00:00": "",
+			"wrfrst_d02_2020-12-25_12:00:00": "",
+			"wrfrst_d03_2020-12-25_12:00:00": "",
+			"wrfrst_d01_2020-12-25_18:00:00": "",
+			"wrfrst_d02_2020-12-25_18:00:00": "",
+		})
+		instant, ok := simulation.LatestRestart(dir, 3, start, end)
+		assert.True(t, ok)
+		assert.Equal(t, start.Add(12*time.Hour), instant)
+	})
+
+	t.Run("IgnoresFilesNotLogged", func(t *testing.T) {
+		// wrf.exe was killed while writing the
+		// restart file of domain 3 at 12:00
+		dir := newDir(t, map[string]string{
+			"rsl.out.0000": wrfLog("2020-12-25_06:00:00", 1, 2, 3) +
+				wrfLog("2020-12-25_12:00:00", 1, 2) +
+				"Timing for main: time 2020-12-25_12:00:00 on domain   3:    0.5",
+			"wrfrst_d01_2020-12-25_06:00:00": "",
+			"wrfrst_d02_2020-12-25_06:00:00": "",
+			"wrfrst_d03_2020-12-25_06:00:00": "",
+			"wrfrst_d01_2020-12-25_12:00:00": "",
+			"wrfrst_d02_2020-12-25_12:00:00": "",
+			"wrfrst_d03_2020-12-25_12:00:00": "",
+		})
+		instant, ok := simulation.LatestRestart(dir, 3, start, end)
+		assert.True(t, ok)
+		assert.Equal(t, start.Add(6*time.Hour), instant)
+	})
+
+	t.Run("LogsOfPreviousAttempts", func(t *testing.T) {
+		dir := newDir(t, map[string]string{
+			"rsl.out.0000.0":                 wrfLog("2020-12-25_06:00:00", 1),
+			"rsl.out.0000.1":                 wrfLog("2020-12-25_12:00:00", 1),
+			"rsl.out.0000":                   "",
+			"wrfrst_d01_2020-12-25_06:00:00": "",
+			"wrfrst_d01_2020-12-25_12:00:00": "",
+		})
+		instant, ok := simulation.LatestRestart(dir, 1, start, end)
+		assert.True(t, ok)
+		assert.Equal(t, start.Add(12*time.Hour), instant)
+	})
+
+	t.Run("IgnoresMissingFiles", func(t *testing.T) {
+		dir := newDir(t, map[string]string{
+			"rsl.out.0000":                   wrfLog("2020-12-25_06:00:00", 1) + wrfLog("2020-12-25_12:00:00", 1),
+			"wrfrst_d01_2020-12-25_06:00:00": "",
+		})
+		instant, ok := simulation.LatestRestart(dir, 1, start, end)
+		assert.True(t, ok)
+		assert.Equal(t, start.Add(6*time.Hour), instant)
+	})
+
+	t.Run("IgnoresSetsOutsideForecast", func(t *testing.T) {
+		dir := newDir(t, map[string]string{
+			"rsl.out.0000": wrfLog("2020-12-25_00:00:00", 1) +
+				wrfLog("2020-12-27_00:00:00", 1) +
+				wrfLog("2020-12-25_06:30:00", 1),
+			"wrfrst_d01_2020-12-25_00:00:00": "",
+			"wrfrst_d01_2020-12-27_00:00:00": "",
+			"wrfrst_d01_2020-12-25_06:30:00": "",
+		})
+		_, ok := simulation.LatestRestart(dir, 1, start, end)
+		assert.False(t, ok)
+	})
+
+	t.Run("MissingDir", func(t *testing.T) {
+		_, ok := simulation.LatestRestart(filepath.Join(t.TempDir(), "missing"), 3, start, end)
+		assert.False(t, ok)
+	})
+}
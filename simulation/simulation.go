@@ -1,14 +1,11 @@
 package simulation
 
 import (
-	"bufio"
+	"context"
 	"fmt"
-	"io"
 	"math/rand"
 	"os"
 	"path/filepath"
-	"strconv"
-	"strings"
 	"time"
 
 	"github.com/meteocima/ensemble-runner/conf"
@@ -16,7 +13,6 @@ import (
 	"github.com/meteocima/ensemble-runner/folders"
 	"github.com/meteocima/ensemble-runner/log"
 	"github.com/meteocima/ensemble-runner/mpiman"
-	"github.com/meteocima/ensemble-runner/par"
 	"github.com/meteocima/ensemble-runner/server"
 )
 
@@ -25,439 +21,506 @@ type Simulation struct {
 	Duration time.Duration
 	Workdir  string
 	Nodes    mpiman.SlurmNodes
+	Opts     Options
+	Conf     *conf.Config
+
+	// cores allocates the cores of Nodes
+	// to the MPI steps of the simulation.
+	cores *mpiman.Allocator
+	// ctx is done when the simulation must be stopped,
+	// stopping all the processes it's running.
+	ctx context.Context
+}
+
+// Options changes the way simulations are run.
+type Options struct {
+	// Resume the simulation from the first step not
+	// completed by a previous run, instead of removing
+	// its workdir and starting from scratch.
+	Resume bool
+	// Plan prints the steps the simulation would
+	// run, without running any of them.
+	Plan bool
 }
 
 var ShortDtFormat = "2006-01-02-15"
 
+// journalFile is the name of the file, inside the
+// workdir, that records the completed steps.
+const journalFile = "completed_steps.log"
+
 var join = filepath.Join
 
 type SimDirs struct {
 	wpsdir        string
-	wrf18dir      string
-	wrf21dir      string
 	wrf00dir      string
 	wpsOutputsDir string
-	da18dir       []string
-	da21dir       []string
-	da00dir       []string
 }
 
-func (s *Simulation) run() {
-	// define directories vars for the workdir of various steps of the simulation:
-	// da dirs have one dir for every domain
-	dirs := simDirs(s)
+// run runs the simulation, returning the number
+// of members of the forecast that failed. Any
+// other failure stops the simulation.
+func (s *Simulation) run() (membersFailed int) {
+	if s.Opts.Plan {
+		s.PrintPlan(os.Stdout)
+		return 0
+	}
 
 	// start simulation
 	log.Info("Starting simulation from %s for %.0f hours", s.Start.Format(ShortDtFormat), s.Duration.Hours())
 	log.Info("  -- $WORKDIR=%s", s.Workdir)
 
-	// in case the workdir for this particular date already exists, it is removed.
-	if server.DirExists(s.Workdir) {
+	// in case the workdir for this particular date already exists, it is removed,
+	// unless the simulation is resumed.
+	if s.Opts.Resume {
+		log.Info("  -- Resuming from steps journal $WORKDIR/%s", journalFile)
+	} else if server.DirExists(s.Workdir) {
 		server.Rmdir(s.Workdir)
 	}
+	server.MkdirAll(s.Workdir, 0775)
 
-	defer errors.OnFailuresDo(func(err errors.RunTimeError) {
-		panic(err)
-	})
+	graph := s.Graph()
+	graph.Journal = errors.CheckResult(OpenJournal(join(s.Workdir, journalFile)))
+	graph.AllocationTimeout = s.Conf.AllocationTimeout
 
-	// assimilation happens in domain from firstDomain to 3,
-	// so if the configuration specifies to assimilate only the
-	// inner domain we set firstDomain=3
-	firstDomain := 1
-	if conf.Values.AssimilateOnlyInnerDomain {
-		firstDomain = 3
+	if !s.Opts.Resume {
+		outfLogPath := filepath.Join(s.Workdir, "output_files.log")
+		if err := os.Remove(outfLogPath); err != nil && !os.IsNotExist(err) {
+			log.Warning("Cannot remove %s: %s", outfLogPath, err)
+		}
 	}
 
+	// execute all steps of the simulation, including
+	// the control forecast and all ensemble members
+	s.cores = s.newAllocator()
+	failures := graph.Run(s.ctx, s.Conf.EnsembleParallelism, s.cores)
+	if err := s.ctx.Err(); err != nil {
+		errors.FailF("simulation stopped: %w", err)
+	}
+
+	// failed members of the forecast don't stop the simulation,
+	// every other failure does.
+	for _, f := range failures {
+		if f.Step.Kind != ForecastStep {
+			errors.FailErr(f)
+		}
+		membersFailed++
+	}
+
+	if membersFailed > 0 {
+		log.Warning("One or more members of the forecast failed to run.")
+		return membersFailed
+	}
+
+	log.Info("Post-processing results.")
+
+	log.Info("Simulation completed successfully.")
+	return 0
+}
+
+// Graph returns the graph of all the steps needed
+// to run the simulation with the current configuration.
+//
+// Building the graph does not touch the file system
+// nor run any process: this happens only when the
+// graph is run.
+func (s *Simulation) Graph() *Graph {
+	g := &Graph{}
+
+	// define directories vars for the workdir of various steps of the simulation
+	dirs := simDirs(s)
+
 	// create all directories for the various wrf and wrfda cycles.
 	// and, if needed, for WPS
-	s.createSimulationDirectories()
+	s.addSimulationDirectories(g)
 
 	// if an ensemble is requested, create the directories for the ensemble members
 	// and calculate the seed for each member
-	if conf.Values.EnsembleMembers > 0 {
-		rnd := rand.NewSource(0xfeedbabebadcafe)
-
-		for ensnum := 1; ensnum <= conf.Values.EnsembleMembers; ensnum++ {
-			seed := rnd.Int63()%100 + 1
-			os.Setenv("ENSEMBLE_SEED", fmt.Sprintf("%02d", seed))
-			log.Debug("Using seed %02d for member n.%d.", seed, ensnum)
-
+	for ensnum := 1; ensnum <= s.Conf.EnsembleMembers; ensnum++ {
+		template, _ := s.forecastTemplate(ensnum)
+		g.Add(s.renderStep(folders.WrfEnsembleProcWorkdir(s.Workdir, s.Start, ensnum), template, s.Start, int(s.Duration.Hours()), func() {
 			s.createWrfEnsembleMemberDir(s.Start, s.Duration, ensnum)
-		}
+		}))
 	}
 
 	// if WPS execution is requested, initial and boundary conditions are copied from the outputs of WPS.
 	// otherwise, they are copied from the inputs directory.
-	if conf.Values.RunWPS {
+	if s.Conf.RunWPS {
 		// WPS: run geogrid, ungrib, metgrid
 		// if WPS preproccing is requested in configuration
-		var start time.Time
-		var duration time.Duration
-
-		// if assimilation is requested, we need to run WPS
-		// for 6 hours before the start of the forecast
-		if conf.Values.AssimilateObservations {
-			start = s.Start.Add(-6 * time.Hour)
-			duration = s.Duration + 6*time.Hour
-		} else {
-			start = s.Start
-			duration = s.Duration
-		}
+		start, duration := s.wpsPeriod()
+
+		wpsdir := dirs.wpsdir
+		geoEm := s.domainFiles(wpsdir, "geo_em.d%02d.nc")
+		g.Add(&Step{
+			ID:       "geogrid",
+			Kind:     ProcessStep,
+			Workdir:  wpsdir,
+			Outputs:  geoEm,
+			Procs:    s.Conf.GeogridProcCount,
+			Run:      s.RunGeogrid,
+			Describe: s.describeCommand(wpsdir, s.geogridCommand),
+		})
 
-		s.RunGeogrid()
+		gribFile := join(wpsdir, "GRIBFILE.AAA")
+		g.Add(&Step{
+			ID:      "link_grib",
+			Kind:    ProcessStep,
+			Workdir: wpsdir,
+			Outputs: []string{gribFile},
+			Run: func(mpiman.Allocation) {
+				s.RunLinkGrib(start)
+			},
+			Describe: s.describeCommand(wpsdir, func(mpiman.Allocation) string {
+				return s.linkGribCommand(start)
+			}),
+		})
 
-		s.RunLinkGrib(start)
-		s.RunUngrib()
+		ungribFile := join(wpsdir, "FILE:"+start.Format("2006-01-02_15"))
+		g.Add(&Step{
+			ID:      "ungrib",
+			Kind:    ProcessStep,
+			Workdir: wpsdir,
+			Inputs:  []string{gribFile},
+			Outputs: []string{ungribFile},
+			Run: func(mpiman.Allocation) {
+				s.RunUngrib()
+			},
+			Describe: s.describeCommand(wpsdir, func(mpiman.Allocation) string {
+				return "./ungrib.exe"
+			}),
+		})
+		metgridInputs := append([]string{ungribFile}, geoEm...)
 
 		// if the forecast is longer than 24 hours,
 		// eventually accounting for the 6 hours of
 		// assimilation, we need to run avgtsfc
 		if duration > 24*time.Hour {
-			s.RunAvgtsfc()
+			avgFile := join(wpsdir, "TAVGSFC")
+			g.Add(&Step{
+				ID:      "avg_tsfc",
+				Kind:    ProcessStep,
+				Workdir: wpsdir,
+				Inputs:  []string{ungribFile},
+				Outputs: []string{avgFile},
+				Run: func(mpiman.Allocation) {
+					s.RunAvgtsfc()
+				},
+				Describe: s.describeCommand(wpsdir, func(mpiman.Allocation) string {
+					return "./avg_tsfc.exe"
+				}),
+			})
+			metgridInputs = append(metgridInputs, avgFile)
 		}
 
-		s.RunMetgrid()
+		// metgrid produces the met_em files for the whole
+		// period: here we declare only the ones used as initial
+		// conditions by the various executions of real.exe
+		var metgridOutputs []string
+		for _, realStart := range s.realStarts() {
+			metgridOutputs = append(metgridOutputs, s.metEmFiles(wpsdir, realStart)...)
+		}
+		g.Add(&Step{
+			ID:       "metgrid",
+			Kind:     ProcessStep,
+			Workdir:  wpsdir,
+			Inputs:   metgridInputs,
+			Outputs:  metgridOutputs,
+			Procs:    s.Conf.MetgridProcCount,
+			Run:      s.RunMetgrid,
+			Describe: s.describeCommand(wpsdir, s.metgridCommand),
+		})
 
 		// creates the directory for WPS outputs.
 		// it will be called inputs because it
 		// contains the input datasets for the forecast
-		server.MkdirAll(dirs.wpsOutputsDir, 0775)
+		g.Add(&Step{
+			ID:      "mkdir " + s.relPath(dirs.wpsOutputsDir),
+			Kind:    MkdirStep,
+			Workdir: dirs.wpsOutputsDir,
+			Outputs: []string{dirs.wpsOutputsDir},
+			Run: func(mpiman.Allocation) {
+				server.MkdirAll(dirs.wpsOutputsDir, 0775)
+			},
+			Describe: func(mpiman.Allocation) string {
+				return "create directory " + s.displayPath(dirs.wpsOutputsDir)
+			},
+		})
 
-		if conf.Values.AssimilateObservations {
-			// run real for every cycle of assimilation and for the main forecast.
+		if s.Conf.AssimilateObservations {
+			// run real for every cycle of assimilation, the last of which is the start of main forecast.
 			// initial conditions are copied from the outputs of execution of real.exe for the first cycle,
 			// boundary conditions are copied from the outputs of execution of real.exe for every cycle.
 			// namelist for the execution of the various real.exe are copied from the wrf directories of every cycle.
-			server.CopyFile(s.Workdir, join(dirs.wrf18dir, "namelist.input"), join(dirs.wpsdir, "namelist.input"))
-			s.RunReal(s.Start.Add(-6 * time.Hour))
-			server.CopyFile(s.Workdir, join(dirs.wpsdir, "wrfbdy_d01"), join(dirs.wpsOutputsDir, "wrfbdy_d01_da01"))
-			server.CopyFile(s.Workdir, join(dirs.wpsdir, "wrfinput_d01"), join(dirs.wpsOutputsDir, "wrfinput_d01"))
-			server.CopyFile(s.Workdir, join(dirs.wpsdir, "wrfinput_d02"), join(dirs.wpsOutputsDir, "wrfinput_d02"))
-			server.CopyFile(s.Workdir, join(dirs.wpsdir, "wrfinput_d03"), join(dirs.wpsOutputsDir, "wrfinput_d03"))
-
-			server.CopyFile(s.Workdir, join(dirs.wrf21dir, "namelist.input"), join(dirs.wpsdir, "namelist.input"))
-			s.RunReal(s.Start.Add(-3 * time.Hour))
-			server.CopyFile(s.Workdir, join(dirs.wpsdir, "wrfbdy_d01"), join(dirs.wpsOutputsDir, "wrfbdy_d01_da02"))
-
-			server.CopyFile(s.Workdir, join(dirs.wrf00dir, "namelist.input"), join(dirs.wpsdir, "namelist.input"))
-			s.RunReal(s.Start)
-			server.CopyFile(s.Workdir, join(dirs.wpsdir, "wrfbdy_d01"), join(dirs.wpsOutputsDir, "wrfbdy_d01_da03"))
+			for cycle, start := range s.cycles() {
+				wrfdir := folders.WrfControlProcWorkdir(s.Workdir, start)
+				g.Add(s.copyStep(join(wrfdir, "namelist.input"), join(dirs.wpsdir, "namelist.input")))
+				g.Add(s.realStep(start))
+				g.Add(s.copyStep(join(dirs.wpsdir, "wrfbdy_d01"), join(dirs.wpsOutputsDir, cycleBdyFile(cycle+1))))
+				if cycle == 0 {
+					s.addWrfinputCopies(g, dirs.wpsdir, dirs.wpsOutputsDir)
+				}
+			}
 		} else {
 			// run real for the main forecast.
 			// namelist for the execution of real.exe is copied from the wrf00 directory.
 			// initial and boundary conditions are copied from the outputs of execution of real.exe
-			server.CopyFile(s.Workdir, join(dirs.wrf00dir, "namelist.input"), join(dirs.wpsdir, "namelist.input"))
-			s.RunReal(s.Start)
-			server.CopyFile(s.Workdir, join(dirs.wpsdir, "wrfbdy_d01"), join(dirs.wpsOutputsDir, "wrfbdy_d01"))
-			server.CopyFile(s.Workdir, join(dirs.wpsdir, "wrfinput_d01"), join(dirs.wpsOutputsDir, "wrfinput_d01"))
-			server.CopyFile(s.Workdir, join(dirs.wpsdir, "wrfinput_d02"), join(dirs.wpsOutputsDir, "wrfinput_d02"))
-			server.CopyFile(s.Workdir, join(dirs.wpsdir, "wrfinput_d03"), join(dirs.wpsOutputsDir, "wrfinput_d03"))
+			g.Add(s.copyStep(join(dirs.wrf00dir, "namelist.input"), join(dirs.wpsdir, "namelist.input")))
+			g.Add(s.realStep(s.Start))
+			g.Add(s.copyStep(join(dirs.wpsdir, "wrfbdy_d01"), join(dirs.wpsOutputsDir, "wrfbdy_d01")))
+			s.addWrfinputCopies(g, dirs.wpsdir, dirs.wpsOutputsDir)
 		}
 
 	}
 
-	// if assimilation is requested, we need to run the 3 cycles of assimilation.
+	// if assimilation is requested, we need to run all the cycles of assimilation.
 	// for every cycle, we need to run WRF from the start of the cycle to the end of the cycle,
 	// in order to advance the time of the initiali conditions for the next phase.
-	// Result sof the last cycle will be copied to the wrf directory of the main forecast.
-
-	// here we assimilate the 1 cycle.
-	if conf.Values.AssimilateObservations {
-		// Assimilation of first cycle is optional: if not requested,
-		// initial and boundary conditions are copied directly from wps
-		// into the first cycle wrf directory.
-		if conf.Values.AssimilateFirstCycle {
-			// assimilate D-6 (first cycle) for all domains
-			if !conf.Values.AssimilateOnlyInnerDomain {
-				server.CopyFile(s.Workdir, join(dirs.wpsOutputsDir, "wrfbdy_d01_da01"), join(dirs.da18dir[1], "wrfbdy_d01"))
-			}
-			for domain := firstDomain; domain <= 3; domain++ {
-				// input condition are copied from wps
-				server.CopyFile(s.Workdir, join(dirs.wpsOutputsDir, fmt.Sprintf("wrfinput_d%02d", domain)), join(dirs.da18dir[domain], "fg"))
-				s.RunDa(s.Start.Add(-6*time.Hour), domain)
+	// The last cycle happens in the wrf directory of the main forecast.
+	if s.Conf.AssimilateObservations {
+		cycles := s.cycles()
+		for cycle, start := range cycles {
+			// input conditions of the first cycle are copied from wps,
+			// the ones of the subsequent cycles from previous cycle wrf.
+			fg := func(domain int) string {
+				return join(dirs.wpsOutputsDir, fmt.Sprintf("wrfinput_d%02d", domain))
 			}
-
-			// to run WRF from D-6 to D-3, input and boundary conditions are copied from da dirs of first cycle.
-			if !conf.Values.AssimilateOnlyInnerDomain {
-				server.CopyFile(s.Workdir, join(dirs.da18dir[1], "wrfbdy_d01"), join(dirs.wrf18dir, "wrfbdy_d01"))
-			} else {
-				server.CopyFile(s.Workdir, join(dirs.wpsOutputsDir, "wrfbdy_d01_da01"), join(dirs.wrf18dir, "wrfbdy_d01"))
-			}
-			for domain := firstDomain; domain <= 3; domain++ {
-				server.CopyFile(s.Workdir, join(dirs.da18dir[domain], "wrfvar_output"), join(dirs.wrf18dir, fmt.Sprintf("wrfinput_d%02d", domain)))
-			}
-			if conf.Values.AssimilateOnlyInnerDomain {
-				for domain := 1; domain <= 2; domain++ {
-					server.CopyFile(s.Workdir, join(dirs.wpsOutputsDir, fmt.Sprintf("wrfinput_d%02d", domain)), join(dirs.wrf18dir, fmt.Sprintf("wrfinput_d%02d", domain)))
+			if cycle > 0 {
+				prevWrfdir := folders.WrfControlProcWorkdir(s.Workdir, cycles[cycle-1])
+				fg = func(domain int) string {
+					return join(prevWrfdir, fmt.Sprintf("wrfvar_input_d%02d", domain))
 				}
 			}
 
-		} else {
-			// to run WRF from D-6 to D-3, input and boundary conditions are copied from wps.
-			server.CopyFile(s.Workdir, join(dirs.wpsOutputsDir, "wrfbdy_d01_da01"), join(dirs.wrf18dir, "wrfbdy_d01"))
-			for domain := 1; domain <= 3; domain++ {
-				server.CopyFile(s.Workdir, join(dirs.wpsOutputsDir, fmt.Sprintf("wrfinput_d%02d", domain)), join(dirs.wrf18dir, fmt.Sprintf("wrfinput_d%02d", domain)))
+			// Assimilation of first cycle is optional: if not requested,
+			// initial and boundary conditions are copied directly from wps
+			// into the first cycle wrf directory.
+			assimilate := cycle > 0 || s.Conf.AssimilateFirstCycle
+			s.addCycle(g, assimilate, start, join(dirs.wpsOutputsDir, cycleBdyFile(cycle+1)), fg)
+
+			// run WRF up to the start of next cycle.
+			if cycle < len(cycles)-1 {
+				g.Add(s.wrfStep(start))
 			}
 		}
 	} else {
-		server.CopyFile(s.Workdir, join(dirs.wpsOutputsDir, "wrfbdy_d01"), join(dirs.wrf00dir, "wrfbdy_d01"))
-		for domain := 1; domain <= 3; domain++ {
-			server.CopyFile(s.Workdir, join(dirs.wpsOutputsDir, fmt.Sprintf("wrfinput_d%02d", domain)), join(dirs.wrf00dir, fmt.Sprintf("wrfinput_d%02d", domain)))
-		}
+		s.addCycle(g, false, s.Start,
+			join(dirs.wpsOutputsDir, "wrfbdy_d01"),
+			func(domain int) string {
+				return join(dirs.wpsOutputsDir, fmt.Sprintf("wrfinput_d%02d", domain))
+			},
+		)
 	}
 
-	// Assimilation cycles 2 and 3
-	if conf.Values.AssimilateObservations {
-		// run WRF from D-6 to D-3.
-		s.RunWrfStep(s.Start.Add(-6 * time.Hour))
-
-		// assimilate D-3 (second cycle) for all domains
-		if !conf.Values.AssimilateOnlyInnerDomain {
-			server.CopyFile(s.Workdir, join(dirs.wpsOutputsDir, "wrfbdy_d01_da02"), join(dirs.da21dir[1], "wrfbdy_d01"))
-		}
-		for domain := firstDomain; domain <= 3; domain++ {
-			// input condition are copied from previous cycle wrf
-			server.CopyFile(s.Workdir, join(dirs.wrf18dir, fmt.Sprintf("wrfvar_input_d%02d", domain)), join(dirs.da21dir[domain], "fg"))
-			s.RunDa(s.Start.Add(-3*time.Hour), domain)
-		}
+	// if an ensemble is procduced, copy wrfinput and wrfbdy from control forecast to all ensemble members
+	for ensnum := 1; ensnum <= s.Conf.EnsembleMembers; ensnum++ {
+		ensdir := folders.WrfEnsembleProcWorkdir(s.Workdir, s.Start, ensnum)
+		s.addWrfinputCopies(g, dirs.wrf00dir, ensdir)
+		g.Add(s.copyStep(join(dirs.wrf00dir, "wrfbdy_d01"), join(ensdir, "wrfbdy_d01")))
+	}
 
-		// run WRF from D-3 to D. input and boundary conditions are copied from da dirs of second cycle.
-		// boundary condition are copied from wps
-		if conf.Values.AssimilateOnlyInnerDomain {
-			server.CopyFile(s.Workdir, join(dirs.wpsOutputsDir, "wrfbdy_d01_da02"), join(dirs.wrf21dir, "wrfbdy_d01"))
-		} else {
-			server.CopyFile(s.Workdir, join(dirs.da21dir[1], "wrfbdy_d01"), join(dirs.wrf21dir, "wrfbdy_d01"))
-		}
+	// execute control forecast and all ensemble members
+	for ensnum := 0; ensnum <= s.Conf.EnsembleMembers; ensnum++ {
+		g.Add(s.forecastStep(ensnum))
+	}
 
-		for domain := firstDomain; domain <= 3; domain++ {
-			server.CopyFile(s.Workdir, join(dirs.da21dir[domain], "wrfvar_output"), join(dirs.wrf21dir, fmt.Sprintf("wrfinput_d%02d", domain)))
-		}
-		if conf.Values.AssimilateOnlyInnerDomain {
-			for domain := 1; domain <= 2; domain++ {
-				server.CopyFile(s.Workdir, join(dirs.wrf18dir, fmt.Sprintf("wrfvar_input_d%02d", domain)), join(dirs.wrf21dir, fmt.Sprintf("wrfinput_d%02d", domain)))
-			}
-		}
+	return g
+}
 
-		s.RunWrfStep(s.Start.Add(-3 * time.Hour))
+// addCycle adds to g the steps that prepare the initial and boundary
+// conditions of the wrf.exe run starting at instant.
+//
+// When assimilate is true, observations are assimilated in the
+// domains configured to do so. Initial conditions of every domain
+// are read from fg(domain), boundary conditions from bdy.
+func (s *Simulation) addCycle(g *Graph, assimilate bool, instant time.Time, bdy string, fg func(domain int) string) {
+	assimilated := func(domain int) bool {
+		return assimilate && s.Conf.Domains[domain-1].Assimilate
+	}
+	wrfdir := folders.WrfControlProcWorkdir(s.Workdir, instant)
+	dadirs := []string{""}
+	for domain := 1; domain <= len(s.Conf.Domains); domain++ {
+		dadirs = append(dadirs, folders.DAProcWorkdir(s.Workdir, instant, domain))
+	}
 
-		// assimilate D (third cycle) for all domains
-		if !conf.Values.AssimilateOnlyInnerDomain {
-			server.CopyFile(s.Workdir, join(dirs.wpsOutputsDir, "wrfbdy_d01_da03"), join(dirs.da00dir[1], "wrfbdy_d01"))
-		}
-		for domain := firstDomain; domain <= 3; domain++ {
-			// input condition are copied from previous cycle wrf
-			server.CopyFile(s.Workdir, join(dirs.wrf21dir, fmt.Sprintf("wrfvar_input_d%02d", domain)), join(dirs.da00dir[domain], "fg"))
-			s.RunDa(s.Start, domain)
+	// boundary conditions are updated by the
+	// assimilation of the outer domain.
+	if assimilated(1) {
+		g.Add(s.copyStep(bdy, join(dadirs[1], "wrfbdy_d01")))
+	}
+	for domain := 1; domain <= len(s.Conf.Domains); domain++ {
+		if assimilated(domain) {
+			g.Add(s.copyStep(fg(domain), join(dadirs[domain], "fg")))
+			g.Add(s.daStep(instant, domain))
 		}
+	}
 
-		if conf.Values.AssimilateOnlyInnerDomain {
-			server.CopyFile(s.Workdir, join(dirs.wpsOutputsDir, "wrfbdy_d01_da03"), join(dirs.wrf00dir, "wrfbdy_d01"))
+	if assimilated(1) {
+		g.Add(s.copyStep(join(dadirs[1], "wrfbdy_d01"), join(wrfdir, "wrfbdy_d01")))
+	} else {
+		g.Add(s.copyStep(bdy, join(wrfdir, "wrfbdy_d01")))
+	}
+	for domain := 1; domain <= len(s.Conf.Domains); domain++ {
+		wrfinput := join(wrfdir, fmt.Sprintf("wrfinput_d%02d", domain))
+		if assimilated(domain) {
+			g.Add(s.copyStep(join(dadirs[domain], "wrfvar_output"), wrfinput))
 		} else {
-			server.CopyFile(s.Workdir, join(dirs.da00dir[1], "wrfbdy_d01"), join(dirs.wrf00dir, "wrfbdy_d01"))
+			g.Add(s.copyStep(fg(domain), wrfinput))
 		}
-		// run WRF from D for the duration of the forecast. input and boundary conditions are copied from da dirs of third cycle.
-		for domain := firstDomain; domain <= 3; domain++ {
-			server.CopyFile(s.Workdir, join(dirs.da00dir[domain], "wrfvar_output"), join(dirs.wrf00dir, fmt.Sprintf("wrfinput_d%02d", domain)))
+	}
+}
+
+// addWrfinputCopies adds to g the steps that copy the
+// wrfinput file of every domain from srcdir to dstdir.
+func (s *Simulation) addWrfinputCopies(g *Graph, srcdir, dstdir string) {
+	for domain := 1; domain <= len(s.Conf.Domains); domain++ {
+		name := fmt.Sprintf("wrfinput_d%02d", domain)
+		g.Add(s.copyStep(join(srcdir, name), join(dstdir, name)))
+	}
+}
+
+func (s *Simulation) addSimulationDirectories(g *Graph) {
+	g.Add(s.renderStep(folders.WrfControlProcWorkdir(s.Workdir, s.Start), "wrf-forecast", s.Start, int(s.Duration.Hours()), func() {
+		s.createWrfControlForecastDir(s.Start, s.Duration)
+	}))
+	if s.Conf.AssimilateObservations {
+		cycles := s.cycles()
+		for _, start := range cycles[:len(cycles)-1] {
+			g.Add(s.renderStep(folders.WrfControlProcWorkdir(s.Workdir, start), "wrf-step", start, s.cycleHours(), func() {
+				s.createWrfStepDir(start)
+			}))
 		}
-		if conf.Values.AssimilateOnlyInnerDomain {
-			for domain := 1; domain <= 2; domain++ {
-				server.CopyFile(s.Workdir, join(dirs.wrf21dir, fmt.Sprintf("wrfvar_input_d%02d", domain)), join(dirs.wrf00dir, fmt.Sprintf("wrfinput_d%02d", domain)))
+		for domain, dom := range s.Conf.Domains {
+			if !dom.Assimilate {
+				continue
+			}
+			domain := domain + 1
+			for _, start := range cycles {
+				g.Add(s.renderStep(folders.DAProcWorkdir(s.Workdir, start, domain), fmt.Sprintf("wrfda_%02d", domain), start, s.cycleHours(), func() {
+					s.createDaDir(start, domain)
+				}))
 			}
 		}
 	}
 
-	// if an ensemble is procduced, copy wrfinput and wrfbdy from control forecast to all ensemble members
-	for ensnum := 1; ensnum <= conf.Values.EnsembleMembers; ensnum++ {
-		ensdir := folders.WrfEnsembleProcWorkdir(s.Workdir, s.Start, ensnum)
-		server.CopyFile(s.Workdir, join(dirs.wrf00dir, "wrfinput_d01"), join(ensdir, "wrfinput_d01"))
-		server.CopyFile(s.Workdir, join(dirs.wrf00dir, "wrfinput_d02"), join(ensdir, "wrfinput_d02"))
-		server.CopyFile(s.Workdir, join(dirs.wrf00dir, "wrfinput_d03"), join(ensdir, "wrfinput_d03"))
-		server.CopyFile(s.Workdir, join(dirs.wrf00dir, "wrfbdy_d01"), join(ensdir, "wrfbdy_d01"))
+	if s.Conf.RunWPS {
+		start, duration := s.wpsPeriod()
+		g.Add(s.renderStep(folders.WPSProcWorkdir(s.Workdir), "wps", start, int(duration.Hours()), func() {
+			s.createWpsDir(start, duration)
+		}))
 	}
+}
 
-	// execute control forecast and all ensemble members
-	failed := runForecast(s)
-
-	if <-failed {
-		log.Warning("One or more members of the forecast failed to run.")
-		return
+// wpsPeriod returns the start and duration of the
+// period WPS have to preprocess.
+func (s *Simulation) wpsPeriod() (start time.Time, duration time.Duration) {
+	// if assimilation is requested, we need to run WPS
+	// from the start of the first cycle
+	if s.Conf.AssimilateObservations {
+		start := s.cycles()[0]
+		return start, s.Duration + s.Start.Sub(start)
 	}
-
-	log.Info("Post-processing results.")
-
-	log.Info("Simulation completed successfully.")
-
+	return s.Start, s.Duration
 }
 
-func (s *Simulation) createSimulationDirectories() {
-	firstDomain := 1
-	if conf.Values.AssimilateOnlyInnerDomain {
-		firstDomain = 3
-	}
-	s.createWrfControlForecastDir(s.Start, s.Duration)
-	if conf.Values.AssimilateObservations {
-		s.createWrfStepDir(s.Start.Add(-6 * time.Hour))
-		s.createWrfStepDir(s.Start.Add(-3 * time.Hour))
-		for domain := firstDomain; domain <= 3; domain++ {
-			s.createDaDir(s.Start.Add(-6*time.Hour), domain)
-			s.createDaDir(s.Start.Add(-3*time.Hour), domain)
-			s.createDaDir(s.Start, domain)
-		}
+// cycles returns the start instants of every assimilation
+// cycle, the last of which is the start of the forecast.
+func (s *Simulation) cycles() []time.Time {
+	schedule := s.Conf.AssimilationCycles
+	res := make([]time.Time, schedule.Count)
+	for cycle := range res {
+		res[cycle] = s.Start.Add(-time.Duration(schedule.Count-1-cycle) * schedule.Interval)
 	}
+	return res
+}
 
-	if conf.Values.RunWPS {
-
-		var start time.Time
-		var duration time.Duration
-		if conf.Values.AssimilateObservations {
-			start = s.Start.Add(-6 * time.Hour)
-			duration = s.Duration + 6*time.Hour
-		} else {
-			start = s.Start
-			duration = s.Duration
-		}
+// cycleBdyFile returns the name of the file, in the WPS outputs
+// directory, containing the boundary conditions for the cycle
+// number `cycle` (starting from 1).
+func cycleBdyFile(cycle int) string {
+	return fmt.Sprintf("wrfbdy_d01_da%02d", cycle)
+}
 
-		s.createWpsDir(start, duration)
+// realStarts returns the start instants of
+// every execution of real.exe.
+func (s *Simulation) realStarts() []time.Time {
+	if s.Conf.AssimilateObservations {
+		return s.cycles()
 	}
+	return []time.Time{s.Start}
 }
 
 func simDirs(s *Simulation) SimDirs {
 	dirs := SimDirs{
 		wpsdir:        folders.WPSProcWorkdir(s.Workdir),
-		wrf18dir:      folders.WrfControlProcWorkdir(s.Workdir, s.Start.Add(-6*time.Hour)),
-		wrf21dir:      folders.WrfControlProcWorkdir(s.Workdir, s.Start.Add(-3*time.Hour)),
 		wrf00dir:      folders.WrfControlProcWorkdir(s.Workdir, s.Start),
 		wpsOutputsDir: folders.WPSOutputsDir(s.Start),
-
-		da18dir: []string{
-			"",
-			folders.DAProcWorkdir(s.Workdir, s.Start.Add(-6*time.Hour), 1),
-			folders.DAProcWorkdir(s.Workdir, s.Start.Add(-6*time.Hour), 2),
-			folders.DAProcWorkdir(s.Workdir, s.Start.Add(-6*time.Hour), 3),
-		},
-		da21dir: []string{
-			"",
-			folders.DAProcWorkdir(s.Workdir, s.Start.Add(-3*time.Hour), 1),
-			folders.DAProcWorkdir(s.Workdir, s.Start.Add(-3*time.Hour), 2),
-			folders.DAProcWorkdir(s.Workdir, s.Start.Add(-3*time.Hour), 3),
-		},
-		da00dir: []string{
-			"",
-			folders.DAProcWorkdir(s.Workdir, s.Start, 1),
-			folders.DAProcWorkdir(s.Workdir, s.Start, 2),
-			folders.DAProcWorkdir(s.Workdir, s.Start, 3),
-		},
 	}
 	return dirs
 }
 
-func runForecast(s *Simulation) chan bool {
-	failed := make(chan bool, conf.Values.EnsembleMembers)
-
-	go func() {
-		var w par.Work[int]
-		for ensnum := 0; ensnum <= conf.Values.EnsembleMembers; ensnum++ {
-			w.Add(ensnum)
-		}
-		outfLogPath := filepath.Join(s.Workdir, "output_files.log")
-
-		if err := os.Remove(outfLogPath); err != nil {
-			log.Warning("Cannot remove %s: %s", outfLogPath, err)
-		}
-
-		w.Do(conf.Values.EnsembleParallelism, func(ensnum int) {
-			err := s.RunWrfEnsemble(s.Start, ensnum)
-			if err != nil {
-				log.Error("Member %d failed: %s", ensnum, err)
-				failed <- true
-			}
-		})
-		close(failed)
-	}()
-	return failed
+// checkEnvironment checks that the simulations described by cfg
+// can run in the current environment, as conf.Config.CheckEnvironment
+// does. When only the plan of the simulations is requested, the
+// problems found are logged as warnings instead.
+func checkEnvironment(cfg *conf.Config, opts Options) error {
+	err := cfg.CheckEnvironment()
+	if err != nil && opts.Plan {
+		log.Warning("The simulations cannot run in this environment: %s", err)
+		return nil
+	}
+	return err
 }
 
-func RunForecastsFromInputs() {
-	nodesStr, ok := os.LookupEnv("SLURM_NODELIST")
-	if !ok {
-		fmt.Fprintln(os.Stderr, "$SLURM_NODELIST not set")
-		os.Exit(1)
+// discoverNodes returns the nodes available for the simulation,
+// read from the source configured in cfg. When only the plan of
+// the simulation is printed, nodes are not required.
+func discoverNodes(cfg *conf.Config, opts Options) mpiman.SlurmNodes {
+	source := cfg.NodeSource()
+	if (source == nil || !source.Available()) && opts.Plan {
+		log.Warning("Nodes of the allocation not found: nodes will not be allocated in the plan.")
+		return mpiman.NewSlurmNodes()
 	}
-
-	nodes, err := mpiman.ParseSlurmNodes(nodesStr)
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "cannot parse $SLURM_NODELIST: %s\n", err)
+	if source == nil {
+		fmt.Fprintln(os.Stderr, "nodes of the allocation not found: none of $SLURM_NODELIST, $PBS_NODEFILE, $LSB_MCPU_HOSTS or $LSB_HOSTS is set, and Scheduler is not configured")
 		os.Exit(1)
 	}
-
-	for _, run := range readArgumentsFile() {
-		errors.Check(os.Setenv("START_FORECAST", run.start.Format(ShortDtFormat)))
-		errors.Check(os.Setenv("DURATION_HOURS", fmt.Sprintf("%.0f", run.duration.Hours())))
-		sim := new(run.start, run.duration, nodes)
-		sim.run()
+	if !source.Available() {
+		fmt.Fprintf(os.Stderr, "%s not set\n", source)
+		os.Exit(1)
 	}
-}
-
-type run struct {
-	start    time.Time
-	duration time.Duration
-}
 
-func readArgumentsFile() []run {
-	var runs []run
-
-	argfilePath := filepath.Join(folders.WPSOutputsRootDir(), "arguments.txt")
-	argFile := errors.CheckResult(os.Open(argfilePath))
-	defer argFile.Close()
-	argReader := bufio.NewReader(argFile)
-
-	// ignore first line, it's the config file name and is not used.
-	readline(argReader)
-
-	for {
-		line := readline(argReader)
-		if len(line) == 0 {
-			break
-		}
-		line = strings.TrimSuffix(line, "\n")
-		start := errors.CheckResult(time.Parse("2006010215", line[0:10]))
-		duration := time.Hour * time.Duration(errors.CheckResult(strconv.Atoi(line[11:])))
-		runs = append(runs, run{start, duration})
+	nodes, err := mpiman.DiscoverNodes(source)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "cannot read nodes from %s: %s\n", source, err)
+		os.Exit(1)
 	}
-	return runs
+	return nodes
 }
 
-func readline(argReader *bufio.Reader) string {
-	line, err := argReader.ReadString('\n')
-	if err == io.EOF {
-		err = nil
-	}
-	errors.Check(err)
-
-	return line
+// newAllocator returns the allocator of the cores of the nodes
+// of s. Cores are allocated also when only one MPI step runs at
+// a time, so that failing nodes are quarantined all the same.
+func (s *Simulation) newAllocator() *mpiman.Allocator {
+	cores := mpiman.NewAllocator(s.Nodes, s.Conf.CoresPerNode)
+	cores.MaxFailures = s.Conf.QuarantineAfter
+	return cores
 }
 
-func RunForecastFromEnv() {
+// RunForecastFromEnv runs the simulation starting at $START_FORECAST
+// and lasting $DURATION_HOURS. The simulation is stopped when ctx is done.
+func RunForecastFromEnv(ctx context.Context, cfg *conf.Config, opts Options) {
 	start := errors.CheckResult(time.Parse(ShortDtFormat, os.Getenv("START_FORECAST")))
 	duration := errors.CheckResult(time.ParseDuration(os.Getenv("DURATION_HOURS") + "h"))
 
-	nodesStr, ok := os.LookupEnv("SLURM_NODELIST")
-	if !ok {
-		fmt.Fprintln(os.Stderr, "$SLURM_NODELIST not set")
-		os.Exit(1)
-	}
-
-	nodes, err := mpiman.ParseSlurmNodes(nodesStr)
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "cannot parse $SLURM_NODELIST: %s\n", err)
-		os.Exit(1)
-	}
+	errors.Check(checkEnvironment(cfg, opts))
+	nodes := discoverNodes(cfg, opts)
 
-	sim := new(start, duration, nodes)
+	sim := new(ctx, cfg, start, duration, nodes, opts)
 	sim.run()
 }
 
-func new(start time.Time, duration time.Duration, nodes mpiman.SlurmNodes) Simulation {
+func new(ctx context.Context, cfg *conf.Config, start time.Time, duration time.Duration, nodes mpiman.SlurmNodes, opts Options) Simulation {
 	workdir := Workdir(start)
 
 	sim := Simulation{
@@ -465,6 +528,9 @@ func new(start time.Time, duration time.Duration, nodes mpiman.SlurmNodes) Simul
 		Duration: duration,
 		Workdir:  workdir,
 		Nodes:    nodes,
+		Opts:     opts,
+		Conf:     cfg,
+		ctx:      ctx,
 	}
 	return sim
 }
@@ -475,20 +541,62 @@ func Workdir(start time.Time) string {
 }
 
 func (s Simulation) createWpsDir(start time.Time, duration time.Duration) {
-	server.RenderTemplate(folders.WPSProcWorkdir(s.Workdir), "wps", start, int(duration.Hours()))
+	server.RenderTemplate(folders.WPSProcWorkdir(s.Workdir), "wps", start, int(duration.Hours()), s.window(), s.env()...)
 }
 
 func (s Simulation) createWrfControlForecastDir(start time.Time, duration time.Duration) {
-	server.RenderTemplate(folders.WrfControlProcWorkdir(s.Workdir, start), "wrf-forecast", start, int(duration.Hours()))
+	server.RenderTemplate(folders.WrfControlProcWorkdir(s.Workdir, start), "wrf-forecast", start, int(duration.Hours()), s.window(),
+		s.env("RESTART", ".false.")...,
+	)
 }
 func (s Simulation) createWrfEnsembleMemberDir(start time.Time, duration time.Duration, ensnum int) {
-	server.RenderTemplate(folders.WrfEnsembleProcWorkdir(s.Workdir, start, ensnum), "wrf-ensmember", start, int(duration.Hours()))
+	log.Debug("Using seed %02d for member n.%d.", memberSeed(ensnum), ensnum)
+	name, envVars := s.forecastTemplate(ensnum)
+	envVars = append(envVars, "RESTART", ".false.")
+	server.RenderTemplate(folders.WrfEnsembleProcWorkdir(s.Workdir, start, ensnum), name, start, int(duration.Hours()), s.window(), s.env(envVars...)...)
+}
+
+// memberSeed returns the seed used to perturb
+// the physics of the ensemble member ensnum.
+func memberSeed(ensnum int) int64 {
+	rnd := rand.NewSource(0xfeedbabebadcafe)
+	var seed int64
+	for i := 1; i <= ensnum; i++ {
+		seed = rnd.Int63()%100 + 1
+	}
+	return seed
 }
 
 func (s Simulation) createWrfStepDir(start time.Time) {
-	server.RenderTemplate(folders.WrfControlProcWorkdir(s.Workdir, start), "wrf-step", start, 3)
+	server.RenderTemplate(folders.WrfControlProcWorkdir(s.Workdir, start), "wrf-step", start, s.cycleHours(), s.window(), s.env()...)
 }
 
 func (s Simulation) createDaDir(start time.Time, domain int) {
-	server.RenderTemplate(folders.DAProcWorkdir(s.Workdir, start, domain), fmt.Sprintf("wrfda_%02d", domain), start, 3)
+	server.RenderTemplate(folders.DAProcWorkdir(s.Workdir, start, domain), fmt.Sprintf("wrfda_%02d", domain), start, s.cycleHours(), s.window(), s.env()...)
+}
+
+// window returns the width of the assimilation
+// window used to render the templates.
+func (s Simulation) window() time.Duration {
+	return s.Conf.AssimilationCycles.Window
+}
+
+// env returns pairs of name and value of the environment
+// variables passed to the commands run by the simulation:
+// the start and duration of the forecast, the values of the
+// configuration needed by templates, and the additional
+// pairs in envVars.
+func (s Simulation) env(envVars ...string) []string {
+	res := []string{
+		"START_FORECAST", s.Start.Format(ShortDtFormat),
+		"DURATION_HOURS", fmt.Sprintf("%.0f", s.Duration.Hours()),
+	}
+	res = append(res, s.Conf.Env()...)
+	return append(res, envVars...)
+}
+
+// cycleHours returns the duration in hours
+// of every cycle of assimilation.
+func (s Simulation) cycleHours() int {
+	return int(s.Conf.AssimilationCycles.Interval.Hours())
 }
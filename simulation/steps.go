@@ -0,0 +1,197 @@
+package simulation
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/meteocima/ensemble-runner/errors"
+	"github.com/meteocima/ensemble-runner/folders"
+	"github.com/meteocima/ensemble-runner/log"
+	"github.com/meteocima/ensemble-runner/mpiman"
+	"github.com/meteocima/ensemble-runner/server"
+)
+
+// relPath returns path relative to the workdir of the simulation.
+func (s *Simulation) relPath(path string) string {
+	return errors.CheckResult(filepath.Rel(s.Workdir, path))
+}
+
+// domainFiles returns the paths of a file inside dir
+// for every configured domain. nameFormat is formatted
+// passing the domain number as argument.
+func (s *Simulation) domainFiles(dir string, nameFormat string) []string {
+	var res []string
+	for domain := 1; domain <= len(s.Conf.Domains); domain++ {
+		res = append(res, join(dir, fmt.Sprintf(nameFormat, domain)))
+	}
+	return res
+}
+
+// metEmFiles returns the paths of the met_em files
+// produced by metgrid for every domain at instant.
+func (s *Simulation) metEmFiles(dir string, instant time.Time) []string {
+	return s.domainFiles(dir, "met_em.d%02d."+instant.Format("2006-01-02_15:04:05")+".nc")
+}
+
+// displayPath returns path relative to $WORKDIR when it's inside
+// the workdir of the simulation, or path itself otherwise.
+func (s *Simulation) displayPath(path string) string {
+	rel := s.relPath(path)
+	if strings.HasPrefix(rel, "..") {
+		return path
+	}
+	return join("$WORKDIR", rel)
+}
+
+// describeCommand returns a Describe function for a
+// step that runs the command returned by cmd in dir.
+func (s *Simulation) describeCommand(dir string, cmd func(alloc mpiman.Allocation) string) func(alloc mpiman.Allocation) string {
+	return func(alloc mpiman.Allocation) string {
+		return fmt.Sprintf("run `%s` in %s", strings.Join(strings.Fields(cmd(alloc)), " "), s.displayPath(dir))
+	}
+}
+
+// renderStep returns a step that calls render to render the
+// template directory `template` into targetDir, for a run
+// starting at start and lasting hours.
+func (s *Simulation) renderStep(targetDir string, template string, start time.Time, hours int, render func()) *Step {
+	return &Step{
+		ID:      "render " + s.relPath(targetDir),
+		Kind:    RenderStep,
+		Workdir: targetDir,
+		Outputs: []string{targetDir},
+		Run: func(mpiman.Allocation) {
+			render()
+		},
+		Describe: func(mpiman.Allocation) string {
+			return fmt.Sprintf("render template `%s` from %s for %d hours in %s", template, start.Format(ShortDtFormat), hours, s.displayPath(targetDir))
+		},
+	}
+}
+
+func (s *Simulation) copyStep(src, dst string) *Step {
+	return &Step{
+		ID:      fmt.Sprintf("copy %s %s", s.relPath(src), s.relPath(dst)),
+		Kind:    CopyStep,
+		Workdir: filepath.Dir(dst),
+		Inputs:  []string{src},
+		Outputs: []string{dst},
+		Run: func(mpiman.Allocation) {
+			server.CopyFile(s.Workdir, src, dst)
+		},
+		Describe: func(mpiman.Allocation) string {
+			return fmt.Sprintf("copy %s to %s", s.displayPath(src), s.displayPath(dst))
+		},
+	}
+}
+
+func (s *Simulation) realStep(startTime time.Time) *Step {
+	wpsdir := folders.WPSProcWorkdir(s.Workdir)
+	inputs := append([]string{join(wpsdir, "namelist.input")}, s.metEmFiles(wpsdir, startTime)...)
+	outputs := append([]string{join(wpsdir, "wrfbdy_d01")}, s.domainFiles(wpsdir, "wrfinput_d%02d")...)
+
+	return &Step{
+		ID:      "real " + startTime.Format(ShortDtFormat),
+		Kind:    ProcessStep,
+		Workdir: wpsdir,
+		Inputs:  inputs,
+		Outputs: outputs,
+		Procs:   s.Conf.RealProcCount,
+		Run: func(alloc mpiman.Allocation) {
+			s.RunReal(startTime, alloc)
+		},
+		Describe: s.describeCommand(wpsdir, s.realCommand),
+	}
+}
+
+func (s *Simulation) daStep(startTime time.Time, domain int) *Step {
+	dadir := folders.DAProcWorkdir(s.Workdir, startTime, domain)
+	inputs := []string{join(dadir, "fg")}
+	outputs := []string{join(dadir, "wrfvar_output")}
+	if domain == 1 {
+		// boundary conditions of the outer domain
+		// are updated by da_wrfvar.exe in place.
+		inputs = append(inputs, join(dadir, "wrfbdy_d01"))
+		outputs = append(outputs, join(dadir, "wrfbdy_d01"))
+	}
+
+	return &Step{
+		ID:      fmt.Sprintf("da_wrfvar %s d%02d", startTime.Format(ShortDtFormat), domain),
+		Kind:    ProcessStep,
+		Workdir: dadir,
+		Inputs:  inputs,
+		Outputs: outputs,
+		Procs:   s.Conf.WrfdaProcCount,
+		Run: func(alloc mpiman.Allocation) {
+			s.RunDa(startTime, domain, alloc)
+		},
+		Describe: s.describeCommand(dadir, s.daCommand),
+	}
+}
+
+func (s *Simulation) wrfStep(startTime time.Time) *Step {
+	wrfdir := folders.WrfControlProcWorkdir(s.Workdir, startTime)
+	inputs := append([]string{join(wrfdir, "wrfbdy_d01")}, s.domainFiles(wrfdir, "wrfinput_d%02d")...)
+
+	return &Step{
+		ID:      "wrf " + startTime.Format(ShortDtFormat),
+		Kind:    ProcessStep,
+		Workdir: wrfdir,
+		Inputs:  inputs,
+		Outputs: s.domainFiles(wrfdir, "wrfvar_input_d%02d"),
+		Procs:   s.Conf.WrfStepProcCount,
+		Run: func(alloc mpiman.Allocation) {
+			s.RunWrfStep(startTime, alloc)
+		},
+		Describe: s.describeCommand(wrfdir, func(alloc mpiman.Allocation) string {
+			return s.wrfCommand(s.Conf.WrfStepProcCount, alloc)
+		}),
+	}
+}
+
+// forecastStep returns the step that runs the control
+// forecast when ensnum is 0, or the ensemble member
+// ensnum otherwise.
+func (s *Simulation) forecastStep(ensnum int) *Step {
+	var wrfdir string
+	var id, descr string
+	priority := 0
+	if ensnum == 0 {
+		wrfdir = folders.WrfControlProcWorkdir(s.Workdir, s.Start)
+		id = "wrf control"
+		descr = "Control forecast"
+	} else {
+		wrfdir = folders.WrfEnsembleProcWorkdir(s.Workdir, s.Start, ensnum)
+		id = fmt.Sprintf("wrf ens%d", ensnum)
+		descr = fmt.Sprintf("Member %d", ensnum)
+		// members wait for the control forecast, and
+		// for the steps it depends on, to get cores
+		priority = -1
+	}
+	inputs := append([]string{join(wrfdir, "wrfbdy_d01")}, s.domainFiles(wrfdir, "wrfinput_d%02d")...)
+	// the files written by wrf.exe depend on the output
+	// intervals of the template, so the whole workdir
+	// is declared as output.
+	outputs := []string{wrfdir}
+
+	return &Step{
+		ID:       id,
+		Kind:     ForecastStep,
+		Workdir:  wrfdir,
+		Inputs:   inputs,
+		Outputs:  outputs,
+		Procs:    s.Conf.WrfProcCount,
+		Priority: priority,
+		Run: func(alloc mpiman.Allocation) {
+			if err := s.RunWrfEnsemble(s.Start, ensnum, alloc); err != nil {
+				log.Error("%s failed: %s", descr, err)
+				errors.FailErr(err)
+			}
+		},
+		Describe: s.describeCommand(wrfdir, func(alloc mpiman.Allocation) string {
+			return s.wrfCommand(s.Conf.WrfProcCount, alloc)
+		}),
+	}
+}
@@ -225,3 +225,26 @@ func ShowProgress(r io.Reader, start, end time.Time) chan Progress {
 	}()
 	return ch
 }
+
+// RestartsWritten reads the log of wrf.exe from r, and returns the
+// domains whose restart files were completely written, indexed by
+// the instant of the files: the one reached by the last time step
+// of the domain logged before the files were written. The restarts
+// read before an error, such as a line truncated because wrf.exe
+// was killed, are returned together with the error.
+func RestartsWritten(r io.Reader) (map[time.Time][]int, error) {
+	p := Parser{R: r}
+	instants := map[int64]time.Time{}
+	res := map[time.Time][]int{}
+	for p.Read() {
+		switch {
+		case p.Curr.Type == CalcLine:
+			instants[p.Curr.Domain] = p.Curr.Instant
+		case p.Curr.Type == FileOutLine && p.Curr.Filename == "restart":
+			if instant, ok := instants[p.Curr.Domain]; ok {
+				res[instant] = append(res[instant], int(p.Curr.Domain))
+			}
+		}
+	}
+	return res, p.Err
+}
@@ -3,6 +3,7 @@ package wrfprocs_test
 import (
 	"embed"
 	"io/fs"
+	"strings"
 	"testing"
 	"time"
 
@@ -87,3 +88,24 @@ func TestParser(t *testing.T) {
 	})
 
 }
+
+func TestRestartsWritten(t *testing.T) {
+	log := strings.Join([]string{
+		"Timing for main: time 2022-11-11_06:00:00 on domain   1:    0.51234 elapsed seconds",
+		"Timing for main: time 2022-11-11_06:00:00 on domain   2:    0.51234 elapsed seconds",
+		"Timing for Writing restart for domain        1:    1.23456 elapsed seconds",
+		"Timing for Writing wrfout_d02_2022-11-11_06:00:00 for domain        2:    0.13536 elapsed seconds",
+		"Timing for Writing restart for domain        2:    1.23456 elapsed seconds",
+		"Timing for main (dt= 10.00): time 2022-11-11_12:00:00 on domain   1:    0.51234 elapsed seconds",
+		"Timing for Writing restart for domain        1:    1.23456 elapsed seconds",
+		"Timing for Writing restart for domain        3:    1.23456 elapsed seconds",
+		"Timing for main: time 2022-11-11_12:00:00 on",
+	}, "\n")
+
+	restarts, err := wrfprocs.RestartsWritten(strings.NewReader(log))
+	assert.Error(t, err)
+	assert.Equal(t, map[time.Time][]int{
+		time.Date(2022, 11, 11, 6, 0, 0, 0, time.UTC):  {1, 2},
+		time.Date(2022, 11, 11, 12, 0, 0, 0, time.UTC): {1},
+	}, restarts)
+}